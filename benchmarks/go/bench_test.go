@@ -59,6 +59,20 @@ func BenchmarkParseToolCall(b *testing.B) {
 	}
 }
 
+func BenchmarkParseToolCallInto(b *testing.B) {
+	b.ReportAllocs()
+	enc := mustLoadEncoding(b)
+	tokens := encodeToolCallTokens(b, enc)
+	author := harmony.RoleAssistant
+	var msgs []harmony.Message
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := enc.ParseMessagesInto(&msgs, tokens, &author); err != nil {
+			b.Fatalf("parse: %v", err)
+		}
+	}
+}
+
 func BenchmarkStreamParseToolCall(b *testing.B) {
 	b.ReportAllocs()
 	enc := mustLoadEncoding(b)
@@ -81,6 +95,29 @@ func BenchmarkStreamParseToolCall(b *testing.B) {
 	}
 }
 
+func BenchmarkStreamParseToolCallCurrentContent(b *testing.B) {
+	b.ReportAllocs()
+	enc := mustLoadEncoding(b)
+	tokens := encodeToolCallTokens(b, enc)
+	author := harmony.RoleAssistant
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		parser, err := harmony.NewStreamParser(enc, &author)
+		if err != nil {
+			b.Fatalf("stream parser: %v", err)
+		}
+		for _, tok := range tokens {
+			if err := parser.Process(tok); err != nil {
+				b.Fatalf("stream parse: %v", err)
+			}
+			_ = parser.CurrentContent()
+		}
+		if err := parser.ProcessEOS(); err != nil {
+			b.Fatalf("stream parse eos: %v", err)
+		}
+	}
+}
+
 func BenchmarkParseLargeCompletion(b *testing.B) {
 	b.ReportAllocs()
 	enc := mustLoadEncoding(b)
@@ -164,3 +201,24 @@ func largeCompletionTokens(tb testing.TB, enc *harmony.Encoding) []uint32 {
 	}
 	return tokens
 }
+
+// BenchmarkRenderManySmallMessages renders short named messages with
+// recipients, where per-message header and sink overhead dominates.
+func BenchmarkRenderManySmallMessages(b *testing.B) {
+	b.ReportAllocs()
+	enc := mustLoadEncoding(b)
+	var convo harmony.Conversation
+	for i := 0; i < 50; i++ {
+		convo.Messages = append(convo.Messages,
+			harmony.Message{Author: harmony.Author{Role: harmony.RoleUser, Name: "alice"}, Content: []harmony.Content{{Type: harmony.ContentText, Text: "ok"}}},
+			harmony.Message{Author: harmony.Author{Role: harmony.RoleAssistant}, Recipient: "functions.lookup", Channel: "commentary", Content: []harmony.Content{{Type: harmony.ContentText, Text: "{}"}}},
+		)
+	}
+	cfg := &harmony.RenderConversationConfig{AutoDropAnalysis: true}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := enc.RenderConversation(convo, cfg); err != nil {
+			b.Fatalf("render: %v", err)
+		}
+	}
+}
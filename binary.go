@@ -0,0 +1,326 @@
+package harmony
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// binaryFormatVersion is the leading byte of the Conversation binary encoding.
+// Version 1 predates SystemContent.ExtraSections and version 2 does not tell
+// nil from empty tool maps; both are still decoded.
+const binaryFormatVersion = 3
+
+var errBinaryTruncated = errors.New("truncated binary conversation")
+
+// MarshalBinary implements encoding.BinaryMarshaler with a compact, versioned
+// encoding of the conversation. Tool maps are written in key order, so equal
+// conversations produce equal bytes. Message.JSON is not encoded.
+func (c Conversation) MarshalBinary() ([]byte, error) {
+	w := binWriter{buf: []byte{binaryFormatVersion}}
+	w.uvarint(uint64(len(c.Messages)))
+	for i := range c.Messages {
+		if err := w.message(&c.Messages[i]); err != nil {
+			return nil, fmt.Errorf("message %d: %w", i, err)
+		}
+	}
+	return w.buf, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler for data produced by
+// MarshalBinary.
+func (c *Conversation) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errBinaryTruncated
+	}
+	if data[0] == 0 || data[0] > binaryFormatVersion {
+		return fmt.Errorf("unsupported binary conversation version %d", data[0])
+	}
+	r := binReader{buf: data[1:], version: data[0]}
+	n := r.count()
+	var msgs []Message
+	if n > 0 {
+		msgs = make([]Message, n)
+	}
+	for i := range msgs {
+		r.message(&msgs[i])
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.buf) != 0 {
+		return fmt.Errorf("%d trailing bytes after binary conversation", len(r.buf))
+	}
+	c.Messages = msgs
+	return nil
+}
+
+type binWriter struct{ buf []byte }
+
+func (w *binWriter) uvarint(v uint64) { w.buf = binary.AppendUvarint(w.buf, v) }
+func (w *binWriter) str(s string)     { w.uvarint(uint64(len(s))); w.buf = append(w.buf, s...) }
+
+func (w *binWriter) bool(b bool) {
+	if b {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *binWriter) optStr(p *string) {
+	w.bool(p != nil)
+	if p != nil {
+		w.str(*p)
+	}
+}
+
+func (w *binWriter) strs(ss []string) {
+	w.uvarint(uint64(len(ss)))
+	for _, s := range ss {
+		w.str(s)
+	}
+}
+
+func (w *binWriter) message(m *Message) error {
+	w.str(string(m.Author.Role))
+	w.str(m.Author.Name)
+	w.str(m.Recipient)
+	w.str(m.Channel)
+	w.str(m.ContentType)
+	w.uvarint(uint64(len(m.Content)))
+	for i := range m.Content {
+		c := &m.Content[i]
+		w.str(string(c.Type))
+		switch c.Type {
+		case ContentText:
+			w.str(c.Text)
+		case ContentSystem:
+			if c.System == nil {
+				return errors.New("nil SystemContent")
+			}
+			w.system(c.System)
+		case ContentDeveloper:
+			if c.Developer == nil {
+				return errors.New("nil DeveloperContent")
+			}
+			w.optStr(c.Developer.Instructions)
+			w.tools(c.Developer.Tools)
+		default:
+			return fmt.Errorf("unknown content type: %v", c.Type)
+		}
+	}
+	return nil
+}
+
+func (w *binWriter) system(s *SystemContent) {
+	w.optStr(s.ModelIdentity)
+	w.optStr((*string)(s.ReasoningEffort))
+	w.bool(s.ReasoningBudget != nil)
+	if s.ReasoningBudget != nil {
+		w.buf = binary.AppendVarint(w.buf, int64(*s.ReasoningBudget))
+	}
+	w.tools(s.Tools)
+	w.optStr(s.ConversationStartDate)
+	w.optStr(s.KnowledgeCutoff)
+	w.bool(s.ChannelConfig != nil)
+	if s.ChannelConfig != nil {
+		w.strs(s.ChannelConfig.ValidChannels)
+		w.bool(s.ChannelConfig.ChannelRequired)
+	}
+	w.strs(s.ExtraSections)
+}
+
+func (w *binWriter) tools(m map[string]ToolNamespaceConfig) {
+	w.bool(m != nil)
+	if m == nil {
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w.uvarint(uint64(len(keys)))
+	for _, k := range keys {
+		ns := m[k]
+		w.str(k)
+		w.str(ns.Name)
+		w.optStr(ns.Description)
+		w.uvarint(uint64(len(ns.Tools)))
+		for i := range ns.Tools {
+			td := &ns.Tools[i]
+			w.str(td.Name)
+			w.str(td.Description)
+			w.str(string(td.Parameters))
+			w.strs(td.PropertyOrder)
+		}
+	}
+}
+
+// binReader decodes binWriter output. The first error sticks; later reads
+// return zero values.
+type binReader struct {
+	buf     []byte
+	err     error
+	version byte
+}
+
+func (r *binReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errBinaryTruncated
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+// count reads a length prefix, rejecting values that cannot fit in the
+// remaining input (every element takes at least one byte).
+func (r *binReader) count() int {
+	v := r.uvarint()
+	if v > uint64(len(r.buf)) {
+		r.err = errBinaryTruncated
+		return 0
+	}
+	return int(v)
+}
+
+func (r *binReader) str() string {
+	n := r.count()
+	if r.err != nil {
+		return ""
+	}
+	s := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return s
+}
+
+func (r *binReader) bool() bool {
+	if r.err != nil {
+		return false
+	}
+	if len(r.buf) == 0 {
+		r.err = errBinaryTruncated
+		return false
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b != 0
+}
+
+func (r *binReader) optStr() *string {
+	if !r.bool() {
+		return nil
+	}
+	s := r.str()
+	return &s
+}
+
+func (r *binReader) strs() []string {
+	n := r.count()
+	if n == 0 {
+		return nil
+	}
+	out := make([]string, n)
+	for i := range out {
+		out[i] = r.str()
+	}
+	return out
+}
+
+func (r *binReader) message(m *Message) {
+	m.Author.Role = Role(r.str())
+	m.Author.Name = r.str()
+	m.Recipient = r.str()
+	m.Channel = r.str()
+	m.ContentType = r.str()
+	n := r.count()
+	if n == 0 {
+		return
+	}
+	m.Content = make([]Content, n)
+	for i := range m.Content {
+		c := &m.Content[i]
+		c.Type = ContentType(r.str())
+		switch c.Type {
+		case ContentText:
+			c.Text = r.str()
+		case ContentSystem:
+			c.System = r.system()
+		case ContentDeveloper:
+			c.Developer = &DeveloperContent{Instructions: r.optStr(), Tools: r.tools()}
+		default:
+			if r.err == nil {
+				r.err = fmt.Errorf("unknown content type: %v", c.Type)
+			}
+			return
+		}
+	}
+}
+
+func (r *binReader) system() *SystemContent {
+	s := &SystemContent{ModelIdentity: r.optStr()}
+	if eff := r.optStr(); eff != nil {
+		s.ReasoningEffort = (*ReasoningEffort)(eff)
+	}
+	if r.bool() {
+		v, n := binary.Varint(r.buf)
+		if n <= 0 {
+			if r.err == nil {
+				r.err = errBinaryTruncated
+			}
+		} else {
+			r.buf = r.buf[n:]
+			budget := int(v)
+			s.ReasoningBudget = &budget
+		}
+	}
+	s.Tools = r.tools()
+	s.ConversationStartDate = r.optStr()
+	s.KnowledgeCutoff = r.optStr()
+	if r.bool() {
+		s.ChannelConfig = &ChannelConfig{ValidChannels: r.strs(), ChannelRequired: r.bool()}
+	}
+	if r.version >= 2 {
+		s.ExtraSections = r.strs()
+	}
+	return s
+}
+
+func (r *binReader) tools() map[string]ToolNamespaceConfig {
+	if r.version >= 3 && !r.bool() {
+		return nil
+	}
+	n := r.count()
+	if n == 0 {
+		if r.version < 3 {
+			return nil
+		}
+		return map[string]ToolNamespaceConfig{}
+	}
+	out := make(map[string]ToolNamespaceConfig, n)
+	for range n {
+		key := r.str()
+		ns := ToolNamespaceConfig{Name: r.str(), Description: r.optStr()}
+		if nt := r.count(); nt > 0 {
+			ns.Tools = make([]ToolDescription, nt)
+			for i := range ns.Tools {
+				td := &ns.Tools[i]
+				td.Name = r.str()
+				td.Description = r.str()
+				if p := r.str(); p != "" {
+					td.Parameters = []byte(p)
+				}
+				td.PropertyOrder = r.strs()
+			}
+		}
+		out[key] = ns
+	}
+	return out
+}
@@ -0,0 +1,154 @@
+package harmony
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func binaryTestConversation() Conversation {
+	effort := ReasoningHigh
+	budget := -1
+	return Conversation{Messages: []Message{
+		{
+			Author: Author{Role: RoleSystem},
+			Content: []Content{{Type: ContentSystem, System: &SystemContent{
+				ModelIdentity:   strPtr("model"),
+				ReasoningEffort: &effort,
+				ReasoningBudget: &budget,
+				KnowledgeCutoff: strPtr("2024-06"),
+				ExtraSections:   []string{"# Style\nTerse."},
+				ChannelConfig:   &ChannelConfig{ValidChannels: []string{"analysis", "final"}, ChannelRequired: true},
+				Tools: map[string]ToolNamespaceConfig{
+					"browser": {Name: "browser", Description: strPtr("Browse."), Tools: []ToolDescription{{Name: "search"}}},
+					"python":  {Name: "python"},
+				},
+			}}},
+		},
+		{
+			Author: Author{Role: RoleDeveloper},
+			Content: []Content{{Type: ContentDeveloper, Developer: &DeveloperContent{
+				Instructions: strPtr("Be brief."),
+				Tools: map[string]ToolNamespaceConfig{"functions": {
+					Name: "functions",
+					Tools: []ToolDescription{{
+						Name:          "f",
+						Description:   "does f",
+						Parameters:    json.RawMessage(`{"type":"object"}`),
+						PropertyOrder: []string{"b", "a"},
+					}},
+				}},
+			}}},
+		},
+		{Author: Author{Role: RoleUser, Name: "alice"}, Content: []Content{{Type: ContentText, Text: "hi"}}},
+		{Author: Author{Role: RoleAssistant}, Recipient: "functions.f", Channel: "commentary", ContentType: "<|constrain|>json", Content: []Content{{Type: ContentText, Text: "{}"}}},
+	}}
+}
+
+func TestConversationBinaryRoundTrip(t *testing.T) {
+	conv := binaryTestConversation()
+	data, err := conv.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	var got Conversation
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if !reflect.DeepEqual(got, conv) {
+		t.Fatalf("round-trip mismatch\n got: %+v\nwant: %+v", got, conv)
+	}
+
+	for range 5 {
+		again, err := binaryTestConversation().MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary: %v", err)
+		}
+		if !bytes.Equal(again, data) {
+			t.Fatalf("encoding is not deterministic")
+		}
+	}
+}
+
+func TestConversationBinaryDecodesVersion1(t *testing.T) {
+	conv := Conversation{Messages: []Message{{
+		Author:  Author{Role: RoleSystem},
+		Content: []Content{{Type: ContentSystem, System: &SystemContent{KnowledgeCutoff: strPtr("2024-06")}}},
+	}}}
+	data, err := conv.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	// With nil tools, version 1 is the same layout without the trailing
+	// ExtraSections count: the absent-tools flag reads as a zero tool count.
+	v1 := append([]byte{1}, data[1:len(data)-1]...)
+	var got Conversation
+	if err := got.UnmarshalBinary(v1); err != nil {
+		t.Fatalf("UnmarshalBinary v1: %v", err)
+	}
+	if !reflect.DeepEqual(got, conv) {
+		t.Fatalf("v1 mismatch\n got: %+v\nwant: %+v", got, conv)
+	}
+}
+
+func TestConversationEmptyToolsRoundTrip(t *testing.T) {
+	empty := map[string]ToolNamespaceConfig{}
+	conv := Conversation{Messages: []Message{
+		{Author: Author{Role: RoleSystem}, Content: []Content{{Type: ContentSystem, System: &SystemContent{Tools: empty}}}},
+		{Author: Author{Role: RoleDeveloper}, Content: []Content{{Type: ContentDeveloper, Developer: &DeveloperContent{Tools: empty}}}},
+		{Author: Author{Role: RoleDeveloper}, Content: []Content{{Type: ContentDeveloper, Developer: &DeveloperContent{}}}},
+	}}
+	check := func(name string, got Conversation) {
+		t.Helper()
+		if got.Messages[0].Content[0].System.Tools == nil || got.Messages[1].Content[0].Developer.Tools == nil {
+			t.Fatalf("%s: empty tool map decoded as nil", name)
+		}
+		if got.Messages[2].Content[0].Developer.Tools != nil {
+			t.Fatalf("%s: nil tool map decoded as non-nil", name)
+		}
+	}
+
+	data, err := conv.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	var bin Conversation
+	if err := bin.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	check("binary", bin)
+
+	raw, err := json.Marshal(conv)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if n := bytes.Count(raw, []byte(`"tools"`)); n != 2 {
+		t.Fatalf("want tools keys for the two empty maps only, got %d: %s", n, raw)
+	}
+	var js Conversation
+	if err := json.Unmarshal(raw, &js); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	check("json", js)
+}
+
+func TestConversationBinaryRejectsBadInput(t *testing.T) {
+	data, err := binaryTestConversation().MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	var c Conversation
+	for n := 0; n < len(data); n++ {
+		if err := c.UnmarshalBinary(data[:n]); err == nil {
+			t.Fatalf("expected error for input truncated to %d bytes", n)
+		}
+	}
+	bad := append([]byte{binaryFormatVersion + 1}, data[1:]...)
+	if err := c.UnmarshalBinary(bad); err == nil {
+		t.Fatalf("expected error for unknown version")
+	}
+	if err := c.UnmarshalBinary(append(data, 0)); err == nil {
+		t.Fatalf("expected error for trailing bytes")
+	}
+}
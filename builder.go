@@ -0,0 +1,168 @@
+package harmony
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// ConversationBuilder appends messages while enforcing Harmony turn order:
+// an optional system message first, then an optional developer message, then
+// user turns each answered by one or more assistant messages. Tool results
+// must answer an outstanding tool call and are followed by the assistant.
+// Each method returns an error and leaves the conversation unchanged when
+// the message would break these rules. The zero value is an empty builder.
+type ConversationBuilder struct {
+	msgs []Message
+	// pending counts tool calls without a result, keyed by recipient.
+	pending map[string]int
+	// seenUser records whether a user message has been added.
+	seenUser bool
+}
+
+// NewConversationBuilder returns an empty builder.
+func NewConversationBuilder() *ConversationBuilder {
+	return &ConversationBuilder{}
+}
+
+// System adds the system message. It must be the first message.
+func (b *ConversationBuilder) System(sys SystemContent) error {
+	if len(b.msgs) > 0 {
+		return errors.New("system message must be the first message")
+	}
+	b.msgs = append(b.msgs, Message{
+		Author:  Author{Role: RoleSystem},
+		Content: []Content{{Type: ContentSystem, System: &sys}},
+	})
+	return nil
+}
+
+// Developer adds the developer message. It must precede all user and
+// assistant messages and may appear once.
+func (b *ConversationBuilder) Developer(dev DeveloperContent) error {
+	for _, m := range b.msgs {
+		switch m.Author.Role {
+		case RoleSystem:
+		case RoleDeveloper:
+			return errors.New("developer message already added")
+		default:
+			return errors.New("developer message must come before the first user message")
+		}
+	}
+	b.msgs = append(b.msgs, Message{
+		Author:  Author{Role: RoleDeveloper},
+		Content: []Content{{Type: ContentDeveloper, Developer: &dev}},
+	})
+	return nil
+}
+
+// User adds a user message. It cannot follow another user message or a tool
+// result, nor be added while tool calls await results.
+func (b *ConversationBuilder) User(text string) error {
+	if err := b.checkNoPending("user message"); err != nil {
+		return err
+	}
+	switch b.lastRole() {
+	case RoleUser:
+		return errors.New("user message cannot follow another user message")
+	case RoleTool:
+		return errors.New("user message cannot follow a tool result; the assistant must respond first")
+	}
+	b.msgs = append(b.msgs, textMessage(RoleUser, text))
+	b.seenUser = true
+	return nil
+}
+
+// Assistant adds an assistant message on channel. Several assistant
+// messages may follow one user turn (e.g. analysis then final) until one is
+// on the final channel, which ends the turn.
+func (b *ConversationBuilder) Assistant(channel, text string) error {
+	if err := b.checkAssistantTurn("assistant message"); err != nil {
+		return err
+	}
+	m := textMessage(RoleAssistant, text)
+	m.Channel = channel
+	b.msgs = append(b.msgs, m)
+	return nil
+}
+
+// ToolCall adds an assistant call to namespaceTool (e.g.
+// "functions.get_weather") on the commentary channel with argsJSON as the
+// constrained-JSON body. The call must be answered by ToolResult before the
+// next user message.
+func (b *ConversationBuilder) ToolCall(namespaceTool, argsJSON string) error {
+	if namespaceTool == "" {
+		return errors.New("tool call needs a recipient")
+	}
+	if !json.Valid([]byte(argsJSON)) {
+		return fmt.Errorf("tool call to %s: arguments are not valid JSON", namespaceTool)
+	}
+	if err := b.checkAssistantTurn("tool call"); err != nil {
+		return err
+	}
+	m := textMessage(RoleAssistant, argsJSON)
+	m.Recipient = namespaceTool
+	m.Channel = "commentary"
+	m.ContentType = "<|constrain|>json"
+	b.msgs = append(b.msgs, m)
+	if b.pending == nil {
+		b.pending = map[string]int{}
+	}
+	b.pending[namespaceTool]++
+	return nil
+}
+
+// ToolResult adds the output of the tool name, which must match the recipient
+// of an earlier ToolCall that has no result yet.
+func (b *ConversationBuilder) ToolResult(name, text string) error {
+	if b.pending[name] == 0 {
+		return fmt.Errorf("tool result from %s without a preceding call", name)
+	}
+	b.msgs = append(b.msgs, NewToolResult(name, text, false))
+	if b.pending[name]--; b.pending[name] == 0 {
+		delete(b.pending, name)
+	}
+	return nil
+}
+
+// Conversation returns the messages added so far. The returned slice is a
+// copy; later calls on the builder do not change it.
+func (b *ConversationBuilder) Conversation() Conversation {
+	var c Conversation
+	c.FromMessages(b.msgs)
+	return c
+}
+
+func (b *ConversationBuilder) lastRole() Role {
+	if len(b.msgs) == 0 {
+		return ""
+	}
+	return b.msgs[len(b.msgs)-1].Author.Role
+}
+
+func (b *ConversationBuilder) checkNoPending(what string) error {
+	if len(b.pending) == 0 {
+		return nil
+	}
+	name := slices.Sorted(maps.Keys(b.pending))[0]
+	return fmt.Errorf("%s while the call to %s has no result", what, name)
+}
+
+// checkAssistantTurn reports whether an assistant message may be added: a
+// user message must have been seen and the last assistant message, if it
+// ended the turn on the final channel, must have been followed by a user.
+func (b *ConversationBuilder) checkAssistantTurn(what string) error {
+	if !b.seenUser {
+		return fmt.Errorf("%s before any user message", what)
+	}
+	if last := b.msgs[len(b.msgs)-1]; last.Author.Role == RoleAssistant && last.Channel == "final" {
+		return fmt.Errorf("%s after a final answer; add a user message first", what)
+	}
+	return nil
+}
+
+func textMessage(role Role, text string) Message {
+	return Message{Author: Author{Role: role}, Content: []Content{{Type: ContentText, Text: text}}}
+}
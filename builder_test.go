@@ -0,0 +1,130 @@
+package harmony
+
+import "testing"
+
+func TestConversationBuilder(t *testing.T) {
+	b := NewConversationBuilder()
+	steps := []func() error{
+		func() error { return b.System(SystemContent{}) },
+		func() error { return b.Developer(DeveloperContent{Instructions: strPtr("Be brief.")}) },
+		func() error { return b.User("Weather in Oslo?") },
+		func() error { return b.Assistant("analysis", "Need the weather tool.") },
+		func() error { return b.ToolCall("functions.get_weather", `{"city":"Oslo"}`) },
+		func() error { return b.ToolResult("functions.get_weather", `{"temp":3}`) },
+		func() error { return b.Assistant("final", "3°C.") },
+		func() error { return b.User("Thanks!") },
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+	}
+	conv := b.Conversation()
+	if len(conv.Messages) != len(steps) {
+		t.Fatalf("got %d messages, want %d", len(conv.Messages), len(steps))
+	}
+	call, result := conv.Messages[4], conv.Messages[5]
+	if call.Recipient != "functions.get_weather" || call.Channel != "commentary" || call.ContentType != "<|constrain|>json" {
+		t.Fatalf("unexpected tool call: %+v", call)
+	}
+	if result.Author != (Author{Role: RoleTool, Name: "functions.get_weather"}) || result.Recipient != "assistant" {
+		t.Fatalf("unexpected tool result: %+v", result)
+	}
+	if err := conv.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if _, err := mustEncoding(t).RenderConversation(conv, nil); err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	_ = b.Assistant("final", "You're welcome.")
+	if len(conv.Messages) != len(steps) {
+		t.Fatal("Conversation result changed by later builder calls")
+	}
+}
+
+func TestConversationBuilderRejectsIllegalTransitions(t *testing.T) {
+	cases := []struct {
+		name  string
+		steps []func(b *ConversationBuilder) error
+	}{
+		{"system after user", []func(*ConversationBuilder) error{
+			func(b *ConversationBuilder) error { return b.User("hi") },
+			func(b *ConversationBuilder) error { return b.System(SystemContent{}) },
+		}},
+		{"developer after user", []func(*ConversationBuilder) error{
+			func(b *ConversationBuilder) error { return b.User("hi") },
+			func(b *ConversationBuilder) error { return b.Developer(DeveloperContent{}) },
+		}},
+		{"second developer", []func(*ConversationBuilder) error{
+			func(b *ConversationBuilder) error { return b.Developer(DeveloperContent{}) },
+			func(b *ConversationBuilder) error { return b.Developer(DeveloperContent{}) },
+		}},
+		{"assistant first", []func(*ConversationBuilder) error{
+			func(b *ConversationBuilder) error { return b.Assistant("final", "hello") },
+		}},
+		{"two users", []func(*ConversationBuilder) error{
+			func(b *ConversationBuilder) error { return b.User("a") },
+			func(b *ConversationBuilder) error { return b.User("b") },
+		}},
+		{"assistant after final", []func(*ConversationBuilder) error{
+			func(b *ConversationBuilder) error { return b.User("a") },
+			func(b *ConversationBuilder) error { return b.Assistant("final", "b") },
+			func(b *ConversationBuilder) error { return b.Assistant("final", "c") },
+		}},
+		{"result without call", []func(*ConversationBuilder) error{
+			func(b *ConversationBuilder) error { return b.User("a") },
+			func(b *ConversationBuilder) error { return b.ToolResult("functions.f", "x") },
+		}},
+		{"user with pending call", []func(*ConversationBuilder) error{
+			func(b *ConversationBuilder) error { return b.User("a") },
+			func(b *ConversationBuilder) error { return b.ToolCall("functions.f", "{}") },
+			func(b *ConversationBuilder) error { return b.User("b") },
+		}},
+		{"user after tool result", []func(*ConversationBuilder) error{
+			func(b *ConversationBuilder) error { return b.User("a") },
+			func(b *ConversationBuilder) error { return b.ToolCall("functions.f", "{}") },
+			func(b *ConversationBuilder) error { return b.ToolResult("functions.f", "x") },
+			func(b *ConversationBuilder) error { return b.User("b") },
+		}},
+		{"invalid args", []func(*ConversationBuilder) error{
+			func(b *ConversationBuilder) error { return b.User("a") },
+			func(b *ConversationBuilder) error { return b.ToolCall("functions.f", "{") },
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := NewConversationBuilder()
+			last := len(tc.steps) - 1
+			for i, step := range tc.steps[:last] {
+				if err := step(b); err != nil {
+					t.Fatalf("setup step %d: %v", i, err)
+				}
+			}
+			if err := tc.steps[last](b); err == nil {
+				t.Fatal("expected error")
+			}
+			if n := len(b.Conversation().Messages); n != last {
+				t.Fatalf("rejected message was added: %d messages", n)
+			}
+		})
+	}
+}
+
+func TestConversationBuilderZeroValue(t *testing.T) {
+	var b ConversationBuilder
+	if err := b.User("Time?"); err != nil {
+		t.Fatalf("User: %v", err)
+	}
+	if err := b.ToolCall("functions.get_time", `{}`); err != nil {
+		t.Fatalf("ToolCall: %v", err)
+	}
+	if err := b.ToolResult("functions.get_time", "12:00"); err != nil {
+		t.Fatalf("ToolResult: %v", err)
+	}
+	if err := b.Assistant("final", "Noon."); err != nil {
+		t.Fatalf("Assistant: %v", err)
+	}
+	if n := len(b.Conversation().Messages); n != 4 {
+		t.Fatalf("got %d messages, want 4", n)
+	}
+}
@@ -0,0 +1,99 @@
+package harmony
+
+import (
+	"encoding/json"
+	"slices"
+)
+
+// Clone returns a deep copy of the conversation: messages, their content
+// items and the system/developer content they point to are copied so edits to
+// the clone never alias the original. Tool parameter caches are not shared;
+// cloned tools re-parse their schema lazily.
+func (c Conversation) Clone() Conversation {
+	if c.Messages == nil {
+		return Conversation{}
+	}
+	msgs := make([]Message, len(c.Messages))
+	for i := range c.Messages {
+		msgs[i] = cloneMessage(c.Messages[i])
+	}
+	return Conversation{Messages: msgs}
+}
+
+func cloneMessage(m Message) Message {
+	if m.JSON != nil {
+		m.JSON = &JSONContent{Raw: slices.Clone(m.JSON.Raw), Valid: m.JSON.Valid}
+	}
+	if m.Content == nil {
+		return m
+	}
+	content := make([]Content, len(m.Content))
+	for i, c := range m.Content {
+		if c.System != nil {
+			c.System = cloneSystemContent(c.System)
+		}
+		if c.Developer != nil {
+			c.Developer = cloneDeveloperContent(c.Developer)
+		}
+		content[i] = c
+	}
+	m.Content = content
+	return m
+}
+
+func cloneSystemContent(s *SystemContent) *SystemContent {
+	out := *s
+	out.ModelIdentity = clonePtr(s.ModelIdentity)
+	out.ReasoningEffort = clonePtr(s.ReasoningEffort)
+	out.ReasoningBudget = clonePtr(s.ReasoningBudget)
+	out.ConversationStartDate = clonePtr(s.ConversationStartDate)
+	out.KnowledgeCutoff = clonePtr(s.KnowledgeCutoff)
+	out.Tools = cloneTools(s.Tools)
+	out.ExtraSections = slices.Clone(s.ExtraSections)
+	if s.ChannelConfig != nil {
+		cc := *s.ChannelConfig
+		cc.ValidChannels = slices.Clone(cc.ValidChannels)
+		out.ChannelConfig = &cc
+	}
+	return &out
+}
+
+func cloneDeveloperContent(d *DeveloperContent) *DeveloperContent {
+	out := *d
+	out.Instructions = clonePtr(d.Instructions)
+	out.Tools = cloneTools(d.Tools)
+	return &out
+}
+
+func cloneTools(tools map[string]ToolNamespaceConfig) map[string]ToolNamespaceConfig {
+	if tools == nil {
+		return nil
+	}
+	out := make(map[string]ToolNamespaceConfig, len(tools))
+	for k, ns := range tools {
+		ns.Description = clonePtr(ns.Description)
+		if ns.Tools != nil {
+			descs := make([]ToolDescription, len(ns.Tools))
+			for i := range ns.Tools {
+				src := &ns.Tools[i]
+				descs[i] = ToolDescription{
+					Name:          src.Name,
+					Description:   src.Description,
+					Parameters:    json.RawMessage(slices.Clone([]byte(src.Parameters))),
+					PropertyOrder: slices.Clone(src.PropertyOrder),
+				}
+			}
+			ns.Tools = descs
+		}
+		out[k] = ns
+	}
+	return out
+}
+
+func clonePtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
@@ -0,0 +1,61 @@
+package harmony
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestConversationCloneDoesNotAlias(t *testing.T) {
+	instr := "original"
+	orig := Conversation{Messages: []Message{
+		{
+			Author: Author{Role: RoleSystem},
+			Content: []Content{{Type: ContentSystem, System: &SystemContent{
+				ModelIdentity: strPtr("model"),
+				ChannelConfig: &ChannelConfig{ValidChannels: []string{"analysis", "final"}},
+			}}},
+		},
+		{
+			Author: Author{Role: RoleDeveloper},
+			Content: []Content{{Type: ContentDeveloper, Developer: &DeveloperContent{
+				Instructions: &instr,
+				Tools: map[string]ToolNamespaceConfig{"functions": {
+					Name:  "functions",
+					Tools: []ToolDescription{{Name: "f", Parameters: json.RawMessage(`{"type":"object"}`)}},
+				}},
+			}}},
+		},
+		{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "hi"}}},
+	}}
+	// Populate the parse cache on the original to check it is not shared.
+	tool := &orig.Messages[1].Content[0].Developer.Tools["functions"].Tools[0]
+	if _, _, err := tool.parsedParameters(); err != nil {
+		t.Fatalf("parsedParameters: %v", err)
+	}
+
+	cl := orig.Clone()
+	cl.Messages[0].Content[0].System.ChannelConfig.ValidChannels[0] = "changed"
+	*cl.Messages[0].Content[0].System.ModelIdentity = "changed"
+	*cl.Messages[1].Content[0].Developer.Instructions = "changed"
+	cl.Messages[1].Content[0].Developer.Tools["functions"].Tools[0].Parameters[2] = 'X'
+	cl.Messages[2].Content[0].Text = "changed"
+
+	if orig.Messages[0].Content[0].System.ChannelConfig.ValidChannels[0] != "analysis" {
+		t.Fatalf("channel config aliased")
+	}
+	if *orig.Messages[0].Content[0].System.ModelIdentity != "model" {
+		t.Fatalf("model identity aliased")
+	}
+	if instr != "original" {
+		t.Fatalf("instructions aliased")
+	}
+	if string(orig.Messages[1].Content[0].Developer.Tools["functions"].Tools[0].Parameters) != `{"type":"object"}` {
+		t.Fatalf("tool parameters aliased")
+	}
+	if orig.Messages[2].Content[0].Text != "hi" {
+		t.Fatalf("text content aliased")
+	}
+	if cl.Messages[1].Content[0].Developer.Tools["functions"].Tools[0].parsed != nil {
+		t.Fatalf("clone should not share the parse cache")
+	}
+}
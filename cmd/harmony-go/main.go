@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/euforicio/harmony-go"
@@ -11,9 +14,50 @@ import (
 
 func die(err error) { fmt.Fprintln(os.Stderr, err); os.Exit(1) }
 
+// maxStreamLine bounds the length of one conversation line read by
+// render-convo-stream.
+const maxStreamLine = 64 << 20
+
+// renderConvoStream reads one conversation per line from r and writes one
+// token array per line to w, rendering all of them with enc. Blank lines are
+// skipped. Errors name the input line; lines already rendered are flushed
+// first, so the output of a failed batch ends at the failing line.
+func renderConvoStream(enc *harmony.Encoding, r io.Reader, w io.Writer) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), maxStreamLine)
+	bw := bufio.NewWriter(w)
+	out := json.NewEncoder(bw)
+	fail := func(err error) error {
+		_ = bw.Flush()
+		return err
+	}
+	line := 0
+	for sc.Scan() {
+		line++
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var convo harmony.Conversation
+		if err := json.Unmarshal(sc.Bytes(), &convo); err != nil {
+			return fail(fmt.Errorf("line %d: %w", line, err))
+		}
+		tok, err := enc.RenderConversation(convo, nil)
+		if err != nil {
+			return fail(fmt.Errorf("line %d: %w", line, err))
+		}
+		if err := out.Encode(tok); err != nil {
+			return fail(err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fail(fmt.Errorf("line %d: %w", line+1, err))
+	}
+	return bw.Flush()
+}
+
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("harmony-go [render-msg|render-convo|render-completion|render-training|parse|decode|stop]")
+		fmt.Println("harmony-go [render-msg|render-convo|render-convo-stream|render-completion|render-training|parse|decode|stop]")
 		return
 	}
 	switch os.Args[1] {
@@ -55,6 +99,14 @@ func main() {
 			die(err)
 		}
 		_ = json.NewEncoder(os.Stdout).Encode(tok)
+	case "render-convo-stream":
+		enc, err := harmony.LoadEncoding(harmony.HarmonyGptOss)
+		if err != nil {
+			die(err)
+		}
+		if err := renderConvoStream(enc, os.Stdin, os.Stdout); err != nil {
+			die(err)
+		}
 	case "render-completion":
 		fs := flag.NewFlagSet("render-completion", flag.ExitOnError)
 		role := fs.String("role", "assistant", "next role")
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/euforicio/harmony-go"
+)
+
+// TestMain runs the command itself when re-executed by runCommand.
+func TestMain(m *testing.M) {
+	if os.Getenv("HARMONY_GO_RUN_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runCommand runs harmony-go with args and stdin and returns its stdout,
+// stderr and exit error.
+func runCommand(t *testing.T, stdin string, args ...string) (string, string, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "HARMONY_GO_RUN_MAIN=1")
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+func TestRenderConvoStream(t *testing.T) {
+	enc, err := harmony.LoadEncoding(harmony.HarmonyGptOss)
+	if err != nil {
+		t.Fatalf("load encoding: %v", err)
+	}
+	convos := []string{
+		`{"messages":[{"role":"user","content":[{"type":"text","text":"hi"}]}]}`,
+		`{"messages":[{"role":"assistant","channel":"final","content":[{"type":"text","text":"hello"}]}]}`,
+	}
+	var want strings.Builder
+	for _, line := range convos {
+		var convo harmony.Conversation
+		if err := json.Unmarshal([]byte(line), &convo); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		tok, err := enc.RenderConversation(convo, nil)
+		if err != nil {
+			t.Fatalf("render: %v", err)
+		}
+		b, _ := json.Marshal(tok)
+		want.Write(b)
+		want.WriteByte('\n')
+	}
+
+	stdout, stderr, err := runCommand(t, convos[0]+"\n\n"+convos[1]+"\n", "render-convo-stream")
+	if err != nil {
+		t.Fatalf("render-convo-stream: %v: %s", err, stderr)
+	}
+	if stdout != want.String() {
+		t.Fatalf("output mismatch\n got: %s\nwant: %s", stdout, want.String())
+	}
+
+	// A bad line fails with its line number after the lines before it.
+	stdout, stderr, err = runCommand(t, convos[0]+"\n\n{not json\n"+convos[1]+"\n", "render-convo-stream")
+	if err == nil {
+		t.Fatal("expected failure for malformed line")
+	}
+	if !strings.HasPrefix(stderr, "line 3: ") {
+		t.Fatalf("error does not name line 3: %q", stderr)
+	}
+	if first, _, _ := strings.Cut(want.String(), "\n"); stdout != first+"\n" {
+		t.Fatalf("expected only the first conversation before the error, got %q", stdout)
+	}
+}
+
+func TestRenderConvoStreamLongLine(t *testing.T) {
+	enc, err := harmony.LoadEncoding(harmony.HarmonyGptOss)
+	if err != nil {
+		t.Fatalf("load encoding: %v", err)
+	}
+	// Longer than bufio.Scanner's default 64 KiB token limit.
+	text := strings.Repeat("a", 1<<20)
+	line := `{"messages":[{"role":"user","content":[{"type":"text","text":"` + text + `"}]}]}`
+	var out bytes.Buffer
+	if err := renderConvoStream(enc, strings.NewReader(line), &out); err != nil {
+		t.Fatalf("renderConvoStream: %v", err)
+	}
+	var tok []uint32
+	if err := json.Unmarshal(out.Bytes(), &tok); err != nil || len(tok) == 0 {
+		t.Fatalf("output %q: %v", out.Bytes()[:min(out.Len(), 64)], err)
+	}
+}
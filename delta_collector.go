@@ -0,0 +1,73 @@
+package harmony
+
+// DeltaCollector accumulates streamed content deltas per channel, e.g. to
+// show analysis and final text in separate panes while tokens arrive. Feed
+// tokens through the collector's Process instead of the parser's.
+type DeltaCollector struct {
+	p     *StreamParser
+	texts map[string][]byte // by channel
+	roles map[Role][]byte   // by role, for messages without a channel
+}
+
+// NewDeltaCollector returns a collector that drives p.
+func (p *StreamParser) NewDeltaCollector() *DeltaCollector {
+	return &DeltaCollector{p: p, texts: map[string][]byte{}, roles: map[Role][]byte{}}
+}
+
+// Process feeds token to the parser and appends any content delta to the
+// text of the current message's channel. Messages without a channel are
+// collected by their role instead, apart from the channels, so a role never
+// shares text with a channel of the same name.
+func (c *DeltaCollector) Process(token uint32) error {
+	if c.p.state != stContent {
+		return c.p.Process(token)
+	}
+	// Capture the key first: a token that ends the message moves the parser
+	// out of the content state, after which the channel is no longer known.
+	channel := c.p.CurrentChannel()
+	var role Role
+	if r := c.p.CurrentRole(); r != nil {
+		role = *r
+	}
+	if err := c.p.Process(token); err != nil {
+		return err
+	}
+	// A token that ends the message leaves the previous delta in place,
+	// except with split-special detection, where the end releases the held
+	// bytes (or the text before a completed literal) as a final delta.
+	if c.p.state != stContent && c.p.splitLits == nil {
+		return nil
+	}
+	if channel != "" {
+		c.texts[channel] = append(c.texts[channel], c.p.lastDeltaBytes...)
+	} else {
+		c.roles[role] = append(c.roles[role], c.p.lastDeltaBytes...)
+	}
+	return nil
+}
+
+// Text returns the text collected so far for channel.
+func (c *DeltaCollector) Text(channel string) string { return string(c.texts[channel]) }
+
+// RoleText returns the text collected so far for messages from role that
+// have no channel.
+func (c *DeltaCollector) RoleText(role Role) string { return string(c.roles[role]) }
+
+// Texts returns a snapshot of the collected text keyed by channel.
+func (c *DeltaCollector) Texts() map[string]string {
+	out := make(map[string]string, len(c.texts))
+	for k, v := range c.texts {
+		out[k] = string(v)
+	}
+	return out
+}
+
+// RoleTexts returns a snapshot of the text of messages without a channel,
+// keyed by role.
+func (c *DeltaCollector) RoleTexts() map[Role]string {
+	out := make(map[Role]string, len(c.roles))
+	for k, v := range c.roles {
+		out[k] = string(v)
+	}
+	return out
+}
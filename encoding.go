@@ -2,12 +2,18 @@ package harmony
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/euforicio/harmony-go/tokenizer"
 )
@@ -20,8 +26,19 @@ const (
 	HarmonyGptOss EncodingName = "HarmonyGptOss"
 )
 
+// FormatVersion identifies the render output format of this library. It is
+// bumped whenever rendering produces different tokens for the same input, so
+// caches keyed on Encoding.Version can be invalidated.
+const FormatVersion = 3
+
 // Encoding provides rendering and parsing for the Harmony format using the
 // O200k tokenizer with Harmony specials.
+//
+// An Encoding is safe for concurrent use by multiple goroutines once loaded;
+// share one across request handlers rather than loading it per request. The
+// values passed in (conversations, tool declarations) are only read, so they
+// may be shared too. A StreamParser or DeltaCollector is not safe for
+// concurrent use; give each stream its own.
 type Encoding struct {
 	name string
 	bpe  *tokenizer.Core // placeholder: expose via thin type alias if needed
@@ -40,21 +57,85 @@ type Encoding struct {
 	stopAssistant map[uint32]struct{}
 	builderPool   sync.Pool
 	bufferPool    sync.Pool
+	parserPool    sync.Pool
+	sinkPool      sync.Pool
+	// msgCache memoizes rendered messages; nil unless WithMessageCache.
+	msgCache *messageCache
+	// hook receives events; nil unless WithEventHook.
+	hook func(Event)
+	// variant is appended to Version for load options that change tokens.
+	variant string
+}
+
+// LoadOption configures LoadEncoding.
+type LoadOption func(*loadConfig)
+
+type loadConfig struct {
+	skipReserved bool
+	messageCache int
+	hook         func(Event)
+	specialIDs   map[string]uint32
+}
+
+// WithoutReservedSpecials skips building the <|reserved_N|> special tokens,
+// which shrinks the special-token tables and speeds up special matching.
+// Reserved ids still decode to their "<|reserved_N|>" literal, but encoding
+// with specials treats reserved literals as plain text.
+func WithoutReservedSpecials() LoadOption {
+	return func(c *loadConfig) { c.skipReserved = true }
+}
+
+// WithMessageCache keeps the rendered tokens of up to size messages in an LRU
+// cache keyed by a hash of the message and the render options, so identical
+// messages re-rendered across turns are not tokenized again. Size <= 0
+// disables the cache.
+func WithMessageCache(size int) LoadOption {
+	return func(c *loadConfig) { c.messageCache = size }
+}
+
+// WithSpecialTokenIDs overrides the ids of formatting tokens, keyed by
+// literal (e.g. "<|call|>"), for models fine-tuned with remapped control
+// tokens. Rendering, parsing, decoding and the stop-token sets all use the
+// new ids; a special that previously held an id is replaced. LoadEncoding
+// fails for literals that are not formatting tokens, for ids used by the
+// ordinary vocabulary or by another formatting token that is not remapped
+// too, and for ids assigned twice.
+func WithSpecialTokenIDs(ids map[string]uint32) LoadOption {
+	ids = maps.Clone(ids)
+	return func(c *loadConfig) { c.specialIDs = ids }
+}
+
+// variant describes the options that change rendered or decoded tokens, for
+// Encoding.Version: "+noreserved" for WithoutReservedSpecials and "+ids-"
+// followed by a digest of the sorted WithSpecialTokenIDs overrides.
+func (c *loadConfig) variant() string {
+	var sb strings.Builder
+	if c.skipReserved {
+		sb.WriteString("+noreserved")
+	}
+	if len(c.specialIDs) > 0 {
+		h := sha256.New()
+		for _, lit := range slices.Sorted(maps.Keys(c.specialIDs)) {
+			fmt.Fprintf(h, "%s=%d\n", lit, c.specialIDs[lit])
+		}
+		fmt.Fprintf(&sb, "+ids-%x", h.Sum(nil)[:8])
+	}
+	return sb.String()
 }
 
 // LoadEncoding returns an encoding by name. Only HarmonyGptOss is supported.
-func LoadEncoding(name EncodingName) (*Encoding, error) {
+func LoadEncoding(name EncodingName, opts ...LoadOption) (*Encoding, error) {
 	if name != HarmonyGptOss {
 		return nil, fmt.Errorf("unsupported encoding: %s", name)
 	}
-	pairs, err := tokenizer.LoadO200k()
-	if err != nil {
-		return nil, err
+	var cfg loadConfig
+	for _, opt := range opts {
+		opt(&cfg)
 	}
 	seg := tokenizer.NewO200kSegmenter()
-	bpe, err := tokenizer.NewCoreBPE(pairs, tokenizer.HarmonySpecials(), seg)
-	if err != nil {
-		return nil, err
+	specials := tokenizer.HarmonySpecials()
+	if cfg.skipReserved {
+		specials = tokenizer.HarmonySpecialsWithoutReserved()
 	}
 	fmtMap := map[string]uint32{
 		"<|start|>":     tokenizer.TokStart,
@@ -66,8 +147,27 @@ func LoadEncoding(name EncodingName) (*Encoding, error) {
 		"<|constrain|>": tokenizer.TokConstrain,
 		"<|channel|>":   tokenizer.TokChannel,
 	}
-	stopAll := map[uint32]struct{}{tokenizer.TokReturn: {}, tokenizer.TokCall: {}, tokenizer.TokEnd: {}}
-	stopAssistant := map[uint32]struct{}{tokenizer.TokReturn: {}, tokenizer.TokCall: {}}
+	if len(cfg.specialIDs) > 0 {
+		if err := overrideSpecialIDs(cfg.specialIDs, fmtMap, specials); err != nil {
+			return nil, err
+		}
+	}
+	load := tokenizer.LoadO200kCore
+	if cfg.skipReserved {
+		load = tokenizer.LoadO200kCoreWithoutReserved
+	}
+	bpe, err := load(specials, seg)
+	if err != nil {
+		return nil, err
+	}
+	for lit, id := range cfg.specialIDs {
+		if bpe.IsOrdinaryToken(id) {
+			return nil, fmt.Errorf("special token id override: %s id %d is an ordinary token", lit, id)
+		}
+	}
+	idEnd, idReturn, idCall := fmtMap["<|end|>"], fmtMap["<|return|>"], fmtMap["<|call|>"]
+	stopAll := map[uint32]struct{}{idReturn: {}, idCall: {}, idEnd: {}}
+	stopAssistant := map[uint32]struct{}{idReturn: {}, idCall: {}}
 	enc := &Encoding{
 		name:          string(name),
 		bpe:           bpe,
@@ -76,6 +176,11 @@ func LoadEncoding(name EncodingName) (*Encoding, error) {
 		stopAssistant: stopAssistant,
 		builderPool:   sync.Pool{New: func() any { return &strings.Builder{} }},
 		bufferPool:    sync.Pool{New: func() any { return &bytes.Buffer{} }},
+		hook:          cfg.hook,
+		variant:       cfg.variant(),
+	}
+	if cfg.messageCache > 0 {
+		enc.msgCache = newMessageCache(cfg.messageCache)
 	}
 	// cache ids
 	enc.idStart = fmtMap["<|start|>"]
@@ -88,9 +193,51 @@ func LoadEncoding(name EncodingName) (*Encoding, error) {
 	return enc, nil
 }
 
+// overrideSpecialIDs applies WithSpecialTokenIDs to the formatting map and
+// the special-token table. A special left holding an overridden id is
+// removed so every id decodes to one literal.
+func overrideSpecialIDs(ids map[string]uint32, fmtMap, specials map[string]uint32) error {
+	owner := make(map[uint32]string, len(ids))
+	for lit, id := range ids {
+		if _, ok := fmtMap[lit]; !ok {
+			return fmt.Errorf("special token id override: %s is not a formatting token", lit)
+		}
+		if prev, dup := owner[id]; dup {
+			return fmt.Errorf("special token id override: %s and %s both map to %d", prev, lit, id)
+		}
+		owner[id] = lit
+	}
+	// An id held by another formatting literal is free only if that literal
+	// moves too; otherwise both would share one id.
+	for lit, id := range fmtMap {
+		if o, ok := owner[id]; ok && o != lit && id != 0 {
+			if _, moved := ids[lit]; !moved {
+				return fmt.Errorf("special token id override: %s id %d is used by %s", o, id, lit)
+			}
+		}
+	}
+	for lit, id := range specials {
+		if o, ok := owner[id]; ok && o != lit {
+			delete(specials, lit)
+		}
+	}
+	for lit, id := range ids {
+		fmtMap[lit] = id
+		specials[lit] = id
+	}
+	return nil
+}
+
 // Name returns the encoding's canonical name.
 func (e *Encoding) Name() string { return e.name }
 
+// Version returns a stable identifier combining the encoding name, the
+// vocabulary checksum, FormatVersion and the load options that change tokens
+// (WithoutReservedSpecials, WithSpecialTokenIDs), suitable for cache keys.
+func (e *Encoding) Version() string {
+	return fmt.Sprintf("%s/o200k-%s/v%d%s", e.name, tokenizer.O200kChecksum(), FormatVersion, e.variant)
+}
+
 // StopTokens returns the set of tokens that terminate any message.
 func (e *Encoding) StopTokens() ([]uint32, error) {
 	out := make([]uint32, 0, len(e.stopAll))
@@ -110,20 +257,113 @@ func (e *Encoding) StopTokensForAssistantActions() ([]uint32, error) {
 	return out, nil
 }
 
+// StopTokenSet returns a copy of the StopTokens set for samplers that test
+// membership per step.
+func (e *Encoding) StopTokenSet() map[uint32]struct{} { return maps.Clone(e.stopAll) }
+
+// AssistantActionStopTokenSet returns a copy of the
+// StopTokensForAssistantActions set.
+func (e *Encoding) AssistantActionStopTokenSet() map[uint32]struct{} {
+	return maps.Clone(e.stopAssistant)
+}
+
 // DecodeUTF8 decodes tokens into a UTF-8 string.
 func (e *Encoding) DecodeUTF8(tokens []uint32) (string, error) {
-	return e.bpe.DecodeUTF8(tokens)
+	s, err := e.bpe.DecodeUTF8(tokens)
+	e.emitErr(err, decodeErrorEvent)
+	return s, err
 }
 
+// DecodePretty decodes tokens for display, e.g. in logs. It is DecodeUTF8
+// under a name that states the guarantee: special tokens decode to their
+// literals ("<|start|>", "<|channel|>", ...) in place, so a rendered
+// conversation reads back as the RenderConversationString prompt.
+func (e *Encoding) DecodePretty(tokens []uint32) (string, error) { return e.DecodeUTF8(tokens) }
+
+// DecodeUTF8Lossy decodes tokens into a string, replacing invalid UTF-8
+// sequences (e.g. a multi-byte character split across a truncated sample)
+// with U+FFFD. hadInvalid reports whether any replacement happened; err is
+// returned only for unknown tokens.
+func (e *Encoding) DecodeUTF8Lossy(tokens []uint32) (s string, hadInvalid bool, err error) {
+	b, err := e.bpe.DecodeBytes(tokens)
+	if err != nil {
+		e.emitErr(err, decodeErrorEvent)
+		return "", false, err
+	}
+	if utf8.Valid(b) {
+		return string(b), false, nil
+	}
+	return strings.ToValidUTF8(string(b), "\uFFFD"), true, nil
+}
+
+// DecodeBytesLenient decodes tokens into bytes without failing on unknown
+// token ids: each one is replaced by placeholder(id), or U+FFFD when
+// placeholder is nil. subs counts the replacements. Use it to show
+// best-effort text from a possibly corrupt stream, e.g.
+//
+//	b, n := enc.DecodeBytesLenient(toks, func(id uint32) string { return fmt.Sprintf("<unk:%d>", id) })
+func (e *Encoding) DecodeBytesLenient(tokens []uint32, placeholder func(id uint32) string) (b []byte, subs int) {
+	return e.bpe.DecodeBytesLenient(tokens, placeholder)
+}
+
+// TokenExplain describes one token of an ordinary encoding; see Explain.
+type TokenExplain = tokenizer.TokenExplain
+
+// Explain encodes text as ordinary text (specials are not recognized) and
+// reports each token's id, bytes and source segment, to show why a word
+// tokenizes the way it does. Intended for debugging only.
+func (e *Encoding) Explain(text string) []TokenExplain { return e.bpe.Explain(text) }
+
+// SpecialTokenID returns the id of the special token with the given literal,
+// e.g. "<|start|>" or "<|reserved_200014|>", reflecting any
+// WithSpecialTokenIDs overrides.
+func (e *Encoding) SpecialTokenID(literal string) (uint32, bool) {
+	return e.bpe.SpecialTokenID(literal)
+}
+
+// SpecialTokenLiteral returns the literal of the special token id; it is the
+// inverse of SpecialTokenID.
+func (e *Encoding) SpecialTokenLiteral(id uint32) (string, bool) {
+	return e.bpe.SpecialTokenLiteral(id)
+}
+
+// DumpVocab returns the loaded decode table indexed by token id, including
+// special tokens as their literal text (e.g. "<|start|>"). Unused ids are nil.
+// It is meant for external tooling that must match the library's vocabulary.
+func (e *Encoding) DumpVocab() ([][]byte, error) { return e.bpe.Vocab() }
+
 // DecodeBytes decodes tokens into raw bytes.
 func (e *Encoding) DecodeBytes(tokens []uint32) ([]byte, error) {
-	return e.bpe.DecodeBytes(tokens)
+	b, err := e.bpe.DecodeBytes(tokens)
+	e.emitErr(err, decodeErrorEvent)
+	return b, err
 }
 
 // Render/Parse API stubs — implemented in subsequent steps.
 
+// renderOptions holds conversation-wide render settings. Fields that change
+// the rendered tokens must also be hashed by cacheKey.
 type renderOptions struct {
 	conversationHasFunctionTools bool
+	validateConstrained          bool
+	knowledgeCutoffLabel         string
+	currentDateLabel             string
+	autoStartDate                string
+	normalizeNewlines            bool
+	noDefaultChannels            bool
+	allowContentSpecials         bool
+	detectRenderedContent        bool
+	sanitizeContent              bool
+	stripZeroWidthSpace          bool
+	instructionsHeader           string
+	toolsHeader                  string
+	omitModelIdentity            bool
+	omitKnowledgeCutoff          bool
+	omitDefaultKnowledgeCutoff   bool
+	omitReasoning                bool
+	emptyToolsSection            bool
+	emptyToolsNote               string
+	toolReturnType               string
 }
 
 // Render encodes a single message into Harmony tokens.
@@ -132,6 +372,43 @@ func (e *Encoding) Render(msg Message) ([]uint32, error) {
 	return e.renderMessage(msg, renderOptions{})
 }
 
+// RenderAppend renders msg as it would appear after conv in
+// RenderConversation with a nil config, for callers that keep their own
+// token buffer and append one message at a time. conv is only consulted for
+// declared function tools, which change how tool calls are checked and
+// rendered; it is not rendered and no completion header is added. A system
+// message appended before the developer message that declares function
+// tools renders without the tools note RenderConversation would add.
+func (e *Encoding) RenderAppend(msg Message, conv Conversation) ([]uint32, error) {
+	opts := renderOptions{conversationHasFunctionTools: hasFunctionTools(conv.Messages)}
+	if opts.conversationHasFunctionTools {
+		if err := checkFunctionCallChannel(len(conv.Messages), msg); err != nil {
+			return nil, err
+		}
+	}
+	return e.renderMessage(msg, opts)
+}
+
+// CountGeneratedTokens returns the number of tokens in the assistant
+// messages of msgs, each rendered in full from <|start|> to its stop token as
+// the model emitted it. Other roles are skipped, so passing a whole
+// conversation counts only the generated turns, e.g. for metering.
+func (e *Encoding) CountGeneratedTokens(msgs []Message) (int, error) {
+	var buf []uint32
+	n := 0
+	for i := range msgs {
+		if msgs[i].Author.Role != RoleAssistant {
+			continue
+		}
+		buf = buf[:0]
+		if err := e.renderMessageInto(msgs[i], renderOptions{}, &buf); err != nil {
+			return 0, fmt.Errorf("message %d: %w", i, err)
+		}
+		n += len(buf)
+	}
+	return n, nil
+}
+
 func (e *Encoding) renderMessage(msg Message, opts renderOptions) ([]uint32, error) {
 	var out []uint32
 	if renderPresizeEnabled() {
@@ -142,89 +419,9 @@ func (e *Encoding) renderMessage(msg Message, opts renderOptions) ([]uint32, err
 		}
 		out = make([]uint32, 0, capHint)
 	}
-	// <|start|>
-	if err := e.renderFormattingToken("<|start|>", &out); err != nil {
+	if err := e.renderMessageInto(msg, opts, &out); err != nil {
 		return nil, err
 	}
-
-	if msg.Author.Role == RoleTool && msg.Author.Name == "" {
-		return nil, fmt.Errorf("tool messages must have a name")
-	}
-
-	needsRecipient := msg.Recipient != "" && msg.Recipient != "all"
-	switch msg.Author.Role {
-	case RoleTool:
-		if needsRecipient {
-			e.renderText(msg.Author.Name, &out)
-			e.renderText(" to=", &out)
-			e.renderText(msg.Recipient, &out)
-		} else {
-			e.renderText(msg.Author.Name, &out)
-		}
-	default:
-		if msg.Author.Name == "" && !needsRecipient {
-			e.renderText(string(msg.Author.Role), &out)
-		} else {
-			e.renderText(string(msg.Author.Role), &out)
-			if msg.Author.Name != "" {
-				e.renderText(":", &out)
-				e.renderText(msg.Author.Name, &out)
-			}
-			if needsRecipient {
-				e.renderText(" to=", &out)
-				e.renderText(msg.Recipient, &out)
-			}
-		}
-	}
-
-	// channel
-	if msg.Channel != "" {
-		if err := e.renderFormattingToken("<|channel|>", &out); err != nil {
-			return nil, err
-		}
-		e.renderText(msg.Channel, &out)
-	}
-
-	// content-type
-	if msg.ContentType != "" {
-		e.renderContentType(msg.ContentType, &out)
-	}
-
-	// <|message|>
-	if err := e.renderFormattingToken("<|message|>", &out); err != nil {
-		return nil, err
-	}
-
-	// content
-	for _, c := range msg.Content {
-		switch c.Type {
-		case ContentText:
-			e.renderText(c.Text, &out)
-		case ContentSystem:
-			if c.System == nil {
-				return nil, errors.New("nil SystemContent")
-			}
-			e.renderSystemContent(*c.System, opts, &out)
-		case ContentDeveloper:
-			if c.Developer == nil {
-				return nil, errors.New("nil DeveloperContent")
-			}
-			e.renderDeveloperContent(*c.Developer, &out)
-		default:
-			return nil, fmt.Errorf("unknown content type: %v", c.Type)
-		}
-	}
-
-	// end-of-message marker: assistant tool call uses <|call|>
-	if msg.Author.Role == RoleAssistant && msg.Recipient != "" && msg.Recipient != "all" {
-		if err := e.renderFormattingToken("<|call|>", &out); err != nil {
-			return nil, err
-		}
-	} else {
-		if err := e.renderFormattingToken("<|end|>", &out); err != nil {
-			return nil, err
-		}
-	}
 	return out, nil
 }
 
@@ -232,51 +429,31 @@ func (e *Encoding) renderMessage(msg Message, opts renderOptions) ([]uint32, err
 // When AutoDropAnalysis=true we omit analysis channel messages before the
 // first final assistant message.
 func (e *Encoding) RenderConversation(conv Conversation, cfg *RenderConversationConfig) ([]uint32, error) {
-	autoDrop := true
-	if cfg != nil {
-		autoDrop = cfg.AutoDropAnalysis
+	if e.hook == nil {
+		out, _, err := e.renderConversation(conv, cfg)
+		return out, err
 	}
-
-	// determine last assistant is final and first index of final
-	lastAssistantFinal := false
-	firstFinal := -1
-	hasFunctionTools := false
-	for i := range conv.Messages {
-		m := conv.Messages[i]
-		if m.Channel == "final" && firstFinal == -1 {
-			firstFinal = i
-		}
-		if m.Author.Role == RoleAssistant {
-			lastAssistantFinal = (m.Channel == "final")
-		}
-		if !hasFunctionTools {
-			for _, c := range m.Content {
-				if c.Type == ContentDeveloper && c.Developer != nil && c.Developer.Tools != nil {
-					if ns, ok := c.Developer.Tools["functions"]; ok {
-						if len(ns.Tools) > 0 {
-							hasFunctionTools = true
-							break
-						}
-					}
-				}
-			}
-		}
+	e.hook(RenderStart{Messages: len(conv.Messages)})
+	out, rendered, err := e.renderConversation(conv, cfg)
+	ev := RenderComplete{Tokens: len(out), Err: err}
+	if err == nil {
+		ev.Messages, ev.Dropped = rendered, len(conv.Messages)-rendered
 	}
-	shouldDrop := autoDrop && lastAssistantFinal
+	e.hook(ev)
+	return out, err
+}
 
-	renderIdx := make([]int, 0, len(conv.Messages))
-	for i := range conv.Messages {
-		m := conv.Messages[i]
-		if shouldDrop && firstFinal >= 0 && i < firstFinal && m.Channel == "analysis" {
-			continue
-		}
-		renderIdx = append(renderIdx, i)
+// renderConversation implements RenderConversation and also returns the
+// number of messages rendered.
+func (e *Encoding) renderConversation(conv Conversation, cfg *RenderConversationConfig) ([]uint32, int, error) {
+	renderIdx, opts, err := e.planConversation(conv, cfg)
+	if err != nil {
+		return nil, 0, err
 	}
 	if len(renderIdx) == 0 {
-		return []uint32{}, nil
+		return []uint32{}, 0, nil
 	}
 
-	opts := renderOptions{conversationHasFunctionTools: hasFunctionTools}
 	// Pre-size output token slice using a rough heuristic to reduce growth churn.
 	estimateTokens := func(msg Message) int {
 		chars := estimateMessageSize(msg)
@@ -318,7 +495,7 @@ func (e *Encoding) RenderConversation(conv Conversation, cfg *RenderConversation
 		}
 		wg.Wait()
 		if firstErr != nil {
-			return nil, firstErr
+			return nil, 0, firstErr
 		}
 		var out []uint32
 		if renderPresizeEnabled() {
@@ -327,7 +504,7 @@ func (e *Encoding) RenderConversation(conv Conversation, cfg *RenderConversation
 		for _, toks := range results {
 			out = append(out, toks...)
 		}
-		return out, nil
+		return out, len(renderIdx), nil
 	}
 
 	var out []uint32
@@ -336,10 +513,142 @@ func (e *Encoding) RenderConversation(conv Conversation, cfg *RenderConversation
 	}
 	for _, idx := range renderIdx {
 		if err := e.renderMessageInto(conv.Messages[idx], opts, &out); err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 	}
-	return out, nil
+	return out, len(renderIdx), nil
+}
+
+// hasFunctionTools reports whether a developer message in msgs declares tools
+// in the functions namespace.
+func hasFunctionTools(msgs []Message) bool {
+	for _, m := range msgs {
+		for _, c := range m.Content {
+			if c.Type == ContentDeveloper && c.Developer != nil && len(c.Developer.Tools["functions"].Tools) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// analysisDropEnd returns the index of the first final-channel message when
+// the last assistant message is on the final channel, and -1 otherwise.
+// Auto-drop removes analysis messages before that index.
+func analysisDropEnd(msgs []Message) int {
+	lastAssistantFinal := false
+	firstFinal := -1
+	for i := range msgs {
+		if msgs[i].Channel == "final" && firstFinal == -1 {
+			firstFinal = i
+		}
+		if msgs[i].Author.Role == RoleAssistant {
+			lastAssistantFinal = msgs[i].Channel == "final"
+		}
+	}
+	if !lastAssistantFinal {
+		return -1
+	}
+	return firstFinal
+}
+
+// planConversation selects the message indices to render (applying analysis
+// auto-drop), derives conversation-wide render options and enforces
+// conversation-level constraints, so that structural errors surface before
+// any tokens are produced.
+func (e *Encoding) planConversation(conv Conversation, cfg *RenderConversationConfig) ([]int, renderOptions, error) {
+	autoDrop := true
+	if cfg != nil {
+		autoDrop = cfg.AutoDropAnalysis
+	}
+
+	dropEnd := -1
+	if autoDrop {
+		dropEnd = analysisDropEnd(conv.Messages)
+	}
+	funcTools := hasFunctionTools(conv.Messages)
+	renderIdx := make([]int, 0, len(conv.Messages))
+	for i := range conv.Messages {
+		if i < dropEnd && conv.Messages[i].Channel == "analysis" {
+			continue
+		}
+		if err := checkContentItems(&conv.Messages[i]); err != nil {
+			return nil, renderOptions{}, fmt.Errorf("message %d: %w", i, err)
+		}
+		renderIdx = append(renderIdx, i)
+	}
+	opts := renderOptions{conversationHasFunctionTools: funcTools}
+	if cfg != nil {
+		opts.validateConstrained = cfg.ValidateConstrainedContent
+		opts.knowledgeCutoffLabel = cfg.KnowledgeCutoffLabel
+		opts.currentDateLabel = cfg.CurrentDateLabel
+		if cfg.AutoConversationStartDate {
+			now := time.Now
+			if cfg.Now != nil {
+				now = cfg.Now
+			}
+			opts.autoStartDate = now().Format(time.DateOnly)
+		}
+		opts.normalizeNewlines = cfg.NormalizeNewlines
+		opts.noDefaultChannels = cfg.NoDefaultChannels
+		opts.allowContentSpecials = cfg.AllowSpecialLiteralsInContent
+		opts.detectRenderedContent = cfg.DetectRenderedContent
+		opts.sanitizeContent = cfg.SanitizeContent
+		opts.stripZeroWidthSpace = cfg.StripZeroWidthSpace
+		opts.instructionsHeader = cfg.InstructionsHeader
+		opts.toolsHeader = cfg.ToolsHeader
+		opts.emptyToolsSection = cfg.EmptyToolsSection
+		opts.emptyToolsNote = cfg.EmptyToolsNote
+		opts.toolReturnType = cfg.ToolReturnType
+		opts.omitModelIdentity = cfg.OmitModelIdentity
+		opts.omitKnowledgeCutoff = cfg.OmitKnowledgeCutoff
+		opts.omitDefaultKnowledgeCutoff = cfg.OmitDefaultKnowledgeCutoff
+		opts.omitReasoning = cfg.OmitReasoning
+	}
+	if funcTools && (cfg == nil || !cfg.AllowFunctionCallsOutsideCommentary) {
+		for _, i := range renderIdx {
+			if err := checkFunctionCallChannel(i, conv.Messages[i]); err != nil {
+				return nil, opts, err
+			}
+		}
+	}
+	if cfg != nil && cfg.ValidateReasoningEffort {
+		for _, i := range renderIdx {
+			if err := checkReasoningEffort(i, conv.Messages[i], cfg.ExtraReasoningEfforts); err != nil {
+				return nil, opts, err
+			}
+		}
+	}
+	if channelRequired(conv.Messages) {
+		for _, i := range renderIdx {
+			err := checkChannelPresent(i, conv.Messages[i])
+			if err == nil {
+				continue
+			}
+			if cfg == nil || !cfg.ChannelRequiredWarnOnly {
+				return nil, opts, err
+			}
+			e.emitErr(err, renderWarningEvent)
+		}
+	}
+	return renderIdx, opts, nil
+}
+
+// PrepareCompletion renders conv for completion by next (as
+// RenderConversationForCompletion) and returns the stop tokens to sample
+// with: the assistant-action set (<|return|>, <|call|>) when next is the
+// assistant, so analysis and commentary messages ending in <|end|> do not
+// stop generation, and the full stop set otherwise. Stop tokens are sorted.
+func (e *Encoding) PrepareCompletion(conv Conversation, next Role, cfg *RenderConversationConfig) (prompt, stop []uint32, err error) {
+	prompt, err = e.RenderConversationForCompletion(conv, next, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	set := e.stopAll
+	if next == RoleAssistant {
+		set = e.stopAssistant
+	}
+	return prompt, slices.Sorted(maps.Keys(set)), nil
 }
 
 // RenderConversationForCompletion encodes a conversation and appends a
@@ -354,8 +663,38 @@ func (e *Encoding) RenderConversationForCompletion(conv Conversation, next Role,
 	return out, nil
 }
 
+// RenderConversationForCompletionWithHeader is like
+// RenderConversationForCompletion but also pre-fills the next message's
+// channel and content type (either may be empty), followed by <|message|>
+// unless cfg.OmitTrailingMessageToken is set. This steers the model into a
+// specific channel, e.g. "<|start|>assistant<|channel|>final<|message|>".
+func (e *Encoding) RenderConversationForCompletionWithHeader(conv Conversation, next Role, channel, contentType string, cfg *RenderConversationConfig) ([]uint32, error) {
+	if err := checkChannel(channel); err != nil {
+		return nil, err
+	}
+	out, err := e.RenderConversationForCompletion(conv, next, cfg)
+	if err != nil {
+		return nil, err
+	}
+	sink := &tokenSink{e: e, out: &out}
+	if channel != "" {
+		sink.writeSpecial(e.idChannel)
+		sink.writeText(channel)
+	}
+	if contentType != "" {
+		e.renderContentType(contentType, sink)
+	}
+	if cfg == nil || !cfg.OmitTrailingMessageToken {
+		sink.writeSpecial(e.idMessage)
+	}
+	return out, nil
+}
+
 // RenderConversationForTraining encodes a conversation replacing the trailing
-// <|end|> with <|return|> when the last message is assistant:final.
+// <|end|> with <|return|> when the last message is the assistant's final
+// answer: an assistant message with Channel "final", or, with
+// RenderConversationConfig.EmptyChannelIsFinal, an assistant message with no
+// channel and no recipient. Any other last message renders unchanged.
 func (e *Encoding) RenderConversationForTraining(conv Conversation, cfg *RenderConversationConfig) ([]uint32, error) {
 	if len(conv.Messages) == 0 {
 		return []uint32{}, nil
@@ -365,7 +704,9 @@ func (e *Encoding) RenderConversationForTraining(conv Conversation, cfg *RenderC
 		return nil, err
 	}
 	last := conv.Messages[len(conv.Messages)-1]
-	if last.Author.Role == RoleAssistant && last.Channel == "final" {
+	isFinal := last.Channel == "final" ||
+		(cfg != nil && cfg.EmptyChannelIsFinal && last.Channel == "" && (last.Recipient == "" || last.Recipient == "all"))
+	if last.Author.Role == RoleAssistant && isFinal {
 		// replace trailing <|end|> with <|return|>
 		if len(out) == 0 {
 			return out, nil
@@ -384,16 +725,86 @@ func (e *Encoding) ParseMessagesFromCompletionTokens(tokens []uint32, role *Role
 	}
 	for _, t := range tokens {
 		if err := p.Process(t); err != nil {
+			e.emitErr(err, parseErrorEvent)
 			return nil, err
 		}
 	}
 	if err := p.ProcessEOS(); err != nil {
+		e.emitErr(err, parseErrorEvent)
 		return nil, err
 	}
 	// Return messages slice directly to avoid a copy; parser is no longer used.
 	return p.messages, nil
 }
 
+// ParsePartial parses the complete messages in tokens, which may end in the
+// middle of a message, and returns the tokens of that unfinished message as a
+// copy to prepend to the next chunk. A message is complete once its stop
+// token has been seen. The role hint applies to the first message only; when
+// the returned tail is that first message, pass the same role again.
+func (e *Encoding) ParsePartial(tokens []uint32, role *Role) ([]Message, []uint32, error) {
+	p, err := NewStreamParser(e, role)
+	if err != nil {
+		return nil, nil, err
+	}
+	start := 0
+	for i, t := range tokens {
+		if p.state == stExpectStart {
+			start = i
+		}
+		if err := p.Process(t); err != nil {
+			e.emitErr(err, parseErrorEvent)
+			return nil, nil, err
+		}
+	}
+	msgs := p.messages
+	if p.state == stExpectStart {
+		return msgs, nil, nil
+	}
+	if p.state == stContent {
+		msgs = msgs[:len(msgs)-1]
+	}
+	return msgs, append([]uint32(nil), tokens[start:]...), nil
+}
+
+// ParseMessagesInto parses completion tokens like
+// ParseMessagesFromCompletionTokens but writes the messages into *dst,
+// reusing its capacity and the Content slices of its elements. Previous
+// contents of *dst are overwritten. A pooled parser is used so repeated
+// calls reach near-zero steady-state allocations.
+func (e *Encoding) ParseMessagesInto(dst *[]Message, tokens []uint32, role *Role) error {
+	p := e.acquireParser(role)
+	defer e.releaseParser(p)
+	p.messages = (*dst)[:0]
+	for _, t := range tokens {
+		if err := p.Process(t); err != nil {
+			*dst = p.messages
+			e.emitErr(err, parseErrorEvent)
+			return err
+		}
+	}
+	err := p.ProcessEOS()
+	*dst = p.messages
+	e.emitErr(err, parseErrorEvent)
+	return err
+}
+
+func (e *Encoding) acquireParser(role *Role) *StreamParser {
+	if v := e.parserPool.Get(); v != nil {
+		p := v.(*StreamParser)
+		p.Reset(role)
+		return p
+	}
+	p, _ := NewStreamParser(e, role)
+	return p
+}
+
+func (e *Encoding) releaseParser(p *StreamParser) {
+	// never retain caller-owned messages in the pool
+	p.messages = nil
+	e.parserPool.Put(p)
+}
+
 // internal helpers (to be used by render/parse)
 func (e *Encoding) renderFormattingToken(name string, out *[]uint32) error {
 	switch name {
@@ -433,79 +844,210 @@ func (e *Encoding) renderText(text string, out *[]uint32) {
 	_ = e.bpe.EncodeIntoOrdinary(text, out)
 }
 
-// renderMessageInto appends the rendered message tokens into out (no temp slice).
+// renderMessageInto appends the rendered message tokens into out (no temp
+// slice). On error out is left as it was.
 func (e *Encoding) renderMessageInto(msg Message, opts renderOptions, out *[]uint32) error {
-	// <|start|>
-	*out = append(*out, e.idStart)
+	if err := checkContentItems(&msg); err != nil {
+		return err
+	}
+	if e.msgCache == nil {
+		return e.renderMessageTokens(msg, opts, out)
+	}
+	key, ok := cacheKey(&msg, opts)
+	if !ok {
+		return e.renderMessageTokens(msg, opts, out)
+	}
+	if e.msgCache.appendTo(key, out) {
+		return nil
+	}
+	start := len(*out)
+	if err := e.renderMessageTokens(msg, opts, out); err != nil {
+		return err
+	}
+	e.msgCache.put(key, (*out)[start:])
+	return nil
+}
 
+// renderMessageTokens renders msg through a pooled tokenSink; a fresh sink
+// would escape to the heap on every message through the renderSink interface.
+// Tokens of a message that fails part way are truncated from out again.
+func (e *Encoding) renderMessageTokens(msg Message, opts renderOptions, out *[]uint32) error {
+	sink, _ := e.sinkPool.Get().(*tokenSink)
+	if sink == nil {
+		sink = &tokenSink{e: e}
+	}
+	start := len(*out)
+	sink.out = out
+	err := e.renderMessageTo(msg, opts, sink)
+	sink.out = nil
+	e.sinkPool.Put(sink)
+	if err != nil {
+		*out = (*out)[:start]
+	}
+	return err
+}
+
+// renderMessageTo writes the message structure into sink. Token and string
+// renders share this path so both stay structurally identical.
+func (e *Encoding) renderMessageTo(msg Message, opts renderOptions, sink renderSink) error {
+	if err := e.renderHeaderTo(msg, opts, sink); err != nil {
+		return err
+	}
+	if err := e.renderContents(msg.Content, opts, sink); err != nil {
+		return err
+	}
+	e.renderEndTo(msg, sink)
+	return nil
+}
+
+// renderHeaderTo validates msg and writes everything up to and including
+// <|message|>.
+func (e *Encoding) renderHeaderTo(msg Message, opts renderOptions, sink renderSink) error {
 	if msg.Author.Role == RoleTool && msg.Author.Name == "" {
 		return fmt.Errorf("tool messages must have a name")
 	}
-
-	needsRecipient := msg.Recipient != "" && msg.Recipient != "all"
-	switch msg.Author.Role {
-	case RoleTool:
-		if needsRecipient {
-			header := msg.Author.Name + " to=" + msg.Recipient
-			e.renderText(header, out)
-		} else {
-			e.renderText(msg.Author.Name, out)
+	if err := checkHeader(msg); err != nil {
+		return err
+	}
+	if opts.detectRenderedContent {
+		if err := checkRenderedContent(msg); err != nil {
+			return err
 		}
-	default:
-		if msg.Author.Name == "" && !needsRecipient {
-			e.renderText(string(msg.Author.Role), out)
-		} else {
-			header := string(msg.Author.Role)
-			if msg.Author.Name != "" {
-				header = header + ":" + msg.Author.Name
-			}
-			if needsRecipient {
-				header = header + " to=" + msg.Recipient
-			}
-			e.renderText(header, out)
+	}
+	if !opts.allowContentSpecials {
+		if err := checkContentSpecials(msg); err != nil {
+			return err
 		}
 	}
+	if opts.validateConstrained {
+		if err := validateConstrainedContent(msg); err != nil {
+			return err
+		}
+	}
+
+	// <|start|>
+	sink.writeSpecial(e.idStart)
+
+	e.renderHeaderName(msg, sink)
 
 	// channel
 	if msg.Channel != "" {
-		*out = append(*out, e.idChannel)
-		e.renderText(msg.Channel, out)
+		sink.writeSpecial(e.idChannel)
+		sink.writeText(msg.Channel)
 	}
 
 	// content-type
 	if msg.ContentType != "" {
-		e.renderContentType(msg.ContentType, out)
+		e.renderContentType(msg.ContentType, sink)
 	}
 
 	// <|message|>
-	*out = append(*out, e.idMessage)
+	sink.writeSpecial(e.idMessage)
+	return nil
+}
 
-	// content
-	for _, c := range msg.Content {
+// renderEndTo writes the end-of-message marker: assistant tool calls use
+// <|call|>, everything else <|end|>.
+func (e *Encoding) renderEndTo(msg Message, sink renderSink) {
+	if msg.Author.Role == RoleAssistant && msg.Recipient != "" && msg.Recipient != "all" {
+		sink.writeSpecial(e.idCall)
+	} else {
+		sink.writeSpecial(e.idEnd)
+	}
+}
+
+// RenderMessageStreaming appends a message whose text body is read from body
+// instead of header.Content, which must be empty. The body is encoded
+// incrementally as ordinary text (special-token literals are not
+// interpreted), so large tool outputs need not be held as one string. The
+// tokens match Render of the same message with the body as text content. On
+// error *out is left as it was on entry.
+func (e *Encoding) RenderMessageStreaming(header Message, body io.Reader, out *[]uint32) error {
+	if len(header.Content) != 0 {
+		return errors.New("RenderMessageStreaming: header must not carry content")
+	}
+	start := len(*out)
+	sink := &tokenSink{e: e, out: out}
+	if err := e.renderHeaderTo(header, renderOptions{}, sink); err != nil {
+		*out = (*out)[:start]
+		return err
+	}
+	if err := e.bpe.EncodeReader(body, func(t uint32) { *out = append(*out, t) }); err != nil {
+		*out = (*out)[:start]
+		return err
+	}
+	e.renderEndTo(header, sink)
+	return nil
+}
+
+// renderHeaderName writes the author and recipient part of the header, e.g.
+// "assistant:name to=functions.x". The pieces are joined before encoding
+// because BPE merges across the separators (":name", "=functions"), so
+// encoding them one by one would yield different tokens. The join uses a
+// pooled builder sized up front, so it allocates only the joined string.
+func (e *Encoding) renderHeaderName(msg Message, sink renderSink) {
+	needsRecipient := msg.Recipient != "" && msg.Recipient != "all"
+	if !needsRecipient {
+		switch {
+		case msg.Author.Role == RoleTool:
+			sink.writeText(msg.Author.Name)
+			return
+		case msg.Author.Name == "":
+			sink.writeText(string(msg.Author.Role))
+			return
+		}
+	}
+	sb := e.acquireBuilder()
+	sb.Grow(len(msg.Author.Role) + 1 + len(msg.Author.Name) + len(" to=") + len(msg.Recipient))
+	if msg.Author.Role == RoleTool {
+		sb.WriteString(msg.Author.Name)
+	} else {
+		sb.WriteString(string(msg.Author.Role))
+		if msg.Author.Name != "" {
+			sb.WriteByte(':')
+			sb.WriteString(msg.Author.Name)
+		}
+	}
+	if needsRecipient {
+		sb.WriteString(" to=")
+		sb.WriteString(msg.Recipient)
+	}
+	sink.writeText(sb.String())
+	e.releaseBuilder(sb)
+}
+
+// renderContents renders a message's content items in order. Consecutive
+// developer content items are merged into a single developer block (see
+// mergeDeveloperContents) so split instructions render as one section.
+func (e *Encoding) renderContents(items []Content, opts renderOptions, sink renderSink) error {
+	if opts.normalizeNewlines {
+		sink = newlineSink{sink}
+	}
+	for i := 0; i < len(items); i++ {
+		c := items[i]
 		switch c.Type {
 		case ContentText:
-			e.renderText(c.Text, out)
+			sink.writeText(sanitizeContent(c.Text, opts))
 		case ContentSystem:
 			if c.System == nil {
 				return errors.New("nil SystemContent")
 			}
-			e.renderSystemContent(*c.System, opts, out)
+			e.renderSystemContent(*c.System, opts, sink)
 		case ContentDeveloper:
-			if c.Developer == nil {
-				return errors.New("nil DeveloperContent")
+			j := i + 1
+			for j < len(items) && items[j].Type == ContentDeveloper {
+				j++
+			}
+			dev, err := mergeDeveloperContents(items[i:j])
+			if err != nil {
+				return err
 			}
-			e.renderDeveloperContent(*c.Developer, out)
+			e.renderDeveloperContent(dev, opts, sink)
+			i = j - 1
 		default:
 			return fmt.Errorf("unknown content type: %v", c.Type)
 		}
 	}
-
-	// end-of-message marker: assistant tool call uses <|call|>
-	if msg.Author.Role == RoleAssistant && msg.Recipient != "" && msg.Recipient != "all" {
-		*out = append(*out, e.idCall)
-	} else {
-		*out = append(*out, e.idEnd)
-	}
 	return nil
 }
 
@@ -521,19 +1063,26 @@ func (e *Encoding) EncodeWithSpecialTokensInto(text string, out *[]uint32) int {
 	return e.bpe.EncodeWithSpecialTokensInto(text, out)
 }
 
+// EncodeTextFunc encodes text as ordinary content (special-token literals are
+// not recognized) and calls emit for each token as it is produced. Useful for
+// streaming very large inputs into a counting or hashing sink.
+func (e *Encoding) EncodeTextFunc(text string, emit func(uint32)) {
+	e.bpe.EncodeFunc(text, nil, emit)
+}
+
 // Special handling for content_type if it starts with <|constrain|>
-func (e *Encoding) renderContentType(ct string, out *[]uint32) {
+func (e *Encoding) renderContentType(ct string, sink renderSink) {
 	if strings.HasPrefix(ct, "<|constrain|>") {
 		// emit space, constrain special, then rest (if any)
-		e.renderText(" ", out)
-		*out = append(*out, e.idConstrain)
+		sink.writeText(" ")
+		sink.writeSpecial(e.idConstrain)
 		rest := strings.TrimPrefix(ct, "<|constrain|>")
 		if rest != "" {
-			e.renderText(rest, out)
+			sink.writeText(rest)
 		}
 		return
 	}
-	e.renderText(" "+ct, out)
+	sink.writeText(" " + ct)
 }
 
 const parallelRenderMinBytes = 8 * 1024
@@ -621,6 +1170,9 @@ func estimateSystemContentSize(sys *SystemContent) int {
 	if sys.ReasoningEffort != nil {
 		total += len(string(*sys.ReasoningEffort))
 	}
+	if sys.ReasoningBudget != nil {
+		total += len(" (budget: )") + 20
+	}
 	if sys.ConversationStartDate != nil {
 		total += len(*sys.ConversationStartDate)
 	}
@@ -630,6 +1182,9 @@ func estimateSystemContentSize(sys *SystemContent) int {
 	if sys.ChannelConfig != nil {
 		total += estimateChannelConfigSize(sys.ChannelConfig)
 	}
+	for _, s := range sys.ExtraSections {
+		total += len(s) + 2
+	}
 	total += estimateToolsMapSize(sys.Tools)
 	return total
 }
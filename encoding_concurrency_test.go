@@ -0,0 +1,89 @@
+package harmony
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// TestEncodingConcurrentUse shares one Encoding across many goroutines that
+// render, parse and decode at once. Run with -race to check for data races.
+func TestEncodingConcurrentUse(t *testing.T) {
+	enc, err := LoadEncoding(HarmonyGptOss, WithMessageCache(16))
+	if err != nil {
+		t.Fatalf("LoadEncoding: %v", err)
+	}
+	// Tool declarations are shared, as servers usually build them once.
+	dev := &DeveloperContent{Tools: map[string]ToolNamespaceConfig{
+		"functions": {Name: "functions", Tools: []ToolDescription{{
+			Name:        "lookup",
+			Description: "Look up a value.",
+			Parameters:  []byte(`{"type":"object","properties":{"key":{"type":"string"}}}`),
+		}}},
+	}}
+	conv := func(i int) Conversation {
+		return Conversation{Messages: []Message{
+			{Author: Author{Role: RoleSystem}, Content: []Content{{Type: ContentSystem, System: &SystemContent{}}}},
+			{Author: Author{Role: RoleDeveloper}, Content: []Content{{Type: ContentDeveloper, Developer: dev}}},
+			{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: fmt.Sprintf("question %d", i%7)}}},
+			{Author: Author{Role: RoleAssistant}, Channel: "final", Content: []Content{{Type: ContentText, Text: "answer"}}},
+		}}
+	}
+	// Expected results computed serially.
+	want := make([][]uint32, 7)
+	for i := range want {
+		if want[i], err = enc.RenderConversation(conv(i), nil); err != nil {
+			t.Fatalf("RenderConversation: %v", err)
+		}
+	}
+
+	const workers = 200
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := w; i < w+20; i++ {
+				toks, err := enc.RenderConversation(conv(i), nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !slices.Equal(toks, want[i%7]) {
+					errs <- fmt.Errorf("render %d differs", i)
+					return
+				}
+				msgs, err := enc.ParseMessagesFromCompletionTokens(toks, nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if len(msgs) != 4 || msgs[3].Content[0].Text != "answer" {
+					errs <- fmt.Errorf("parse %d: %+v", i, msgs)
+					return
+				}
+				var dst []Message
+				if err := enc.ParseMessagesInto(&dst, toks, nil); err != nil || len(dst) != 4 {
+					errs <- fmt.Errorf("parse into %d: %v", i, err)
+					return
+				}
+				text, err := enc.DecodeUTF8(toks)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if s, err := enc.RenderConversationString(conv(i), nil); err != nil || s != text {
+					errs <- fmt.Errorf("string render %d differs from decode: %v", i, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
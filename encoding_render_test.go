@@ -1,8 +1,13 @@
 package harmony
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"unicode/utf8"
 
 	"slices"
 
@@ -48,6 +53,54 @@ func TestStopTokensForAssistantActions(t *testing.T) {
 	}
 }
 
+func TestPrepareCompletion(t *testing.T) {
+	enc := mustEncoding(t)
+	conv := Conversation{Messages: []Message{{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "hi"}}}}}
+	for _, tc := range []struct {
+		next Role
+		stop []uint32
+	}{
+		{RoleAssistant, []uint32{tokenizer.TokReturn, tokenizer.TokCall}},
+		{RoleUser, []uint32{tokenizer.TokEnd, tokenizer.TokReturn, tokenizer.TokCall}},
+	} {
+		prompt, stop, err := enc.PrepareCompletion(conv, tc.next, nil)
+		if err != nil {
+			t.Fatalf("%s: PrepareCompletion: %v", tc.next, err)
+		}
+		want, err := enc.RenderConversationForCompletion(conv, tc.next, nil)
+		if err != nil {
+			t.Fatalf("%s: RenderConversationForCompletion: %v", tc.next, err)
+		}
+		if !slices.Equal(prompt, want) {
+			t.Fatalf("%s: prompt differs from RenderConversationForCompletion", tc.next)
+		}
+		slices.Sort(tc.stop)
+		if !slices.Equal(stop, tc.stop) {
+			t.Fatalf("%s: stop = %v, want %v", tc.next, stop, tc.stop)
+		}
+	}
+}
+
+func TestStopTokenSetsAreCopies(t *testing.T) {
+	enc := mustEncoding(t)
+	for name, get := range map[string]func() map[uint32]struct{}{
+		"StopTokenSet":                enc.StopTokenSet,
+		"AssistantActionStopTokenSet": enc.AssistantActionStopTokenSet,
+	} {
+		set := get()
+		if _, ok := set[tokenizer.TokCall]; !ok {
+			t.Fatalf("%s: missing <|call|>", name)
+		}
+		delete(set, tokenizer.TokCall)
+		if _, ok := get()[tokenizer.TokCall]; !ok {
+			t.Fatalf("%s: mutation leaked into encoding", name)
+		}
+	}
+	if _, ok := enc.AssistantActionStopTokenSet()[tokenizer.TokEnd]; ok {
+		t.Fatalf("assistant action set should not contain <|end|>")
+	}
+}
+
 func TestRenderConversationForCompletion(t *testing.T) {
 	enc := mustEncoding(t)
 
@@ -83,6 +136,48 @@ func TestRenderConversationForCompletion(t *testing.T) {
 	}
 }
 
+func TestRenderConversationForCompletionWithHeader(t *testing.T) {
+	enc := mustEncoding(t)
+	conv := Conversation{Messages: []Message{{
+		Author:  Author{Role: RoleUser},
+		Content: []Content{{Type: ContentText, Text: "ping"}},
+	}}}
+	base, err := enc.RenderConversation(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+
+	cases := []struct {
+		channel, ct string
+		cfg         *RenderConversationConfig
+		want        string
+	}{
+		{"final", "", nil, "<|start|>assistant<|channel|>final<|message|>"},
+		{"commentary", "<|constrain|>json", nil, "<|start|>assistant<|channel|>commentary <|constrain|>json<|message|>"},
+		{"final", "", &RenderConversationConfig{AutoDropAnalysis: true, OmitTrailingMessageToken: true}, "<|start|>assistant<|channel|>final"},
+	}
+	for _, tc := range cases {
+		got, err := enc.RenderConversationForCompletionWithHeader(conv, RoleAssistant, tc.channel, tc.ct, tc.cfg)
+		if err != nil {
+			t.Fatalf("RenderConversationForCompletionWithHeader: %v", err)
+		}
+		if !slices.Equal(got[:len(base)], base) {
+			t.Fatalf("conversation prefix changed")
+		}
+		suffix, err := enc.DecodeUTF8(got[len(base):])
+		if err != nil {
+			t.Fatalf("DecodeUTF8: %v", err)
+		}
+		if suffix != tc.want {
+			t.Fatalf("suffix = %q, want %q", suffix, tc.want)
+		}
+	}
+
+	if _, err := enc.RenderConversationForCompletionWithHeader(conv, RoleAssistant, "bad channel", "", nil); err == nil {
+		t.Fatalf("expected invalid channel to fail")
+	}
+}
+
 func TestRenderConversationForTraining(t *testing.T) {
 	enc := mustEncoding(t)
 
@@ -142,6 +237,46 @@ func TestRenderConversationForTraining(t *testing.T) {
 	if !slices.Equal(plainBase, plainTraining) {
 		t.Fatalf("expected non-final training render to match base\n base: %v\ntrain: %v", plainBase, plainTraining)
 	}
+
+}
+
+func TestRenderConversationForTrainingEmptyChannelIsFinal(t *testing.T) {
+	enc := mustEncoding(t)
+	conv := Conversation{Messages: []Message{
+		{
+			Author:  Author{Role: RoleUser},
+			Content: []Content{{Type: ContentText, Text: "ping"}},
+		},
+		{
+			Author:  Author{Role: RoleAssistant},
+			Content: []Content{{Type: ContentText, Text: "pong"}},
+		},
+	}}
+
+	// An unchanneled final only counts when EmptyChannelIsFinal is set.
+	training, err := enc.RenderConversationForTraining(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversationForTraining unchanneled: %v", err)
+	}
+	if training[len(training)-1] != tokenizer.TokEnd {
+		t.Fatalf("expected unchanneled assistant to keep <|end|> by default")
+	}
+	cfg := &RenderConversationConfig{AutoDropAnalysis: true, EmptyChannelIsFinal: true}
+	training, err = enc.RenderConversationForTraining(conv, cfg)
+	if err != nil {
+		t.Fatalf("RenderConversationForTraining EmptyChannelIsFinal: %v", err)
+	}
+	if training[len(training)-1] != tokenizer.TokReturn {
+		t.Fatalf("expected <|return|> with EmptyChannelIsFinal, got %d", training[len(training)-1])
+	}
+	conv.Messages[1].Recipient = "functions.f"
+	training, err = enc.RenderConversationForTraining(conv, cfg)
+	if err != nil {
+		t.Fatalf("RenderConversationForTraining tool call: %v", err)
+	}
+	if training[len(training)-1] != tokenizer.TokCall {
+		t.Fatalf("expected tool call to keep <|call|>, got %d", training[len(training)-1])
+	}
 }
 
 func TestRenderContentTypeConstrain(t *testing.T) {
@@ -305,3 +440,683 @@ func TestRenderConversationParallelDeterminism(t *testing.T) {
 		t.Fatalf("parallel render differed from sequential baseline")
 	}
 }
+
+func TestRenderMultiNamespaceDeterministic(t *testing.T) {
+	enc := mustEncoding(t)
+	params := json.RawMessage(`{"type":"object","properties":{"z":{"type":"string"},"a":{"type":"object","properties":{"y":{"type":"number"},"b":{"type":"string"}}},"m":{"type":"boolean"}}}`)
+	tools := func(names ...string) []ToolDescription {
+		out := make([]ToolDescription, len(names))
+		for i, n := range names {
+			out[i] = ToolDescription{Name: n, Description: "tool " + n, Parameters: params}
+		}
+		return out
+	}
+	sysTools := map[string]ToolNamespaceConfig{
+		"browser": {Name: "browser", Tools: tools("search", "open")},
+		"python":  {Name: "python", Description: strPtr("Run code.")},
+		"alias":   {Name: "browser", Tools: tools("find")},
+	}
+	devTools := map[string]ToolNamespaceConfig{
+		"functions": {Name: "functions", Tools: tools("b", "a", "c")},
+		"extra":     {Name: "extra", Tools: tools("x")},
+		"more":      {Name: "more", Tools: tools("y")},
+	}
+	conv := Conversation{Messages: []Message{
+		{Author: Author{Role: RoleSystem}, Content: []Content{{Type: ContentSystem, System: &SystemContent{Tools: sysTools}}}},
+		{Author: Author{Role: RoleDeveloper}, Content: []Content{
+			{Type: ContentDeveloper, Developer: &DeveloperContent{Tools: devTools}},
+			{Type: ContentDeveloper, Developer: &DeveloperContent{Tools: map[string]ToolNamespaceConfig{"late": {Name: "late", Tools: tools("z")}}}},
+		}},
+		{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "hi"}}},
+	}}
+
+	first, err := enc.RenderConversation(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		got, err := enc.RenderConversation(conv.Clone(), nil)
+		if err != nil {
+			t.Fatalf("RenderConversation: %v", err)
+		}
+		if !slices.Equal(got, first) {
+			t.Fatalf("render %d differs from the first render", i)
+		}
+	}
+}
+
+func TestRenderConversationStringMatchesTokens(t *testing.T) {
+	enc := mustEncoding(t)
+	conv := Conversation{Messages: []Message{
+		{
+			Author:  Author{Role: RoleUser},
+			Content: []Content{{Type: ContentText, Text: "What is 2+2?"}},
+		},
+		{
+			Author:      Author{Role: RoleAssistant},
+			Recipient:   "functions.calc",
+			Channel:     "commentary",
+			ContentType: "<|constrain|>json",
+			Content:     []Content{{Type: ContentText, Text: `{"expr":"2+2"}`}},
+		},
+	}}
+
+	got, err := enc.RenderConversationString(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversationString: %v", err)
+	}
+	want := "<|start|>user<|message|>What is 2+2?<|end|>" +
+		"<|start|>assistant to=functions.calc<|channel|>commentary <|constrain|>json<|message|>{\"expr\":\"2+2\"}<|call|>"
+	if got != want {
+		t.Fatalf("string render mismatch\n got: %q\nwant: %q", got, want)
+	}
+
+	toks, err := enc.RenderConversation(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	decoded, err := enc.DecodeUTF8(toks)
+	if err != nil {
+		t.Fatalf("DecodeUTF8: %v", err)
+	}
+	if decoded != got {
+		t.Fatalf("string render diverged from token render\n str: %q\ntoks: %q", got, decoded)
+	}
+
+	cfg := &RenderConversationConfig{AutoDropAnalysis: true, StringMessageSeparator: "\n"}
+	got, err = enc.RenderConversationString(conv, cfg)
+	if err != nil {
+		t.Fatalf("RenderConversationString with separator: %v", err)
+	}
+	if want := strings.Replace(want, "<|end|><|start|>", "<|end|>\n<|start|>", 1); got != want {
+		t.Fatalf("separator not applied\n got: %q\nwant: %q", got, want)
+	}
+	sepToks, err := enc.RenderConversation(conv, cfg)
+	if err != nil {
+		t.Fatalf("RenderConversation with separator: %v", err)
+	}
+	if !slices.Equal(sepToks, toks) {
+		t.Fatal("separator changed the token render")
+	}
+}
+
+func TestRenderHeaderMatchesJoinedEncoding(t *testing.T) {
+	enc := mustEncoding(t)
+	msgs := []Message{
+		{Author: Author{Role: RoleAssistant, Name: "scribe"}, Recipient: "functions.lookup", Channel: "commentary"},
+		{Author: Author{Role: RoleTool, Name: "functions.lookup"}, Recipient: "assistant"},
+		{Author: Author{Role: RoleUser, Name: "alice"}},
+		{Author: Author{Role: RoleSystem}},
+	}
+	for _, msg := range msgs {
+		msg.Content = []Content{{Type: ContentText, Text: "x"}}
+		single, err := enc.Render(msg)
+		if err != nil {
+			t.Fatalf("Render: %v", err)
+		}
+		conv, err := enc.RenderConversation(Conversation{Messages: []Message{msg}}, nil)
+		if err != nil {
+			t.Fatalf("RenderConversation: %v", err)
+		}
+		if !slices.Equal(single, conv) {
+			t.Fatalf("Render and RenderConversation differ for %+v", msg.Author)
+		}
+		// The header must tokenize as one joined string, not piece by piece.
+		text, err := enc.RenderConversationString(Conversation{Messages: []Message{msg}}, nil)
+		if err != nil {
+			t.Fatalf("RenderConversationString: %v", err)
+		}
+		if want := enc.EncodeWithSpecialTokens(text); !slices.Equal(single, want) {
+			t.Fatalf("header tokens differ from joined encoding for %q\n got: %v\nwant: %v", text, single, want)
+		}
+	}
+}
+
+func TestRenderHeaderNameTokens(t *testing.T) {
+	enc := mustEncoding(t)
+	body := []Content{{Type: ContentText, Text: "{}"}}
+	cases := []struct {
+		msg  Message
+		want string
+	}{
+		{Message{Author: Author{Role: RoleUser, Name: "alice"}, Content: body}, "<|start|>user:alice<|message|>{}<|end|>"},
+		{Message{Author: Author{Role: RoleAssistant}, Recipient: "functions.get_weather", Channel: "commentary", Content: body}, "<|start|>assistant to=functions.get_weather<|channel|>commentary<|message|>{}<|call|>"},
+		{Message{Author: Author{Role: RoleAssistant, Name: "bot"}, Recipient: "functions.f", Channel: "commentary", Content: body}, "<|start|>assistant:bot to=functions.f<|channel|>commentary<|message|>{}<|call|>"},
+		{Message{Author: Author{Role: RoleTool, Name: "functions.f"}, Recipient: "assistant", Channel: "commentary", Content: body}, "<|start|>functions.f to=assistant<|channel|>commentary<|message|>{}<|end|>"},
+	}
+	for _, tc := range cases {
+		got, err := enc.Render(tc.msg)
+		if err != nil {
+			t.Fatalf("Render %q: %v", tc.want, err)
+		}
+		if want := enc.bpe.EncodeWithSpecialTokens(tc.want); !slices.Equal(got, want) {
+			t.Fatalf("header tokens for %q\n got: %v\nwant: %v", tc.want, got, want)
+		}
+	}
+}
+
+func TestRenderMessageStreamingMatchesRender(t *testing.T) {
+	enc := mustEncoding(t)
+	body := strings.Repeat("line of tool output, with <|end|> literal and numbers 12345\n", 500)
+	header := Message{Author: Author{Role: RoleTool, Name: "functions.read_file"}, Recipient: "assistant", Channel: "commentary"}
+
+	var got []uint32
+	if err := enc.RenderMessageStreaming(header, iotest.HalfReader(strings.NewReader(body)), &got); err != nil {
+		t.Fatalf("RenderMessageStreaming: %v", err)
+	}
+	full := header
+	full.Content = []Content{{Type: ContentText, Text: body}}
+	want, err := enc.renderMessage(full, renderOptions{allowContentSpecials: true})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("streamed render differs from Render (%d vs %d tokens)", len(got), len(want))
+	}
+
+	if err := enc.RenderMessageStreaming(full, strings.NewReader(""), &got); err == nil {
+		t.Fatalf("expected error when header carries content")
+	}
+
+	// A failed render leaves previously written tokens untouched.
+	prefix := []uint32{1, 2, 3}
+	out := slices.Clone(prefix)
+	if err := enc.RenderMessageStreaming(header, iotest.TimeoutReader(iotest.HalfReader(strings.NewReader(body))), &out); err == nil {
+		t.Fatalf("expected body read error")
+	}
+	if !slices.Equal(out, prefix) {
+		t.Fatalf("body error left %d partial tokens", len(out)-len(prefix))
+	}
+	bad := header
+	bad.Author.Name = ""
+	if err := enc.RenderMessageStreaming(bad, strings.NewReader(body), &out); err == nil || !slices.Equal(out, prefix) {
+		t.Fatalf("header error: %v, out %v", err, out)
+	}
+}
+
+func TestRenderConversationDebug(t *testing.T) {
+	enc := mustEncoding(t)
+	conv := Conversation{Messages: []Message{
+		{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "What is 2+2?"}}},
+		{Author: Author{Role: RoleAssistant}, Channel: "final", Content: []Content{{Type: ContentText, Text: "4"}}},
+	}}
+	toks, text, err := enc.RenderConversationDebug(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversationDebug: %v", err)
+	}
+	wantToks, err := enc.RenderConversation(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	wantText, err := enc.RenderConversationString(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversationString: %v", err)
+	}
+	if !slices.Equal(toks, wantToks) || text != wantText {
+		t.Fatalf("debug render mismatch\n got: %q\nwant: %q", text, wantText)
+	}
+}
+
+func TestRenderConversationNormalizeNewlines(t *testing.T) {
+	enc := mustEncoding(t)
+	mixed := Conversation{Messages: []Message{{
+		Author:  Author{Role: RoleUser},
+		Content: []Content{{Type: ContentText, Text: "a\r\nb\rc\nd"}},
+	}}}
+	unix := Conversation{Messages: []Message{{
+		Author:  Author{Role: RoleUser},
+		Content: []Content{{Type: ContentText, Text: "a\nb\nc\nd"}},
+	}}}
+
+	raw, err := enc.RenderConversation(mixed, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	want, err := enc.RenderConversation(unix, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation unix: %v", err)
+	}
+	if slices.Equal(raw, want) {
+		t.Fatalf("expected default render to preserve \\r bytes")
+	}
+	cfg := &RenderConversationConfig{AutoDropAnalysis: true, NormalizeNewlines: true}
+	got, err := enc.RenderConversation(mixed, cfg)
+	if err != nil {
+		t.Fatalf("RenderConversation normalized: %v", err)
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("normalized render mismatch\n got: %v\nwant: %v", got, want)
+	}
+}
+
+func TestRenderConversationSanitizeContent(t *testing.T) {
+	enc := mustEncoding(t)
+	user := func(s string) Conversation {
+		return Conversation{Messages: []Message{{
+			Author:  Author{Role: RoleUser},
+			Content: []Content{{Type: ContentText, Text: s}},
+		}}}
+	}
+	dirty := user("\ufeffhel\u200blo \u200d\ufeff")
+	clean := user("hello \u200d\ufeff")
+
+	want, err := enc.RenderConversation(clean, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation clean: %v", err)
+	}
+	raw, err := enc.RenderConversation(dirty, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	if slices.Equal(raw, want) {
+		t.Fatalf("expected default render to preserve BOM and zero-width bytes")
+	}
+	bomOnly, err := enc.RenderConversation(user("hel\u200blo \u200d\ufeff"), nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	got, err := enc.RenderConversation(dirty, &RenderConversationConfig{SanitizeContent: true})
+	if err != nil {
+		t.Fatalf("RenderConversation sanitized: %v", err)
+	}
+	if !slices.Equal(got, bomOnly) {
+		t.Fatalf("SanitizeContent should strip only the leading BOM\n got: %v\nwant: %v", got, bomOnly)
+	}
+	got, err = enc.RenderConversation(dirty, &RenderConversationConfig{SanitizeContent: true, StripZeroWidthSpace: true})
+	if err != nil {
+		t.Fatalf("RenderConversation sanitized: %v", err)
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("sanitized render mismatch\n got: %v\nwant: %v", got, want)
+	}
+}
+
+func TestEncodingVersion(t *testing.T) {
+	enc := mustEncoding(t)
+	v := enc.Version()
+	if !strings.HasPrefix(v, string(HarmonyGptOss)+"/") || !strings.Contains(v, tokenizer.O200kChecksum()) {
+		t.Fatalf("unexpected version %q", v)
+	}
+	if again := mustEncoding(t).Version(); again != v {
+		t.Fatalf("version not stable across loads: %q vs %q", v, again)
+	}
+}
+
+func TestEncodingVersionLoadOptions(t *testing.T) {
+	base := mustEncoding(t).Version()
+	load := func(opts ...LoadOption) string {
+		t.Helper()
+		enc, err := LoadEncoding(HarmonyGptOss, opts...)
+		if err != nil {
+			t.Fatalf("LoadEncoding: %v", err)
+		}
+		return enc.Version()
+	}
+	id := uint32(tokenizer.ReservedStart + 6)
+	noReserved := load(WithoutReservedSpecials())
+	remapped := load(WithSpecialTokenIDs(map[string]uint32{"<|call|>": id}))
+	other := load(WithSpecialTokenIDs(map[string]uint32{"<|call|>": id + 1}))
+	both := load(WithoutReservedSpecials(), WithSpecialTokenIDs(map[string]uint32{"<|call|>": id}))
+	seen := map[string]bool{}
+	for _, v := range []string{base, noReserved, remapped, other, both} {
+		if seen[v] {
+			t.Fatalf("duplicate version %q among distinct load options", v)
+		}
+		seen[v] = true
+	}
+	if again := load(WithSpecialTokenIDs(map[string]uint32{"<|call|>": id})); again != remapped {
+		t.Fatalf("remapped version not stable: %q vs %q", remapped, again)
+	}
+}
+
+// TestFormatVersionPinned fails when FormatVersion changes, as a reminder
+// that a bump must accompany every change to rendered tokens.
+func TestFormatVersionPinned(t *testing.T) {
+	const want = 3
+	if FormatVersion != want {
+		t.Fatalf("FormatVersion = %d, want %d", FormatVersion, want)
+	}
+	if v := mustEncoding(t).Version(); !strings.HasSuffix(v, fmt.Sprintf("/v%d", want)) {
+		t.Fatalf("Version %q does not end in /v%d", v, want)
+	}
+}
+
+func TestLoadEncodingWithoutReservedSpecials(t *testing.T) {
+	enc, err := LoadEncoding(HarmonyGptOss, WithoutReservedSpecials())
+	if err != nil {
+		t.Fatalf("LoadEncoding: %v", err)
+	}
+	id := uint32(tokenizer.ReservedStart + 6)
+	got, err := enc.DecodeUTF8([]uint32{id})
+	if err != nil || got != "<|reserved_200020|>" {
+		t.Fatalf("decode reserved: %q %v", got, err)
+	}
+	if toks := enc.EncodeWithSpecialTokens("<|reserved_200020|>"); slices.Contains(toks, id) {
+		t.Fatalf("reserved literal matched as special: %v", toks)
+	}
+	if toks := enc.EncodeWithSpecialTokens("<|start|>"); !slices.Equal(toks, []uint32{tokenizer.TokStart}) {
+		t.Fatalf("named special not matched: %v", toks)
+	}
+	conv := Conversation{Messages: []Message{{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "hi"}}}}}
+	want, err := mustEncoding(t).RenderConversation(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	if got, err := enc.RenderConversation(conv, nil); err != nil || !slices.Equal(got, want) {
+		t.Fatalf("render differs without reserved specials: %v %v", got, err)
+	}
+}
+
+func TestSpecialTokenLookup(t *testing.T) {
+	noReserved, err := LoadEncoding(HarmonyGptOss, WithoutReservedSpecials())
+	if err != nil {
+		t.Fatalf("LoadEncoding: %v", err)
+	}
+	for name, enc := range map[string]*Encoding{"default": mustEncoding(t), "without reserved": noReserved} {
+		for lit, id := range map[string]uint32{
+			"<|start|>":           tokenizer.TokStart,
+			"<|channel|>":         tokenizer.TokChannel,
+			"<|endoftext|>":       tokenizer.TokEndOfText,
+			"<|reserved_200014|>": tokenizer.ReservedStart,
+			"<|reserved_201088|>": tokenizer.ReservedEnd,
+		} {
+			if got, ok := enc.SpecialTokenID(lit); !ok || got != id {
+				t.Errorf("%s: SpecialTokenID(%q) = %d, %v; want %d", name, lit, got, ok, id)
+			}
+			if got, ok := enc.SpecialTokenLiteral(id); !ok || got != lit {
+				t.Errorf("%s: SpecialTokenLiteral(%d) = %q, %v; want %q", name, id, got, ok, lit)
+			}
+		}
+		for _, lit := range []string{"hello", "<|nope|>", "<|reserved_1|>", "<|reserved_0200014|>", "<|reserved_201089|>"} {
+			if _, ok := enc.SpecialTokenID(lit); ok {
+				t.Errorf("%s: SpecialTokenID(%q) resolved", name, lit)
+			}
+		}
+		if _, ok := enc.SpecialTokenLiteral(1); ok {
+			t.Errorf("%s: ordinary id has a special literal", name)
+		}
+	}
+}
+
+func TestLoadEncodingWithSpecialTokenIDs(t *testing.T) {
+	callID := uint32(tokenizer.ReservedStart + 6)
+	enc, err := LoadEncoding(HarmonyGptOss, WithSpecialTokenIDs(map[string]uint32{"<|call|>": callID}))
+	if err != nil {
+		t.Fatalf("LoadEncoding: %v", err)
+	}
+	msg := Message{Author: Author{Role: RoleAssistant}, Recipient: "functions.f", Channel: "commentary", Content: []Content{{Type: ContentText, Text: "{}"}}}
+	toks, err := enc.Render(msg)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if toks[len(toks)-1] != callID || slices.Contains(toks, tokenizer.TokCall) {
+		t.Fatalf("call not remapped: %v", toks)
+	}
+	if _, ok := enc.StopTokenSet()[callID]; !ok {
+		t.Fatalf("stop set missing remapped call: %v", enc.StopTokenSet())
+	}
+	if got, err := enc.DecodeUTF8(toks[len(toks)-1:]); err != nil || got != "<|call|>" {
+		t.Fatalf("decode remapped call: %q %v", got, err)
+	}
+	if got := enc.EncodeWithSpecialTokens("<|call|>"); !slices.Equal(got, []uint32{callID}) {
+		t.Fatalf("encode remapped call: %v", got)
+	}
+	msgs, err := enc.ParseMessagesFromCompletionTokens(toks, nil)
+	if err != nil || len(msgs) != 1 || msgs[0].Recipient != "functions.f" {
+		t.Fatalf("parse remapped render: %+v %v", msgs, err)
+	}
+	if id, ok := enc.SpecialTokenID("<|call|>"); !ok || id != callID {
+		t.Fatalf("SpecialTokenID remapped call: %d %v", id, ok)
+	}
+	if lit, ok := enc.SpecialTokenLiteral(callID); !ok || lit != "<|call|>" {
+		t.Fatalf("SpecialTokenLiteral remapped call: %q %v", lit, ok)
+	}
+	if _, ok := enc.SpecialTokenID("<|reserved_200020|>"); ok {
+		t.Fatal("replaced reserved literal still resolves")
+	}
+
+	for name, ids := range map[string]map[string]uint32{
+		"unknown literal": {"<|nope|>": callID},
+		"ordinary id":     {"<|call|>": 100},
+		"duplicate id":    {"<|call|>": callID, "<|return|>": callID},
+		"end/call clash":  {"<|call|>": tokenizer.TokEnd},
+	} {
+		if _, err := LoadEncoding(HarmonyGptOss, WithSpecialTokenIDs(ids)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	// Swapping two formatting ids is fine when both move.
+	swapped, err := LoadEncoding(HarmonyGptOss, WithSpecialTokenIDs(map[string]uint32{"<|call|>": tokenizer.TokEnd, "<|end|>": tokenizer.TokCall}))
+	if err != nil {
+		t.Fatalf("LoadEncoding swap: %v", err)
+	}
+	toks, err = swapped.Render(Message{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "hi"}}})
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if toks[len(toks)-1] != tokenizer.TokCall {
+		t.Fatalf("swapped <|end|> renders as %d", toks[len(toks)-1])
+	}
+}
+
+func TestDecodePretty(t *testing.T) {
+	enc := mustEncoding(t)
+	conv := Conversation{Messages: []Message{
+		{Author: Author{Role: RoleSystem}, Content: []Content{{Type: ContentSystem, System: &SystemContent{}}}},
+		{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "Weather?"}}},
+		{Author: Author{Role: RoleAssistant}, Recipient: "functions.get_weather", Channel: "commentary", ContentType: "<|constrain|>json",
+			Content: []Content{{Type: ContentText, Text: `{"city":"Oslo"}`}}},
+	}}
+	toks, err := enc.RenderConversation(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	got, err := enc.DecodePretty(toks)
+	if err != nil {
+		t.Fatalf("DecodePretty: %v", err)
+	}
+	want, err := enc.RenderConversationString(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversationString: %v", err)
+	}
+	if got != want {
+		t.Fatalf("pretty decode differs from string render\n got: %q\nwant: %q", got, want)
+	}
+	if !strings.Contains(got, "<|start|>assistant to=functions.get_weather<|channel|>commentary <|constrain|>json<|message|>{\"city\":\"Oslo\"}<|call|>") {
+		t.Fatalf("special markers not visible: %q", got)
+	}
+}
+
+func TestCountGeneratedTokens(t *testing.T) {
+	enc := mustEncoding(t)
+	completion := enc.bpe.EncodeWithSpecialTokens("<|start|>assistant<|channel|>analysis<|message|>Let me check.<|end|>" +
+		"<|start|>assistant<|channel|>final<|message|>It is sunny.<|return|>")
+	msgs, err := enc.ParseMessagesFromCompletionTokens(completion, nil)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	prompt := []Message{{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "Weather?"}}}}
+	n, err := enc.CountGeneratedTokens(append(prompt, msgs...))
+	if err != nil {
+		t.Fatalf("CountGeneratedTokens: %v", err)
+	}
+	if n != len(completion) {
+		t.Fatalf("counted %d tokens, model emitted %d", n, len(completion))
+	}
+	if n, err := enc.CountGeneratedTokens(prompt); err != nil || n != 0 {
+		t.Fatalf("prompt-only count = %d, %v", n, err)
+	}
+}
+
+func TestDumpVocab(t *testing.T) {
+	enc := mustEncoding(t)
+	vocab, err := enc.DumpVocab()
+	if err != nil {
+		t.Fatalf("DumpVocab: %v", err)
+	}
+	if string(vocab[tokenizer.TokStart]) != "<|start|>" {
+		t.Fatalf("special entry = %q", vocab[tokenizer.TokStart])
+	}
+	toks := enc.bpe.EncodeOrdinary("hello world")
+	var joined []byte
+	for _, tok := range toks {
+		joined = append(joined, vocab[tok]...)
+	}
+	if string(joined) != "hello world" {
+		t.Fatalf("vocab bytes do not reproduce text: %q", joined)
+	}
+}
+
+func TestDecodeUTF8Lossy(t *testing.T) {
+	enc := mustEncoding(t)
+	full := enc.bpe.EncodeOrdinary("héllo")
+	s, bad, err := enc.DecodeUTF8Lossy(full)
+	if err != nil || bad || s != "héllo" {
+		t.Fatalf("valid decode: %q %v %v", s, bad, err)
+	}
+
+	// Drop trailing tokens until the byte stream ends mid-rune.
+	var cut []uint32
+	for n := len(full) - 1; n > 0; n-- {
+		b, _ := enc.DecodeBytes(full[:n])
+		if !utf8.Valid(b) {
+			cut = full[:n]
+			break
+		}
+	}
+	if cut == nil {
+		t.Skip("tokenizer keeps é in a single token; no split to test")
+	}
+	s, bad, err = enc.DecodeUTF8Lossy(cut)
+	if err != nil || !bad || !strings.HasSuffix(s, "�") {
+		t.Fatalf("lossy decode: %q %v %v", s, bad, err)
+	}
+
+	if _, _, err := enc.DecodeUTF8Lossy([]uint32{^uint32(0)}); err == nil {
+		t.Fatalf("expected error for unknown token")
+	}
+}
+
+func TestRenderedSystemText(t *testing.T) {
+	enc := mustEncoding(t)
+	conv := Conversation{Messages: []Message{
+		{Author: Author{Role: RoleSystem}, Content: []Content{{Type: ContentSystem, System: &SystemContent{ModelIdentity: strPtr("You are a test model.")}}}},
+		{Author: Author{Role: RoleDeveloper}, Content: []Content{{Type: ContentDeveloper, Developer: &DeveloperContent{Instructions: strPtr("Be brief.")}}}},
+		{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "hello"}}},
+	}}
+	got, err := enc.RenderedSystemText(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderedSystemText: %v", err)
+	}
+	if strings.Contains(got, "<|") {
+		t.Fatalf("expected no framing tokens, got %q", got)
+	}
+	if !strings.HasPrefix(got, "You are a test model.") || !strings.Contains(got, "\n\n# Instructions\n\nBe brief.") {
+		t.Fatalf("unexpected system text: %q", got)
+	}
+	if strings.Contains(got, "hello") {
+		t.Fatalf("user message leaked into system text: %q", got)
+	}
+}
+
+func TestLoadEncodingWithMessageCache(t *testing.T) {
+	enc, err := LoadEncoding(HarmonyGptOss, WithMessageCache(2))
+	if err != nil {
+		t.Fatalf("LoadEncoding: %v", err)
+	}
+	plain := mustEncoding(t)
+	text := func(role Role, s string) Message {
+		return Message{Author: Author{Role: role}, Content: []Content{{Type: ContentText, Text: s}}}
+	}
+	conv := Conversation{Messages: []Message{text(RoleUser, "line\r\none"), text(RoleUser, "again")}}
+	for _, cfg := range []*RenderConversationConfig{nil, {NormalizeNewlines: true}, nil} {
+		want, err := plain.RenderConversation(conv, cfg)
+		if err != nil {
+			t.Fatalf("RenderConversation: %v", err)
+		}
+		got, err := enc.RenderConversation(conv, cfg)
+		if err != nil || !slices.Equal(got, want) {
+			t.Fatalf("cached render mismatch (cfg %+v)\n got: %v\nwant: %v", cfg, got, want)
+		}
+		got[0] = 0 // callers own the result; the cache keeps its own copy
+	}
+	if n := enc.msgCache.len(); n != 2 {
+		t.Fatalf("cache holds %d entries, want 2 (LRU bound)", n)
+	}
+	if _, err := enc.Render(Message{Author: Author{Role: RoleTool}}); err == nil {
+		t.Fatal("expected error for unnamed tool message")
+	}
+}
+
+func TestDropAnalysisMatchesRender(t *testing.T) {
+	enc := mustEncoding(t)
+	user := Message{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "hi"}}}
+	say := func(channel, text string) Message {
+		return Message{Author: Author{Role: RoleAssistant}, Channel: channel, Content: []Content{{Type: ContentText, Text: text}}}
+	}
+	cases := map[string][]Message{
+		"final":       {user, say("analysis", "a"), say("final", "done")},
+		"no final":    {user, say("analysis", "a"), say("commentary", "c")},
+		"trailing":    {user, say("analysis", "a"), say("final", "done"), user, say("analysis", "b")},
+		"second turn": {user, say("analysis", "a"), say("final", "one"), user, say("analysis", "b"), say("final", "two")},
+	}
+	for name, msgs := range cases {
+		t.Run(name, func(t *testing.T) {
+			before := slices.Clone(msgs)
+			got := DropAnalysis(msgs)
+			if !slices.EqualFunc(msgs, before, func(a, b Message) bool { return a.Channel == b.Channel }) {
+				t.Fatalf("DropAnalysis modified its input")
+			}
+			want, err := enc.RenderConversation(Conversation{Messages: msgs}, nil)
+			if err != nil {
+				t.Fatalf("RenderConversation: %v", err)
+			}
+			toks, err := enc.RenderConversation(Conversation{Messages: got}, &RenderConversationConfig{AutoDropAnalysis: false})
+			if err != nil {
+				t.Fatalf("RenderConversation dropped: %v", err)
+			}
+			if !slices.Equal(toks, want) {
+				t.Fatalf("DropAnalysis kept %d messages; render differs from auto-drop", len(got))
+			}
+		})
+	}
+	// Only analysis before the first final is dropped, as when rendering.
+	if got := DropAnalysis(cases["second turn"]); len(got) != 5 {
+		t.Fatalf("second turn: got %d messages, want 5", len(got))
+	}
+}
+
+func TestRenderAppendMatchesConversation(t *testing.T) {
+	enc := mustEncoding(t)
+	dev := DeveloperContent{Tools: map[string]ToolNamespaceConfig{
+		"functions": {Name: "functions", Tools: []ToolDescription{{Name: "lookup", Description: "Look up a term."}}},
+	}}
+	conv := Conversation{Messages: []Message{
+		{Author: Author{Role: RoleDeveloper}, Content: []Content{{Type: ContentDeveloper, Developer: &dev}}},
+		{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "define harmony"}}},
+		{Author: Author{Role: RoleAssistant}, Channel: "commentary", Recipient: "functions.lookup", ContentType: "<|constrain|>json", Content: []Content{{Type: ContentText, Text: `{"q":"harmony"}`}}},
+		NewToolResult("functions.lookup", "agreement", false),
+	}}
+	want, err := enc.RenderConversation(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	var got []uint32
+	for i, m := range conv.Messages {
+		toks, err := enc.RenderAppend(m, Conversation{Messages: conv.Messages[:i]})
+		if err != nil {
+			t.Fatalf("RenderAppend %d: %v", i, err)
+		}
+		got = append(got, toks...)
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("appended render differs from conversation render")
+	}
+
+	offChannel := Message{Author: Author{Role: RoleAssistant}, Channel: "analysis", Recipient: "functions.lookup", Content: []Content{{Type: ContentText, Text: "{}"}}}
+	var chErr *FunctionCallChannelError
+	if _, err := enc.RenderAppend(offChannel, conv); !errors.As(err, &chErr) || chErr.Index != len(conv.Messages) {
+		t.Fatalf("expected FunctionCallChannelError at %d, got %v", len(conv.Messages), err)
+	}
+}
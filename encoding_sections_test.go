@@ -2,8 +2,11 @@ package harmony
 
 import (
 	"encoding/json"
+	"errors"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/euforicio/harmony-go/tokenizer"
 )
@@ -247,3 +250,507 @@ func TestRenderDeveloperContentAndTools_Text(t *testing.T) {
 		}
 	}
 }
+
+func TestRenderToolsExplicitPropertyOrder(t *testing.T) {
+	enc := mustEncoding(t)
+
+	params, err := json.Marshal(map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"zeta":  map[string]any{"type": "string"},
+			"alpha": map[string]any{"type": "number"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Marshal params: %v", err)
+	}
+	msg := Message{
+		Author: Author{Role: RoleDeveloper},
+		Content: []Content{{
+			Type: ContentDeveloper,
+			Developer: &DeveloperContent{Tools: map[string]ToolNamespaceConfig{
+				"functions": {
+					Name: "functions",
+					Tools: []ToolDescription{{
+						Name:          "ordered",
+						Parameters:    params,
+						PropertyOrder: []string{"zeta", "missing", "alpha"},
+					}},
+				},
+			}},
+		}},
+	}
+
+	tokens, err := enc.Render(msg)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	body := extractMessageBody(t, enc, tokens, 0)
+	if !strings.Contains(body, "{\nzeta?: string,\nalpha?: number,\n}") {
+		t.Fatalf("explicit property order not respected:\n%s", body)
+	}
+	if strings.Contains(body, "missing") {
+		t.Fatalf("undeclared property rendered:\n%s", body)
+	}
+}
+
+func TestRenderToolsNestedPropertyOrder(t *testing.T) {
+	enc := mustEncoding(t)
+	params := json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"stops": {
+				"type": "array",
+				"items": {
+					"type": "object",
+					"properties": {
+						"zeta": {"type": "string"},
+						"alpha": {"type": "number"},
+						"mid": {"type": "boolean"}
+					},
+					"required": ["zeta"]
+				}
+			},
+			"origin": {
+				"type": "object",
+				"properties": {"lon": {"type": "number"}, "lat": {"type": "number"}}
+			}
+		}
+	}`)
+	msg := Message{
+		Author: Author{Role: RoleDeveloper},
+		Content: []Content{{
+			Type: ContentDeveloper,
+			Developer: &DeveloperContent{Tools: map[string]ToolNamespaceConfig{
+				"functions": {
+					Name:  "functions",
+					Tools: []ToolDescription{{Name: "route", Parameters: params}},
+				},
+			}},
+		}},
+	}
+
+	tokens, err := enc.Render(msg)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	body := extractMessageBody(t, enc, tokens, 0)
+	want := "stops?: {\n    zeta: string,\n    alpha?: number,\n    mid?: boolean,\n\n   }[],\norigin?: {\n    lon?: number,\n    lat?: number,\n\n   },"
+	if !strings.Contains(body, want) {
+		t.Fatalf("nested property order not preserved:\n%s", body)
+	}
+}
+
+func TestRenderSystemContentLabelOverrides(t *testing.T) {
+	enc := mustEncoding(t)
+	sys := SystemContent{
+		KnowledgeCutoff:       strPtr("2024-06"),
+		ConversationStartDate: strPtr("2025-01-02"),
+	}
+	conv := Conversation{Messages: []Message{{
+		Author:  Author{Role: RoleSystem},
+		Content: []Content{{Type: ContentSystem, System: &sys}},
+	}}}
+
+	tokens, err := enc.RenderConversation(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	body := extractMessageBody(t, enc, tokens, 0)
+	if !strings.Contains(body, "Knowledge cutoff: 2024-06\nCurrent date: 2025-01-02") {
+		t.Fatalf("default labels changed: %q", body)
+	}
+
+	cfg := &RenderConversationConfig{AutoDropAnalysis: true, KnowledgeCutoffLabel: "Wissensstand", CurrentDateLabel: "Heute"}
+	tokens, err = enc.RenderConversation(conv, cfg)
+	if err != nil {
+		t.Fatalf("RenderConversation with labels: %v", err)
+	}
+	body = extractMessageBody(t, enc, tokens, 0)
+	if !strings.Contains(body, "Wissensstand: 2024-06\nHeute: 2025-01-02") {
+		t.Fatalf("label overrides not applied: %q", body)
+	}
+}
+
+func TestRenderAutoConversationStartDate(t *testing.T) {
+	enc := mustEncoding(t)
+	render := func(sys SystemContent, cfg *RenderConversationConfig) string {
+		t.Helper()
+		conv := Conversation{Messages: []Message{{
+			Author:  Author{Role: RoleSystem},
+			Content: []Content{{Type: ContentSystem, System: &sys}},
+		}}}
+		tokens, err := enc.RenderConversation(conv, cfg)
+		if err != nil {
+			t.Fatalf("RenderConversation: %v", err)
+		}
+		return extractMessageBody(t, enc, tokens, 0)
+	}
+	clock := func() time.Time { return time.Date(2025, 3, 4, 23, 59, 0, 0, time.UTC) }
+	cfg := &RenderConversationConfig{AutoDropAnalysis: true, AutoConversationStartDate: true, Now: clock}
+
+	if body := render(SystemContent{}, cfg); !strings.Contains(body, "Knowledge cutoff: 2024-06\nCurrent date: 2025-03-04\n") {
+		t.Fatalf("auto date missing: %q", body)
+	}
+	if body := render(SystemContent{ConversationStartDate: strPtr("2025-01-02")}, cfg); !strings.Contains(body, "Current date: 2025-01-02") {
+		t.Fatalf("explicit date overridden: %q", body)
+	}
+	if body := render(SystemContent{}, nil); strings.Contains(body, "Current date") {
+		t.Fatalf("date rendered without the option: %q", body)
+	}
+}
+
+func TestRenderSystemContentExtraSections(t *testing.T) {
+	enc := mustEncoding(t)
+	sys := &SystemContent{ExtraSections: []string{"# Style\nAnswer tersely.", "", "Locale: de-DE"}}
+	msg := Message{Author: Author{Role: RoleSystem}, Content: []Content{{Type: ContentSystem, System: sys}}}
+	conv := Conversation{Messages: []Message{msg}}
+	text, err := enc.RenderedSystemText(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderedSystemText: %v", err)
+	}
+	want := "# Valid channels: analysis, commentary, final. Channel must be included for every message." +
+		"\n\n# Style\nAnswer tersely.\n\nLocale: de-DE"
+	if !strings.HasSuffix(text, want) {
+		t.Fatalf("extra sections not appended:\n%q", text)
+	}
+
+	data, err := json.Marshal(&msg)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var back Message
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !back.Equal(msg) {
+		t.Fatalf("JSON round trip lost extra sections: %s", data)
+	}
+}
+
+func TestRenderSystemContentOmitSections(t *testing.T) {
+	enc := mustEncoding(t)
+	sys := SystemContent{ConversationStartDate: strPtr("2025-01-02")}
+	conv := Conversation{Messages: []Message{{
+		Author:  Author{Role: RoleSystem},
+		Content: []Content{{Type: ContentSystem, System: &sys}},
+	}}}
+	channels := "# Valid channels: analysis, commentary, final. Channel must be included for every message."
+	cases := []struct {
+		cfg  RenderConversationConfig
+		want string
+	}{
+		{RenderConversationConfig{OmitModelIdentity: true},
+			"Knowledge cutoff: 2024-06\nCurrent date: 2025-01-02\n\nReasoning: medium\n\n" + channels},
+		{RenderConversationConfig{OmitKnowledgeCutoff: true},
+			"You are ChatGPT, a large language model trained by OpenAI.\nCurrent date: 2025-01-02\n\nReasoning: medium\n\n" + channels},
+		{RenderConversationConfig{OmitModelIdentity: true, OmitKnowledgeCutoff: true, OmitReasoning: true},
+			"Current date: 2025-01-02\n\n" + channels},
+	}
+	for _, tc := range cases {
+		tc.cfg.AutoDropAnalysis = true
+		text, err := enc.RenderedSystemText(conv, &tc.cfg)
+		if err != nil {
+			t.Fatalf("RenderedSystemText: %v", err)
+		}
+		if text != tc.want {
+			t.Fatalf("cfg %+v:\n got: %q\nwant: %q", tc.cfg, text, tc.want)
+		}
+	}
+
+	cfg := &RenderConversationConfig{AutoDropAnalysis: true, OmitDefaultKnowledgeCutoff: true}
+	want := "You are ChatGPT, a large language model trained by OpenAI.\nCurrent date: 2025-01-02\n\nReasoning: medium\n\n" + channels
+	if text, err := enc.RenderedSystemText(conv, cfg); err != nil || text != want {
+		t.Fatalf("default cutoff not omitted: %q %v", text, err)
+	}
+	sys.KnowledgeCutoff = strPtr("2025-01")
+	if text, err := enc.RenderedSystemText(conv, cfg); err != nil || !strings.Contains(text, "\nKnowledge cutoff: 2025-01\n") {
+		t.Fatalf("explicit cutoff dropped: %q %v", text, err)
+	}
+	sys.KnowledgeCutoff = nil
+
+	sys.ConversationStartDate = nil
+	cfg = &RenderConversationConfig{AutoDropAnalysis: true, OmitModelIdentity: true, OmitKnowledgeCutoff: true}
+	if text, err := enc.RenderedSystemText(conv, cfg); err != nil || text != "Reasoning: medium\n\n"+channels {
+		t.Fatalf("empty identity section not skipped: %q %v", text, err)
+	}
+}
+
+func TestRenderSectionHeaderOverrides(t *testing.T) {
+	enc := mustEncoding(t)
+	tools := map[string]ToolNamespaceConfig{
+		"functions": {Name: "functions", Tools: []ToolDescription{{Name: "noop", Description: "does nothing"}}},
+	}
+	conv := Conversation{Messages: []Message{
+		{
+			Author:  Author{Role: RoleSystem},
+			Content: []Content{{Type: ContentSystem, System: &SystemContent{Tools: tools}}},
+		},
+		{
+			Author:  Author{Role: RoleDeveloper},
+			Content: []Content{{Type: ContentDeveloper, Developer: &DeveloperContent{Instructions: strPtr("Sei knapp."), Tools: tools}}},
+		},
+	}}
+
+	text, err := enc.RenderConversationString(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversationString: %v", err)
+	}
+	if !strings.Contains(text, "medium\n\n# Tools\n\n## functions") || !strings.Contains(text, "<|message|># Instructions\n\nSei knapp.\n\n# Tools\n\n") {
+		t.Fatalf("default headers changed: %q", text)
+	}
+
+	cfg := &RenderConversationConfig{AutoDropAnalysis: true, InstructionsHeader: "# Anweisungen", ToolsHeader: "# Werkzeuge"}
+	text, err = enc.RenderConversationString(conv, cfg)
+	if err != nil {
+		t.Fatalf("RenderConversationString with headers: %v", err)
+	}
+	if !strings.Contains(text, "medium\n\n# Werkzeuge\n\n## functions") {
+		t.Fatalf("tools header override not applied to system: %q", text)
+	}
+	if !strings.Contains(text, "<|message|># Anweisungen\n\nSei knapp.\n\n# Werkzeuge\n\n") {
+		t.Fatalf("header overrides not applied to developer: %q", text)
+	}
+}
+
+func TestRenderEmptyToolsSection(t *testing.T) {
+	enc, err := LoadEncoding(HarmonyGptOss, WithMessageCache(16))
+	if err != nil {
+		t.Fatalf("LoadEncoding: %v", err)
+	}
+	render := func(tools map[string]ToolNamespaceConfig, cfg *RenderConversationConfig) string {
+		t.Helper()
+		conv := Conversation{Messages: []Message{
+			{Author: Author{Role: RoleSystem}, Content: []Content{{Type: ContentSystem, System: &SystemContent{Tools: tools}}}},
+			{Author: Author{Role: RoleDeveloper}, Content: []Content{{Type: ContentDeveloper, Developer: &DeveloperContent{Instructions: strPtr("Be brief."), Tools: tools}}}},
+		}}
+		text, err := enc.RenderConversationString(conv, cfg)
+		if err != nil {
+			t.Fatalf("RenderConversationString: %v", err)
+		}
+		return text
+	}
+	empty := map[string]ToolNamespaceConfig{}
+	cfg := &RenderConversationConfig{AutoDropAnalysis: true, EmptyToolsSection: true}
+
+	if text := render(empty, nil); strings.Contains(text, "# Tools") {
+		t.Fatalf("empty tools rendered by default: %q", text)
+	}
+	if text := render(nil, cfg); strings.Contains(text, "# Tools") {
+		t.Fatalf("nil tools rendered: %q", text)
+	}
+	text := render(empty, cfg)
+	if !strings.Contains(text, "Reasoning: medium\n\n# Tools\n\n# Valid channels") ||
+		!strings.Contains(text, "<|message|># Instructions\n\nBe brief.\n\n# Tools<|end|>") {
+		t.Fatalf("empty tools section missing: %q", text)
+	}
+	cfg.EmptyToolsNote = "No tools are available."
+	if text := render(empty, cfg); !strings.Contains(text, "Be brief.\n\n# Tools\n\nNo tools are available.<|end|>") {
+		t.Fatalf("empty tools note missing: %q", text)
+	}
+
+	// Token renders go through the message cache, whose key must tell nil
+	// and empty tool maps apart.
+	dev := func(tools map[string]ToolNamespaceConfig) Conversation {
+		return Conversation{Messages: []Message{{Author: Author{Role: RoleDeveloper}, Content: []Content{{Type: ContentDeveloper, Developer: &DeveloperContent{Instructions: strPtr("x"), Tools: tools}}}}}}
+	}
+	a, err := enc.RenderConversation(dev(nil), cfg)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	b, err := enc.RenderConversation(dev(empty), cfg)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	if slices.Equal(a, b) {
+		t.Fatal("cached render ignores nil vs empty tools")
+	}
+}
+
+func TestRenderToolReturnType(t *testing.T) {
+	enc := mustEncoding(t)
+	conv := Conversation{Messages: []Message{{
+		Author: Author{Role: RoleDeveloper},
+		Content: []Content{{Type: ContentDeveloper, Developer: &DeveloperContent{Tools: map[string]ToolNamespaceConfig{
+			"functions": {Name: "functions", Tools: []ToolDescription{
+				{Name: "ping"},
+				{Name: "echo", Parameters: json.RawMessage(`{"type":"object","properties":{"text":{"type":"string"}}}`)},
+				{Name: "broken", Parameters: json.RawMessage(`{`)},
+			}},
+		}}}},
+	}}}
+	text, err := enc.RenderConversationString(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversationString: %v", err)
+	}
+	for _, sig := range []string{"type ping = () => any;", "\n}) => any;", "type broken = (_: any) => any;"} {
+		if !strings.Contains(text, sig) {
+			t.Fatalf("default signature %q missing: %q", sig, text)
+		}
+	}
+	cfg := &RenderConversationConfig{AutoDropAnalysis: true, ToolReturnType: "Promise<any>"}
+	text, err = enc.RenderConversationString(conv, cfg)
+	if err != nil {
+		t.Fatalf("RenderConversationString: %v", err)
+	}
+	for _, sig := range []string{"type ping = () => Promise<any>;", "\n}) => Promise<any>;", "type broken = (_: any) => Promise<any>;"} {
+		if !strings.Contains(text, sig) {
+			t.Fatalf("signature %q missing: %q", sig, text)
+		}
+	}
+	if strings.Contains(text, "=> any;") {
+		t.Fatalf("default return type left over: %q", text)
+	}
+}
+
+func TestRenderMultipleDeveloperContentItems(t *testing.T) {
+	enc := mustEncoding(t)
+	msg := Message{
+		Author: Author{Role: RoleDeveloper},
+		Content: []Content{
+			{Type: ContentDeveloper, Developer: &DeveloperContent{Instructions: strPtr("Be concise.")}},
+			{Type: ContentDeveloper, Developer: &DeveloperContent{Instructions: strPtr("Answer in French.")}},
+			{Type: ContentDeveloper, Developer: &DeveloperContent{Tools: map[string]ToolNamespaceConfig{
+				"functions": {Name: "functions", Tools: []ToolDescription{{Name: "noop", Description: "does nothing"}}},
+			}}},
+		},
+	}
+
+	tokens, err := enc.Render(msg)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	body := extractMessageBody(t, enc, tokens, 0)
+	want := "# Instructions\n\nBe concise.\n\nAnswer in French.\n\n# Tools\n\n## functions"
+	if !strings.HasPrefix(body, want) {
+		t.Fatalf("merged developer content mismatch:\n%s", body)
+	}
+	if strings.Count(body, "# Instructions") != 1 {
+		t.Fatalf("expected a single instructions header:\n%s", body)
+	}
+
+	// The sequential conversation path must agree with single-message render.
+	convTokens, err := enc.RenderConversation(Conversation{Messages: []Message{msg}}, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	if got := extractMessageBody(t, enc, convTokens, 0); got != body {
+		t.Fatalf("conversation render diverged:\n%s\n---\n%s", got, body)
+	}
+
+	// A namespace declared by two items is reported, not silently replaced.
+	msg.Content = append(msg.Content, Content{Type: ContentDeveloper, Developer: &DeveloperContent{Tools: map[string]ToolNamespaceConfig{
+		"functions": {Name: "functions", Tools: []ToolDescription{{Name: "other"}}},
+	}}})
+	var dup *DuplicateNameError
+	if _, err := enc.Render(msg); !errors.As(err, &dup) || dup.Kind != "namespace" || !slices.Equal(dup.Names, []string{"functions"}) {
+		t.Fatalf("expected duplicate namespace error, got %v", err)
+	}
+}
+
+func TestRenderSystemContentNoDefaultChannels(t *testing.T) {
+	enc := mustEncoding(t)
+	sys := SystemContent{ModelIdentity: strPtr("model")}
+	conv := Conversation{Messages: []Message{{
+		Author:  Author{Role: RoleSystem},
+		Content: []Content{{Type: ContentSystem, System: &sys}},
+	}}}
+	cfg := &RenderConversationConfig{AutoDropAnalysis: true, NoDefaultChannels: true}
+
+	tokens, err := enc.RenderConversation(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	if body := extractMessageBody(t, enc, tokens, 0); !strings.Contains(body, "# Valid channels:") {
+		t.Fatalf("default channels missing: %q", body)
+	}
+
+	tokens, err = enc.RenderConversation(conv, cfg)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	if body := extractMessageBody(t, enc, tokens, 0); strings.Contains(body, "channels") {
+		t.Fatalf("expected no channels section: %q", body)
+	}
+
+	sys.ChannelConfig = &ChannelConfig{ValidChannels: []string{"final"}}
+	tokens, err = enc.RenderConversation(conv, cfg)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	if body := extractMessageBody(t, enc, tokens, 0); !strings.Contains(body, "# Valid channels: final.") {
+		t.Fatalf("explicit channels not rendered: %q", body)
+	}
+}
+
+func TestRenderSystemContentReasoningBudget(t *testing.T) {
+	enc := mustEncoding(t)
+	effort := ReasoningHigh
+	budget := 2048
+	sys := SystemContent{ReasoningEffort: &effort}
+	conv := Conversation{Messages: []Message{{
+		Author:  Author{Role: RoleSystem},
+		Content: []Content{{Type: ContentSystem, System: &sys}},
+	}}}
+
+	tokens, err := enc.RenderConversation(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	if body := extractMessageBody(t, enc, tokens, 0); !strings.Contains(body, "Reasoning: high\n") {
+		t.Fatalf("reasoning line changed without budget: %q", body)
+	}
+
+	sys.ReasoningBudget = &budget
+	tokens, err = enc.RenderConversation(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	if body := extractMessageBody(t, enc, tokens, 0); !strings.Contains(body, "Reasoning: high (budget: 2048)\n") {
+		t.Fatalf("budget not rendered: %q", body)
+	}
+
+	raw, err := json.Marshal(sys)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var back SystemContent
+	if err := json.Unmarshal(raw, &back); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if back.ReasoningBudget == nil || *back.ReasoningBudget != budget {
+		t.Fatalf("budget lost in JSON round-trip: %s", raw)
+	}
+}
+
+func TestRenderToolMultiParagraphDescription(t *testing.T) {
+	enc := mustEncoding(t)
+	msg := Message{
+		Author: Author{Role: RoleDeveloper},
+		Content: []Content{{Type: ContentDeveloper, Developer: &DeveloperContent{
+			Tools: map[string]ToolNamespaceConfig{"functions": {
+				Name: "functions",
+				Tools: []ToolDescription{{
+					Name:        "summarize",
+					Description: "Summarizes text.\n\n**Notes**\n- keeps markdown",
+					Parameters:  json.RawMessage(`{"type":"object","properties":{"text":{"type":"string","description":"Input.\n\nPlain or markdown."}}}`),
+				}},
+			}},
+		}}},
+	}
+	tokens, err := enc.Render(msg)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	body := extractMessageBody(t, enc, tokens, 0)
+	want := "// Summarizes text.\n//\n// **Notes**\n// - keeps markdown\ntype summarize = (_: {\n"
+	if !strings.Contains(body, want) {
+		t.Fatalf("tool comment block mismatch; want %q in:\n%s", want, body)
+	}
+	if !strings.Contains(body, "// Input.\n//\n// Plain or markdown.\n") {
+		t.Fatalf("parameter comment block mismatch:\n%s", body)
+	}
+	if strings.Contains(body, "// \n") {
+		t.Fatalf("blank comment line has trailing space:\n%s", body)
+	}
+}
@@ -0,0 +1,65 @@
+package harmony
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+)
+
+// Equal reports whether m and other have the same author, recipient,
+// channel, content type and content. System and developer content are
+// compared by value, tool parameter caches are ignored, and nil and empty
+// slices or maps are equal. Message.JSON and Message.RawHeader are parser
+// annotations and are not compared.
+func (m Message) Equal(other Message) bool {
+	return m.Author == other.Author &&
+		m.Recipient == other.Recipient &&
+		m.Channel == other.Channel &&
+		m.ContentType == other.ContentType &&
+		slices.EqualFunc(m.Content, other.Content, contentEqual)
+}
+
+func contentEqual(a, b Content) bool {
+	return a.Type == b.Type && a.Text == b.Text &&
+		ptrEqual(a.System, b.System, systemContentEqual) &&
+		ptrEqual(a.Developer, b.Developer, developerContentEqual)
+}
+
+func systemContentEqual(a, b *SystemContent) bool {
+	return ptrEqual(a.ModelIdentity, b.ModelIdentity, valueEqual) &&
+		ptrEqual(a.ReasoningEffort, b.ReasoningEffort, valueEqual) &&
+		ptrEqual(a.ReasoningBudget, b.ReasoningBudget, valueEqual) &&
+		toolsEqual(a.Tools, b.Tools) &&
+		ptrEqual(a.ConversationStartDate, b.ConversationStartDate, valueEqual) &&
+		ptrEqual(a.KnowledgeCutoff, b.KnowledgeCutoff, valueEqual) &&
+		ptrEqual(a.ChannelConfig, b.ChannelConfig, func(x, y *ChannelConfig) bool {
+			return x.ChannelRequired == y.ChannelRequired && slices.Equal(x.ValidChannels, y.ValidChannels)
+		}) &&
+		slices.Equal(a.ExtraSections, b.ExtraSections)
+}
+
+func developerContentEqual(a, b *DeveloperContent) bool {
+	return ptrEqual(a.Instructions, b.Instructions, valueEqual) && toolsEqual(a.Tools, b.Tools)
+}
+
+func toolsEqual(a, b map[string]ToolNamespaceConfig) bool {
+	return maps.EqualFunc(a, b, func(x, y ToolNamespaceConfig) bool {
+		return x.Name == y.Name &&
+			ptrEqual(x.Description, y.Description, valueEqual) &&
+			slices.EqualFunc(x.Tools, y.Tools, func(s, t ToolDescription) bool {
+				return s.Name == t.Name && s.Description == t.Description &&
+					bytes.Equal(s.Parameters, t.Parameters) &&
+					slices.Equal(s.PropertyOrder, t.PropertyOrder)
+			})
+	})
+}
+
+// ptrEqual reports whether a and b are both nil, or both non-nil and eq.
+func ptrEqual[T any](a, b *T, eq func(a, b *T) bool) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return eq(a, b)
+}
+
+func valueEqual[T comparable](a, b *T) bool { return *a == *b }
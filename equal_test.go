@@ -0,0 +1,71 @@
+package harmony
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMessageEqual(t *testing.T) {
+	build := func() []Message {
+		instr := "be brief"
+		return []Message{
+			{
+				Author: Author{Role: RoleSystem},
+				Content: []Content{{Type: ContentSystem, System: &SystemContent{
+					ModelIdentity:   strPtr("model"),
+					ReasoningEffort: reasoningPtr(ReasoningHigh),
+					ChannelConfig:   &ChannelConfig{ValidChannels: []string{"analysis", "final"}, ChannelRequired: true},
+				}}},
+			},
+			{
+				Author: Author{Role: RoleDeveloper},
+				Content: []Content{{Type: ContentDeveloper, Developer: &DeveloperContent{
+					Instructions: &instr,
+					Tools: map[string]ToolNamespaceConfig{"functions": {
+						Name:  "functions",
+						Tools: []ToolDescription{{Name: "f", Parameters: json.RawMessage(`{"type":"object"}`)}},
+					}},
+				}}},
+			},
+			{Author: Author{Role: RoleAssistant, Name: "bot"}, Recipient: "functions.f", Channel: "commentary", ContentType: "<|constrain|>json", Content: []Content{{Type: ContentText, Text: "{}"}}},
+		}
+	}
+	a, b := build(), build()
+	// A populated parameter cache on one side must not matter.
+	if _, _, err := a[1].Content[0].Developer.Tools["functions"].Tools[0].parsedParameters(); err != nil {
+		t.Fatalf("parsedParameters: %v", err)
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			t.Fatalf("message %d: distinct but equal values compare unequal", i)
+		}
+	}
+
+	edits := map[string]func(ms []Message){
+		"model identity": func(ms []Message) { *ms[0].Content[0].System.ModelIdentity = "other" },
+		"nil effort":     func(ms []Message) { ms[0].Content[0].System.ReasoningEffort = nil },
+		"valid channels": func(ms []Message) { ms[0].Content[0].System.ChannelConfig.ValidChannels[1] = "commentary" },
+		"instructions":   func(ms []Message) { *ms[1].Content[0].Developer.Instructions = "be verbose" },
+		"tool parameters": func(ms []Message) {
+			ms[1].Content[0].Developer.Tools["functions"].Tools[0].Parameters = json.RawMessage(`{}`)
+		},
+		"author name":  func(ms []Message) { ms[2].Author.Name = "" },
+		"content type": func(ms []Message) { ms[2].ContentType = "" },
+		"text":         func(ms []Message) { ms[2].Content[0].Text = "{ }" },
+	}
+	for name, edit := range edits {
+		c := build()
+		edit(c)
+		same := true
+		for i := range c {
+			same = same && c[i].Equal(b[i])
+		}
+		if same {
+			t.Errorf("%s: edit not detected", name)
+		}
+	}
+
+	if !(Message{Author: Author{Role: RoleUser}}).Equal(Message{Author: Author{Role: RoleUser}, Content: []Content{}}) {
+		t.Error("nil and empty content should be equal")
+	}
+}
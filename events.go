@@ -0,0 +1,59 @@
+package harmony
+
+// Event is passed to the hook installed with WithEventHook. It is one of
+// RenderStart, RenderComplete, RenderWarning, ParseError or DecodeError.
+type Event interface{ isEvent() }
+
+// RenderStart is emitted when RenderConversation (or a variant built on it)
+// begins.
+type RenderStart struct {
+	// Messages is the number of messages in the conversation.
+	Messages int
+}
+
+// RenderComplete is emitted when RenderConversation returns.
+type RenderComplete struct {
+	// Messages is the number of messages rendered and Dropped the number
+	// removed by analysis auto-drop. Both are zero when Err is set.
+	Messages int
+	Dropped  int
+	// Tokens is the number of tokens produced.
+	Tokens int
+	Err    error
+}
+
+// RenderWarning is emitted for a problem that a render config downgraded
+// from an error, e.g. a *MissingChannelError under ChannelRequiredWarnOnly.
+// The render continues.
+type RenderWarning struct{ Err error }
+
+// ParseError is emitted when parsing completion tokens fails.
+type ParseError struct{ Err error }
+
+// DecodeError is emitted when decoding tokens fails.
+type DecodeError struct{ Err error }
+
+func (RenderStart) isEvent()    {}
+func (RenderComplete) isEvent() {}
+func (RenderWarning) isEvent()  {}
+func (ParseError) isEvent()     {}
+func (DecodeError) isEvent()    {}
+
+// WithEventHook installs fn to receive render, parse and decode events, e.g.
+// to feed metrics or logs. fn is called synchronously on the calling
+// goroutine and must be safe for concurrent use when the Encoding is shared.
+// Without a hook, no events are built.
+func WithEventHook(fn func(Event)) LoadOption {
+	return func(c *loadConfig) { c.hook = fn }
+}
+
+// emitErr reports err through the hook, wrapped by wrap, when both are set.
+func (e *Encoding) emitErr(err error, wrap func(error) Event) {
+	if e.hook != nil && err != nil {
+		e.hook(wrap(err))
+	}
+}
+
+func renderWarningEvent(err error) Event { return RenderWarning{Err: err} }
+func parseErrorEvent(err error) Event    { return ParseError{Err: err} }
+func decodeErrorEvent(err error) Event   { return DecodeError{Err: err} }
@@ -0,0 +1,65 @@
+package harmony
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestEventHook(t *testing.T) {
+	var mu sync.Mutex
+	var events []Event
+	enc, err := LoadEncoding(HarmonyGptOss, WithEventHook(func(ev Event) {
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	}))
+	if err != nil {
+		t.Fatalf("LoadEncoding: %v", err)
+	}
+	conv := Conversation{Messages: []Message{
+		{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "hi"}}},
+		{Author: Author{Role: RoleAssistant}, Channel: "analysis", Content: []Content{{Type: ContentText, Text: "think"}}},
+		{Author: Author{Role: RoleAssistant}, Channel: "final", Content: []Content{{Type: ContentText, Text: "hello"}}},
+	}}
+	toks, err := enc.RenderConversation(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	if len(events) != 2 || events[0] != (RenderStart{Messages: 3}) || events[1] != (RenderComplete{Messages: 2, Dropped: 1, Tokens: len(toks)}) {
+		t.Fatalf("unexpected render events: %+v", events)
+	}
+
+	events = nil
+	if _, err := enc.ParseMessagesFromCompletionTokens(toks[1:], nil); err == nil {
+		t.Fatal("expected parse error")
+	}
+	if _, err := enc.DecodeUTF8([]uint32{1 << 30}); err == nil {
+		t.Fatal("expected decode error")
+	}
+	if len(events) != 2 {
+		t.Fatalf("unexpected error events: %+v", events)
+	}
+	if ev, ok := events[0].(ParseError); !ok || ev.Err == nil {
+		t.Fatalf("expected ParseError, got %+v", events[0])
+	}
+	if ev, ok := events[1].(DecodeError); !ok || ev.Err == nil {
+		t.Fatalf("expected DecodeError, got %+v", events[1])
+	}
+
+	events = nil
+	in := make(chan uint32, len(toks))
+	for _, tok := range toks[1:] {
+		in <- tok
+	}
+	close(in)
+	msgs, errs := enc.StreamParseChannel(context.Background(), in)
+	for range msgs {
+	}
+	streamErr := <-errs
+	mu.Lock()
+	defer mu.Unlock()
+	if streamErr == nil || len(events) != 1 || events[0] != (ParseError{Err: streamErr}) {
+		t.Fatalf("StreamParseChannel error %v, events %+v", streamErr, events)
+	}
+}
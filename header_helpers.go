@@ -54,43 +54,30 @@ func nextValueToken(input string) string {
 }
 
 // detectRoleAndAuthor infers the role from the header's leading token and
-// recovers the author name when applicable (especially for tools).
+// recovers the author name when applicable (especially for tools). A leading
+// word other than a known role is treated as a tool name.
 func detectRoleAndAuthor(roleToken, remainder string) (Role, string) {
-	var detected Role
-	switch {
-	case roleToken == string(RoleUser) || strings.HasPrefix(roleToken, string(RoleUser)+":"):
-		detected = RoleUser
-	case roleToken == string(RoleAssistant) || strings.HasPrefix(roleToken, string(RoleAssistant)+":"):
-		detected = RoleAssistant
-	case roleToken == string(RoleSystem) || strings.HasPrefix(roleToken, string(RoleSystem)+":"):
-		detected = RoleSystem
-	case roleToken == string(RoleDeveloper) || strings.HasPrefix(roleToken, string(RoleDeveloper)+":"):
-		detected = RoleDeveloper
-	default:
-		detected = RoleTool
+	// One cut and one string switch instead of a prefix test per role.
+	base, alias, _ := strings.Cut(roleToken, ":")
+	switch Role(base) {
+	case RoleUser, RoleAssistant, RoleSystem, RoleDeveloper:
+		return Role(base), alias
 	}
+	detected := RoleTool
 
-	// author name (for tools or role:name aliases)
+	// author name for tools
 	name := ""
-	if detected == RoleTool {
-		switch {
-		case strings.HasPrefix(roleToken, "tool:"):
-			name = roleToken[len("tool:"):]
-		case roleToken == string(RoleTool):
-			name = nextValueToken(remainder)
-		case roleToken != "":
-			name = roleToken
-		}
-		if name == "" {
-			name = nextValueToken(remainder)
-		}
-	} else {
-		aliasPrefix := string(detected) + ":"
-		if strings.HasPrefix(roleToken, aliasPrefix) {
-			name = roleToken[len(aliasPrefix):]
-		}
+	switch {
+	case strings.HasPrefix(roleToken, "tool:"):
+		name = roleToken[len("tool:"):]
+	case roleToken == string(RoleTool), strings.HasPrefix(roleToken, "to="):
+		name = nextValueToken(remainder)
+	case roleToken != "":
+		name = roleToken
+	}
+	if name == "" {
+		name = nextValueToken(remainder)
 	}
-
 	return detected, name
 }
 
@@ -106,9 +93,17 @@ func extractChannel(s string) string {
 	return ""
 }
 
+// extractRecipient returns the value of the header's to= field. The field
+// may lead the header when the role was supplied out of band.
 func extractRecipient(s string) string {
-	if idx := strings.Index(s, " to="); idx != -1 {
-		after := s[idx+len(" to="):]
+	idx := strings.Index(s, " to=")
+	if idx != -1 {
+		idx++
+	} else if strings.HasPrefix(s, "to=") {
+		idx = 0
+	}
+	if idx != -1 {
+		after := s[idx+len("to="):]
 		end := -1
 		for i := 0; i < len(after); i++ {
 			if after[i] == ' ' || after[i] == '<' {
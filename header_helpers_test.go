@@ -39,6 +39,16 @@ func TestDetectRoleAndAuthor(t *testing.T) {
 	if r != RoleTool || name != "browser.search" {
 		t.Fatalf("tool explicit: got (%v,%q)", r, name)
 	}
+	// role words only match whole; a longer word is a tool name
+	r, name = detectRoleAndAuthor("assistants", "")
+	if r != RoleTool || name != "assistants" {
+		t.Fatalf("role-like tool: got (%v,%q)", r, name)
+	}
+	// empty alias
+	r, name = detectRoleAndAuthor("user:", "")
+	if r != RoleUser || name != "" {
+		t.Fatalf("empty alias: got (%v,%q)", r, name)
+	}
 }
 
 func TestExtractors(t *testing.T) {
@@ -49,6 +59,9 @@ func TestExtractors(t *testing.T) {
 	if rcpt := extractRecipient(s); rcpt != "functions.get_weather" {
 		t.Fatalf("extractRecipient: %q", rcpt)
 	}
+	if rcpt := extractRecipient("to=functions.b <|channel|>commentary"); rcpt != "functions.b" {
+		t.Fatalf("extractRecipient leading: %q", rcpt)
+	}
 }
 
 func TestScrubContentType(t *testing.T) {
@@ -58,3 +71,11 @@ func TestScrubContentType(t *testing.T) {
 		t.Fatalf("scrubContentType: %q", ct)
 	}
 }
+
+func BenchmarkDetectRoleAndAuthor(b *testing.B) {
+	tokens := []string{"assistant", "user", "developer:ops", "functions.lookup_weather", "tool:browser.search"}
+	b.ReportAllocs()
+	for i := 0; b.Loop(); i++ {
+		detectRoleAndAuthor(tokens[i%len(tokens)], "<|channel|>commentary")
+	}
+}
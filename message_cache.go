@@ -0,0 +1,101 @@
+package harmony
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+)
+
+// messageCacheKey identifies a rendered message: a SHA-256 over the message's
+// binary encoding and the render options that affect its tokens.
+type messageCacheKey [sha256.Size]byte
+
+// messageCache is a fixed-size LRU of rendered message tokens. Messages are
+// values, so entries never need invalidation; they only age out.
+type messageCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[messageCacheKey]*list.Element
+}
+
+type messageCacheEntry struct {
+	key  messageCacheKey
+	toks []uint32
+}
+
+func newMessageCache(size int) *messageCache {
+	return &messageCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[messageCacheKey]*list.Element, size),
+	}
+}
+
+// appendTo appends the cached tokens for key to out and reports whether the
+// key was present.
+func (c *messageCache) appendTo(key messageCacheKey, out *[]uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	c.ll.MoveToFront(el)
+	*out = append(*out, el.Value.(*messageCacheEntry).toks...)
+	return true
+}
+
+// put stores a private copy of toks under key, evicting the least recently
+// used entry when full.
+func (c *messageCache) put(key messageCacheKey, toks []uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&messageCacheEntry{key: key, toks: append([]uint32(nil), toks...)})
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*messageCacheEntry).key)
+	}
+}
+
+func (c *messageCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// cacheKey hashes msg together with opts. It reports false for messages the
+// binary encoding rejects; those are rendered uncached so the renderer
+// reports the error.
+func cacheKey(msg *Message, opts renderOptions) (messageCacheKey, bool) {
+	w := binWriter{}
+	if err := w.message(msg); err != nil {
+		return messageCacheKey{}, false
+	}
+	w.bool(opts.conversationHasFunctionTools)
+	w.bool(opts.validateConstrained)
+	w.str(opts.knowledgeCutoffLabel)
+	w.str(opts.currentDateLabel)
+	w.str(opts.autoStartDate)
+	w.bool(opts.normalizeNewlines)
+	w.bool(opts.noDefaultChannels)
+	w.bool(opts.allowContentSpecials)
+	w.bool(opts.detectRenderedContent)
+	w.bool(opts.sanitizeContent)
+	w.bool(opts.stripZeroWidthSpace)
+	w.str(opts.instructionsHeader)
+	w.str(opts.toolsHeader)
+	w.bool(opts.omitModelIdentity)
+	w.bool(opts.omitKnowledgeCutoff)
+	w.bool(opts.omitDefaultKnowledgeCutoff)
+	w.bool(opts.omitReasoning)
+	w.bool(opts.emptyToolsSection)
+	w.str(opts.emptyToolsNote)
+	w.str(opts.toolReturnType)
+	return sha256.Sum256(w.buf), true
+}
@@ -0,0 +1,115 @@
+package harmony
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ToolCalls returns the assistant messages in msgs that address a tool (a
+// recipient other than "all"), in order. Use it to collect every call emitted
+// in a completion that interleaves several tool calls.
+func ToolCalls(msgs []Message) []Message {
+	var out []Message
+	for _, m := range msgs {
+		if m.Author.Role == RoleAssistant && m.Recipient != "" && m.Recipient != "all" {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// UnmarshalToolArgs decodes the JSON arguments of the tool call m (an
+// assistant message with a recipient, as returned by ToolCalls) into a T.
+// The text content items are joined before decoding.
+func UnmarshalToolArgs[T any](m Message) (T, error) {
+	var args T
+	if m.Author.Role != RoleAssistant || m.Recipient == "" || m.Recipient == "all" {
+		return args, errors.New("message is not a tool call")
+	}
+	var sb strings.Builder
+	for _, c := range m.Content {
+		if c.Type == ContentText {
+			sb.WriteString(c.Text)
+		}
+	}
+	if err := json.Unmarshal([]byte(sb.String()), &args); err != nil {
+		return args, fmt.Errorf("arguments for %s: %w", m.Recipient, err)
+	}
+	return args, nil
+}
+
+// AssistantWithToolCall returns the canonical pair for an assistant that
+// says something and then calls a tool in the same turn: text as a
+// commentary-channel message (a preamble), followed by the call to
+// namespaceTool (e.g. "functions.get_weather") with argsJSON as its
+// constrained-JSON body. The text is not on the final channel because a
+// final message ends the turn. Rendered, the text ends with <|end|> and the
+// call with <|call|>.
+func AssistantWithToolCall(text, namespaceTool string, argsJSON json.RawMessage) []Message {
+	return []Message{
+		{
+			Author:  Author{Role: RoleAssistant},
+			Channel: "commentary",
+			Content: []Content{{Type: ContentText, Text: text}},
+		},
+		{
+			Author:      Author{Role: RoleAssistant},
+			Recipient:   namespaceTool,
+			Channel:     "commentary",
+			ContentType: "<|constrain|>json",
+			Content:     []Content{{Type: ContentText, Text: string(argsJSON)}},
+		},
+	}
+}
+
+// ToolErrorContentType is the content type that marks a tool result as a
+// failure. It renders in the header after the channel, e.g.
+// "<|start|>functions.f to=assistant<|channel|>commentary error<|message|>",
+// and is recovered as Message.ContentType when parsing.
+//
+// It is a local convention of this library, not part of the Harmony format:
+// models trained on Harmony have not seen it and will not treat it as an
+// error signal. Use it only with a model fine-tuned on the convention, or to
+// tag results for your own tooling.
+const ToolErrorContentType = "error"
+
+// NewToolResult returns the message carrying the output of tool name (e.g.
+// "functions.get_weather") back to the assistant on the commentary channel.
+// Failures should normally be reported as plain text with isError false,
+// since that is what the model understands. Setting isError also applies
+// the ToolErrorContentType convention.
+func NewToolResult(name, text string, isError bool) Message {
+	m := Message{
+		Author:    Author{Role: RoleTool, Name: name},
+		Recipient: "assistant",
+		Channel:   "commentary",
+		Content:   []Content{{Type: ContentText, Text: text}},
+	}
+	if isError {
+		m.ContentType = ToolErrorContentType
+	}
+	return m
+}
+
+// IsToolError reports whether m is a tool result marked as a failure.
+func IsToolError(m Message) bool {
+	return m.Author.Role == RoleTool && m.ContentType == ToolErrorContentType
+}
+
+// DropAnalysis returns msgs without the analysis-channel messages that
+// RenderConversation drops by default: those before the first final-channel
+// message, and only when the last assistant message is on the final channel.
+// msgs is not modified; the result is a new slice.
+func DropAnalysis(msgs []Message) []Message {
+	end := analysisDropEnd(msgs)
+	out := make([]Message, 0, len(msgs))
+	for i, m := range msgs {
+		if i < end && m.Channel == "analysis" {
+			continue
+		}
+		out = append(out, m)
+	}
+	return out
+}
@@ -0,0 +1,149 @@
+package harmony
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// openAIMessage is one entry of an OpenAI chat-completions messages array.
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    json.RawMessage  `json:"content"`
+	Name       string           `json:"name"`
+	ToolCalls  []openAIToolCall `json:"tool_calls"`
+	ToolCallID string           `json:"tool_call_id"`
+}
+
+type openAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// ConversationFromOpenAI converts a JSON array of OpenAI chat-completions
+// messages into a Conversation. Messages map as follows:
+//
+//   - "system" and "developer": a developer message whose Instructions hold
+//     the content. Harmony keeps model metadata in its own system message,
+//     which is not produced; prepend one with SystemContent as needed.
+//   - "user": a user message; "name" becomes Author.Name.
+//   - "assistant" without tool_calls: a final-channel message.
+//   - "assistant" with tool_calls: any content becomes a commentary-channel
+//     preamble, then each call becomes a commentary-channel message to
+//     "functions.<name>" with content type "<|constrain|>json" and the
+//     arguments string as its text (see AssistantWithToolCall).
+//   - "tool": a tool result from "functions.<name>" to the assistant on the
+//     commentary channel (see NewToolResult). The name is that of the
+//     earlier call with the same tool_call_id, or the message's "name" when
+//     no call matches.
+//
+// Content may be a string, null or an array of parts; the "text" parts of
+// an array are concatenated. Other part types (e.g. images), other roles,
+// non-function tool calls and tool results whose tool cannot be resolved are
+// errors. Assistant messages with neither content nor tool calls are errors.
+func ConversationFromOpenAI(messages json.RawMessage) (Conversation, error) {
+	var in []openAIMessage
+	if err := json.Unmarshal(messages, &in); err != nil {
+		return Conversation{}, fmt.Errorf("decode OpenAI messages: %w", err)
+	}
+	var out []Message
+	callNames := map[string]string{}
+	for i, m := range in {
+		text, err := openAIText(m.Content)
+		if err != nil {
+			return Conversation{}, fmt.Errorf("message %d: %w", i, err)
+		}
+		switch m.Role {
+		case "system", "developer":
+			out = append(out, Message{
+				Author:  Author{Role: RoleDeveloper},
+				Content: []Content{{Type: ContentDeveloper, Developer: &DeveloperContent{Instructions: &text}}},
+			})
+		case "user":
+			out = append(out, Message{
+				Author:  Author{Role: RoleUser, Name: m.Name},
+				Content: []Content{{Type: ContentText, Text: text}},
+			})
+		case "assistant":
+			if len(m.ToolCalls) == 0 {
+				if text == "" {
+					return Conversation{}, fmt.Errorf("message %d: assistant message has no content or tool calls", i)
+				}
+				out = append(out, Message{
+					Author:  Author{Role: RoleAssistant},
+					Channel: "final",
+					Content: []Content{{Type: ContentText, Text: text}},
+				})
+				continue
+			}
+			if text != "" {
+				out = append(out, Message{
+					Author:  Author{Role: RoleAssistant},
+					Channel: "commentary",
+					Content: []Content{{Type: ContentText, Text: text}},
+				})
+			}
+			for j, tc := range m.ToolCalls {
+				if tc.Type != "" && tc.Type != "function" {
+					return Conversation{}, fmt.Errorf("message %d: tool call %d: unsupported type %q", i, j, tc.Type)
+				}
+				if tc.Function.Name == "" {
+					return Conversation{}, fmt.Errorf("message %d: tool call %d has no function name", i, j)
+				}
+				if tc.ID != "" {
+					callNames[tc.ID] = tc.Function.Name
+				}
+				out = append(out, Message{
+					Author:      Author{Role: RoleAssistant},
+					Recipient:   "functions." + tc.Function.Name,
+					Channel:     "commentary",
+					ContentType: "<|constrain|>json",
+					Content:     []Content{{Type: ContentText, Text: tc.Function.Arguments}},
+				})
+			}
+		case "tool":
+			name, ok := callNames[m.ToolCallID]
+			if !ok {
+				name = m.Name
+			}
+			if name == "" {
+				return Conversation{}, fmt.Errorf("message %d: tool result for unknown call %q", i, m.ToolCallID)
+			}
+			out = append(out, NewToolResult("functions."+name, text, false))
+		default:
+			return Conversation{}, fmt.Errorf("message %d: unsupported role %q", i, m.Role)
+		}
+	}
+	return Conversation{Messages: out}, nil
+}
+
+// openAIText returns the text of an OpenAI message content value.
+func openAIText(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", errors.New("content must be a string, null or an array of parts")
+	}
+	var sb strings.Builder
+	for _, p := range parts {
+		if p.Type != "text" {
+			return "", fmt.Errorf("unsupported content part type %q", p.Type)
+		}
+		sb.WriteString(p.Text)
+	}
+	return sb.String(), nil
+}
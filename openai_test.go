@@ -0,0 +1,69 @@
+package harmony
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestConversationFromOpenAI(t *testing.T) {
+	in := json.RawMessage(`[
+		{"role": "system", "content": "Be brief."},
+		{"role": "user", "name": "alice", "content": [{"type": "text", "text": "Weather in "}, {"type": "text", "text": "Oslo?"}]},
+		{"role": "assistant", "content": "Checking.", "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Oslo\"}"}},
+			{"id": "call_2", "type": "function", "function": {"name": "get_time", "arguments": "{}"}}
+		]},
+		{"role": "tool", "tool_call_id": "call_1", "content": "{\"temp\":3}"},
+		{"role": "tool", "tool_call_id": "call_2", "content": "12:00"},
+		{"role": "assistant", "content": "3°C at noon."}
+	]`)
+	conv, err := ConversationFromOpenAI(in)
+	if err != nil {
+		t.Fatalf("ConversationFromOpenAI: %v", err)
+	}
+	want := []Message{
+		{Author: Author{Role: RoleDeveloper}, Content: []Content{{Type: ContentDeveloper, Developer: &DeveloperContent{Instructions: strPtr("Be brief.")}}}},
+		{Author: Author{Role: RoleUser, Name: "alice"}, Content: []Content{{Type: ContentText, Text: "Weather in Oslo?"}}},
+		{Author: Author{Role: RoleAssistant}, Channel: "commentary", Content: []Content{{Type: ContentText, Text: "Checking."}}},
+		{Author: Author{Role: RoleAssistant}, Recipient: "functions.get_weather", Channel: "commentary", ContentType: "<|constrain|>json", Content: []Content{{Type: ContentText, Text: `{"city":"Oslo"}`}}},
+		{Author: Author{Role: RoleAssistant}, Recipient: "functions.get_time", Channel: "commentary", ContentType: "<|constrain|>json", Content: []Content{{Type: ContentText, Text: `{}`}}},
+		NewToolResult("functions.get_weather", `{"temp":3}`, false),
+		NewToolResult("functions.get_time", "12:00", false),
+		{Author: Author{Role: RoleAssistant}, Channel: "final", Content: []Content{{Type: ContentText, Text: "3°C at noon."}}},
+	}
+	if len(conv.Messages) != len(want) {
+		t.Fatalf("got %d messages, want %d: %+v", len(conv.Messages), len(want), conv.Messages)
+	}
+	for i := range want {
+		if !conv.Messages[i].Equal(want[i]) {
+			t.Fatalf("message %d\n got: %+v\nwant: %+v", i, conv.Messages[i], want[i])
+		}
+	}
+	if _, err := mustEncoding(t).RenderConversation(conv, nil); err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+}
+
+func TestConversationFromOpenAIErrors(t *testing.T) {
+	cases := map[string]string{
+		"not an array":      `{"role": "user"}`,
+		"unknown role":      `[{"role": "function", "content": "x"}]`,
+		"image part":        `[{"role": "user", "content": [{"type": "image_url", "image_url": {"url": "x"}}]}]`,
+		"empty assistant":   `[{"role": "assistant", "content": null}]`,
+		"unresolved result": `[{"role": "tool", "tool_call_id": "call_9", "content": "x"}]`,
+		"nameless call":     `[{"role": "assistant", "tool_calls": [{"id": "a", "type": "function", "function": {"arguments": "{}"}}]}]`,
+	}
+	for name, in := range cases {
+		if _, err := ConversationFromOpenAI(json.RawMessage(in)); err == nil {
+			t.Errorf("%s: expected error", name)
+		} else if name != "not an array" && !strings.HasPrefix(err.Error(), "message 0: ") {
+			t.Errorf("%s: error lacks message index: %v", name, err)
+		}
+	}
+
+	conv, err := ConversationFromOpenAI(json.RawMessage(`[{"role": "tool", "name": "lookup", "content": "ok"}]`))
+	if err != nil || len(conv.Messages) != 1 || conv.Messages[0].Author.Name != "functions.lookup" {
+		t.Fatalf("tool result by name: %+v %v", conv.Messages, err)
+	}
+}
@@ -1,10 +1,11 @@
 package harmony
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
-
-	"github.com/euforicio/harmony-go/tokenizer"
+	"slices"
+	"strings"
 )
 
 type streamState int
@@ -20,6 +21,17 @@ type parsedHeader struct {
 	recipient   string
 	channel     string
 	contentType string
+	// raw is the decoded header text before normalization.
+	raw string
+}
+
+// Header is the parsed header of a message, reported by the callback set with
+// StreamParser.OnHeaderComplete before any of the message's content.
+type Header struct {
+	Author      Author
+	Recipient   string
+	Channel     string
+	ContentType string
 }
 
 // StreamParser incrementally parses Harmony tokens into messages. It mirrors
@@ -36,18 +48,206 @@ type StreamParser struct {
 	lastDeltaBytes []byte
 	// scratch buffer reused for per-token decoding to reduce allocations
 	scratch []byte
+	// keepContentToks retains each finalized message's content tokens in
+	// msgContentToks (indexed like messages).
+	keepContentToks bool
+	msgContentToks  [][]uint32
+	// parseJSON attaches a JSONContent to finalized constrained-JSON messages.
+	parseJSON bool
+	// strict turns recoverable malformations into errors.
+	strict bool
+	// keepRawHeader sets Message.RawHeader on each message.
+	keepRawHeader bool
+	// startEndsMessage treats <|start|> in content as the end of the message.
+	startEndsMessage bool
+	// splitLits holds the stop-token literals scanned for in content when
+	// split-special detection is on (nil when off). held is the content tail
+	// that may begin one of them, contentLen counts decoded content bytes and
+	// cutLen, when hasCut, truncates the finalized text before a literal.
+	splitLits  [][]byte
+	held       []byte
+	contentLen int
+	cutLen     int
+	hasCut     bool
+	// onHeader, if set, is called from beginMessage with each parsed header.
+	onHeader func(Header)
+	// onMessage, if set, is called from finalizeMessage with each message.
+	onMessage func(Message)
+}
+
+// StreamParserOptions configures a parser created with
+// NewStreamParserWithOptions. The zero value matches NewStreamParser(enc,
+// nil). Each field corresponds to the setter of the same name.
+type StreamParserOptions struct {
+	// Role hints the role of the first message; the parser then starts in
+	// the header state.
+	Role *Role
+	// ImmediateContent starts the parser in the content of a message with
+	// role Role, channel ChannelHint and content type ContentTypeHint, as
+	// SetImmediateContent does, for streams whose header the backend already
+	// consumed. It requires Role; the hints require ImmediateContent.
+	ImmediateContent    bool
+	ChannelHint         string
+	ContentTypeHint     string
+	Strict              bool
+	KeepContentTokens   bool
+	ParseJSON           bool
+	KeepRawHeader       bool
+	DetectSplitSpecials bool
+	StartEndsMessage    bool
+	OnHeaderComplete    func(Header)
+	OnMessageComplete   func(Message)
 }
 
 // NewStreamParser creates a streaming parser. If role is provided, it is used
 // as a hint for the upcoming header and the parser starts in Header state.
 func NewStreamParser(enc *Encoding, role *Role) (*StreamParser, error) {
+	return NewStreamParserWithOptions(enc, StreamParserOptions{Role: role})
+}
+
+// NewStreamParserWithOptions creates a streaming parser configured by opts.
+func NewStreamParserWithOptions(enc *Encoding, opts StreamParserOptions) (*StreamParser, error) {
 	st := stExpectStart
-	if role != nil {
+	if opts.Role != nil {
 		// Match upstream behaviour: if a next role is hinted, begin collecting header tokens
 		// immediately until we see <|message|>.
 		st = stHeader
 	}
-	return &StreamParser{enc: enc, nextRole: role, state: st}, nil
+	p := &StreamParser{
+		enc:              enc,
+		nextRole:         opts.Role,
+		state:            st,
+		strict:           opts.Strict,
+		keepContentToks:  opts.KeepContentTokens,
+		parseJSON:        opts.ParseJSON,
+		keepRawHeader:    opts.KeepRawHeader,
+		startEndsMessage: opts.StartEndsMessage,
+		onHeader:         opts.OnHeaderComplete,
+		onMessage:        opts.OnMessageComplete,
+	}
+	p.SetDetectSplitSpecials(opts.DetectSplitSpecials)
+	if opts.ImmediateContent {
+		if err := p.SetImmediateContent(opts.ChannelHint, opts.ContentTypeHint); err != nil {
+			return nil, err
+		}
+	} else if opts.ChannelHint != "" || opts.ContentTypeHint != "" {
+		return nil, errors.New("channel and content type hints require ImmediateContent")
+	}
+	return p, nil
+}
+
+// Reset returns the parser to its initial state with a new role hint while
+// keeping internal buffers for reuse. Messages returned before Reset remain
+// valid; the parser does not reuse their storage.
+func (p *StreamParser) Reset(role *Role) {
+	p.nextRole = role
+	p.state = stExpectStart
+	if role != nil {
+		p.state = stHeader
+	}
+	p.tokens = p.tokens[:0]
+	p.messages = nil
+	p.headerToks = p.headerToks[:0]
+	p.contentToks = p.contentToks[:0]
+	p.lastDeltaBytes = p.lastDeltaBytes[:0]
+	p.msgContentToks = nil
+	p.held = p.held[:0]
+	p.contentLen = 0
+	p.hasCut = false
+}
+
+// SetImmediateContent makes a parser created with a role hint skip the
+// header and treat the first tokens as content of a message with the given
+// channel and content type. It is for serving setups that strip the whole
+// header from the stream, and must be called before any token is processed.
+func (p *StreamParser) SetImmediateContent(channel, contentType string) error {
+	if p.nextRole == nil {
+		return errors.New("immediate content requires a role hint")
+	}
+	if p.state != stHeader || len(p.tokens) > 0 {
+		return errors.New("immediate content must be set before processing tokens")
+	}
+	p.messages = append(p.messages, Message{Author: Author{Role: *p.nextRole}, Channel: channel, ContentType: contentType})
+	p.nextRole = nil
+	p.contentToks = p.contentToks[:0]
+	p.state = stContent
+	return nil
+}
+
+// SetKeepContentTokens controls whether the parser retains the content token
+// ids of each finalized message for MessageContentTokens. It is off by default
+// to avoid the extra copy per message.
+func (p *StreamParser) SetKeepContentTokens(keep bool) { p.keepContentToks = keep }
+
+// SetParseJSON controls whether finalized messages with a <|constrain|>json
+// content type get their text parsed into Message.JSON. Invalid JSON does
+// not fail the parse; it is reported through JSONContent.Valid.
+func (p *StreamParser) SetParseJSON(parse bool) { p.parseJSON = parse }
+
+// SetKeepRawHeader controls whether each message gets the header text as
+// decoded, before any normalization, in Message.RawHeader. The structured
+// fields are filled as usual; the raw text recovers anything a nonstandard
+// header carries that they cannot hold. Off by default.
+func (p *StreamParser) SetKeepRawHeader(keep bool) { p.keepRawHeader = keep }
+
+// SetStrict controls whether malformed but recoverable input is an error.
+// By default a stop token that arrives before <|message|> finalizes a message
+// with the parsed header and empty content; in strict mode it fails Process.
+func (p *StreamParser) SetStrict(strict bool) { p.strict = strict }
+
+// SetStartEndsMessage controls how a <|start|> token inside message content
+// is handled. By default it is kept as content. When set, it is taken as an
+// implicit terminator for a stream that lost its stop token: the current
+// message is finalized as if a stop token had arrived and the <|start|>
+// begins the next message's header.
+func (p *StreamParser) SetStartEndsMessage(ends bool) { p.startEndsMessage = ends }
+
+// OnHeaderComplete sets fn to be called with each message header as soon as
+// it is parsed, i.e. when <|message|> arrives and before any content, so a
+// caller can route on the channel or recipient early. It is also called for
+// a header ended by a stop token (see SetStrict). A nil fn removes the
+// callback. Reset keeps it.
+func (p *StreamParser) OnHeaderComplete(fn func(Header)) { p.onHeader = fn }
+
+// OnMessageComplete sets fn to be called with each message once it is
+// finalized by a stop token or ProcessEOS, before Process or ProcessEOS
+// returns. A nil fn removes the callback. Reset keeps it.
+func (p *StreamParser) OnMessageComplete(fn func(Message)) { p.onMessage = fn }
+
+// SetDetectSplitSpecials controls whether content is scanned for stop-token
+// literals ("<|end|>", "<|return|>", "<|call|>") spelled out by ordinary
+// tokens, as malformed or adversarial streams may do. While the content ends
+// with a possible prefix of such a literal (e.g. "<|en"), those bytes are
+// held back from LastContentDelta. If the literal completes, the message is
+// finalized with the text before it, as if the stop token itself had
+// arrived; any bytes after the literal in the same token are dropped. The
+// token that ends a message sets LastContentDelta to the bytes still held,
+// if any. Off by default since it adds a scan per token.
+func (p *StreamParser) SetDetectSplitSpecials(detect bool) {
+	p.splitLits = nil
+	if !detect {
+		return
+	}
+	ids := make([]uint32, 0, len(p.enc.stopAll))
+	for id := range p.enc.stopAll {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		if lit, err := p.enc.bpe.DecodeBytes([]uint32{id}); err == nil {
+			p.splitLits = append(p.splitLits, lit)
+		}
+	}
+}
+
+// MessageContentTokens returns a copy of the content token ids of the i-th
+// parsed message, or nil if tokens were not retained (see
+// SetKeepContentTokens) or the message is not finalized yet.
+func (p *StreamParser) MessageContentTokens(i int) []uint32 {
+	if i < 0 || i >= len(p.msgContentToks) {
+		return nil
+	}
+	return append([]uint32(nil), p.msgContentToks[i]...)
 }
 
 // Process consumes a single token and updates the parser state.
@@ -55,30 +255,33 @@ func (p *StreamParser) Process(token uint32) error {
 	p.tokens = append(p.tokens, token)
 	switch p.state {
 	case stExpectStart:
-		if token == tokenizer.TokStart {
+		if token == p.enc.idStart {
 			p.headerToks = p.headerToks[:0]
 			p.state = stHeader
 			return nil
 		}
 		return errors.New("unexpected token while expecting <|start|>")
 	case stHeader:
-		if token == tokenizer.TokStart {
+		if token == p.enc.idStart {
 			// Ignore stray start tokens when beginning in Header due to role hint
 			return nil
 		}
-		if token == tokenizer.TokMessage {
-			// parse header tokens
-			hdr, err := p.parseHeaderFromTokens(p.headerToks)
-			if err != nil {
+		if token == p.enc.idMessage {
+			return p.beginMessage()
+		}
+		if _, stop := p.enc.stopAll[token]; stop {
+			// A stop token before <|message|> means the turn was truncated
+			// after its header. Keep it as an empty message unless strict.
+			if p.strict {
+				return errors.New("stop token before <|message|> in header")
+			}
+			if err := p.beginMessage(); err != nil {
+				return err
+			}
+			if err := p.finalizeMessage(); err != nil {
 				return err
 			}
-			// set state
-			p.nextRole = nil
-			p.contentToks = p.contentToks[:0]
-			// store header in next message via zero-width marker: we carry as separate field? we'll stash in struct
-			// Encapsulate header in a new message placeholder using content later
-			p.messages = append(p.messages, Message{Author: hdr.author, Recipient: hdr.recipient, Channel: hdr.channel, ContentType: hdr.contentType})
-			p.state = stContent
+			p.state = stExpectStart
 			return nil
 		}
 		p.headerToks = append(p.headerToks, token)
@@ -86,12 +289,21 @@ func (p *StreamParser) Process(token uint32) error {
 	case stContent:
 		// stop tokens finalize message
 		if _, stop := p.enc.stopAll[token]; stop {
+			p.releaseHeld()
 			if err := p.finalizeMessage(); err != nil {
 				return err
 			}
 			p.state = stExpectStart
 			return nil
 		}
+		if token == p.enc.idStart && p.startEndsMessage {
+			p.releaseHeld()
+			if err := p.finalizeMessage(); err != nil {
+				return err
+			}
+			p.state = stHeader
+			return nil
+		}
 		// Append token to logical content
 		p.contentToks = append(p.contentToks, token)
 		// Decode only this token into scratch and set delta to the decoded bytes
@@ -100,6 +312,9 @@ func (p *StreamParser) Process(token uint32) error {
 		if err := p.enc.bpe.DecodeBytesInto(&p.scratch, one[:]); err != nil {
 			return err
 		}
+		if p.splitLits != nil {
+			return p.scanSplitSpecial()
+		}
 		// Save bytes; conversion to string is deferred to LastContentDelta.
 		p.lastDeltaBytes = append(p.lastDeltaBytes[:0], p.scratch...)
 		return nil
@@ -108,25 +323,144 @@ func (p *StreamParser) Process(token uint32) error {
 	}
 }
 
+// beginMessage parses the buffered header tokens and opens a new message for
+// the content that follows.
+func (p *StreamParser) beginMessage() error {
+	hdr, err := p.parseHeaderFromTokens(p.headerToks)
+	if err != nil {
+		return err
+	}
+	p.nextRole = nil
+	p.contentToks = p.contentToks[:0]
+	p.held = p.held[:0]
+	p.contentLen = 0
+	p.hasCut = false
+	// Reuse the Content backing of a recycled slot (ParseMessagesInto).
+	var content []Content
+	if n := len(p.messages); n < cap(p.messages) {
+		content = p.messages[:n+1][n].Content[:0]
+	}
+	p.messages = append(p.messages, Message{Author: hdr.author, Recipient: hdr.recipient, Channel: hdr.channel, ContentType: hdr.contentType, Content: content})
+	if p.keepRawHeader {
+		p.messages[len(p.messages)-1].RawHeader = hdr.raw
+	}
+	p.state = stContent
+	if p.onHeader != nil {
+		p.onHeader(Header{Author: hdr.author, Recipient: hdr.recipient, Channel: hdr.channel, ContentType: hdr.contentType})
+	}
+	return nil
+}
+
 func (p *StreamParser) finalizeMessage() error {
 	if len(p.messages) == 0 {
 		return nil
 	}
 	idx := len(p.messages) - 1
-	text, err := p.enc.bpe.DecodeUTF8(p.contentToks)
-	if err != nil {
+	p.scratch = p.scratch[:0]
+	if err := p.enc.bpe.DecodeBytesInto(&p.scratch, p.contentToks); err != nil {
 		return err
 	}
-	p.messages[idx].Content = []Content{{Type: ContentText, Text: text}}
+	if p.hasCut {
+		p.scratch = p.scratch[:p.cutLen]
+	}
+	p.messages[idx].Content = append(p.messages[idx].Content[:0], Content{Type: ContentText, Text: string(p.scratch)})
+	if p.parseJSON && isConstrainedJSON(p.messages[idx].ContentType) {
+		jc := &JSONContent{}
+		var raw json.RawMessage
+		if json.Unmarshal(p.scratch, &raw) == nil {
+			jc.Raw, jc.Valid = raw, true
+		}
+		p.messages[idx].JSON = jc
+	}
+	if p.keepContentToks {
+		for len(p.msgContentToks) < idx {
+			p.msgContentToks = append(p.msgContentToks, nil)
+		}
+		p.msgContentToks = append(p.msgContentToks[:idx], append([]uint32(nil), p.contentToks...))
+	}
 	// reset buffers
 	p.headerToks = p.headerToks[:0]
 	p.contentToks = p.contentToks[:0]
+	if p.onMessage != nil {
+		p.onMessage(p.messages[idx])
+	}
+	return nil
+}
+
+// scanSplitSpecial handles the decoded bytes of one content token (in
+// p.scratch) when split-special detection is on: it finalizes the message if
+// they complete a stop-token literal and otherwise holds back a trailing
+// partial literal from the delta.
+func (p *StreamParser) scanSplitSpecial() error {
+	p.contentLen += len(p.scratch)
+	start := p.contentLen - len(p.scratch) - len(p.held)
+	buf := append(p.held, p.scratch...)
+	at := -1
+	for _, lit := range p.splitLits {
+		if i := bytes.Index(buf, lit); i >= 0 && (at < 0 || i < at) {
+			at = i
+		}
+	}
+	if at >= 0 {
+		p.lastDeltaBytes = append(p.lastDeltaBytes[:0], buf[:at]...)
+		p.held = buf[:0]
+		p.cutLen, p.hasCut = start+at, true
+		if err := p.finalizeMessage(); err != nil {
+			return err
+		}
+		p.hasCut = false
+		p.state = stExpectStart
+		return nil
+	}
+	keep := 0
+	for n := min(len(buf), maxLen(p.splitLits)-1); n > 0; n-- {
+		if p.isLiteralPrefix(buf[len(buf)-n:]) {
+			keep = n
+			break
+		}
+	}
+	p.lastDeltaBytes = append(p.lastDeltaBytes[:0], buf[:len(buf)-keep]...)
+	p.held = append(buf[:0], buf[len(buf)-keep:]...)
 	return nil
 }
 
+// releaseHeld makes the held-back bytes (possibly none) the last delta once
+// the message ends without completing a literal.
+func (p *StreamParser) releaseHeld() {
+	if p.splitLits == nil {
+		return
+	}
+	p.lastDeltaBytes = append(p.lastDeltaBytes[:0], p.held...)
+	p.held = p.held[:0]
+}
+
+func (p *StreamParser) isLiteralPrefix(b []byte) bool {
+	for _, lit := range p.splitLits {
+		if bytes.HasPrefix(lit, b) {
+			return true
+		}
+	}
+	return false
+}
+
+func maxLen(bs [][]byte) int {
+	n := 0
+	for _, b := range bs {
+		n = max(n, len(b))
+	}
+	return n
+}
+
+// isConstrainedJSON reports whether ct is the <|constrain|>json content type.
+func isConstrainedJSON(ct string) bool {
+	kind, ok := strings.CutPrefix(strings.TrimSpace(ct), "<|constrain|>")
+	return ok && strings.TrimSpace(kind) == "json"
+}
+
 // ProcessEOS flushes any buffered content and finalizes the current message.
 func (p *StreamParser) ProcessEOS() error {
 	if p.state == stContent {
+		p.releaseHeld()
 		return p.finalizeMessage()
 	}
 	return nil
@@ -214,6 +548,7 @@ func (p *StreamParser) parseHeaderFromTokens(header []uint32) (parsedHeader, err
 	if err != nil {
 		return hdr, err
 	}
+	hdr.raw = s
 	s = normalizeHeader(s)
 	roleToken, remainder := splitLeadingToken(s)
 
@@ -222,10 +557,14 @@ func (p *StreamParser) parseHeaderFromTokens(header []uint32) (parsedHeader, err
 	hdr.author.Role = detectedRole
 	hdr.author.Name = nameFromHeader
 	if p.nextRole != nil {
-		hdr.author.Role = *p.nextRole
-		if hdr.author.Role == RoleTool && hdr.author.Name == "" {
-			hdr.author.Name = nameFromHeader
+		// The hint wins over the header. A header that repeats the hinted
+		// role ("assistant<|channel|>...") is consumed as usual; one that
+		// names no role at all must not turn its first word into the name
+		// of a non-tool author.
+		if *p.nextRole != RoleTool && detectedRole == RoleTool {
+			hdr.author.Name = ""
 		}
+		hdr.author.Role = *p.nextRole
 	}
 	// channel
 	hdr.channel = extractChannel(s)
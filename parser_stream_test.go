@@ -1,6 +1,19 @@
 package harmony
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/euforicio/harmony-go/tokenizer"
+)
 
 func TestStreamParserGetters(t *testing.T) {
 	enc, err := LoadEncoding(HarmonyGptOss)
@@ -41,3 +54,919 @@ func TestStreamParserGetters(t *testing.T) {
 		t.Fatalf("expected empty current content after finalization")
 	}
 }
+
+func TestParseMessagesIntoReusesSlice(t *testing.T) {
+	enc := mustEncoding(t)
+	first := enc.bpe.EncodeWithSpecialTokens("<|start|>assistant<|channel|>analysis<|message|>think<|end|><|start|>assistant<|channel|>final<|message|>done<|return|>")
+	second := enc.bpe.EncodeWithSpecialTokens("<|start|>assistant<|channel|>final<|message|>again<|return|>")
+
+	var msgs []Message
+	if err := enc.ParseMessagesInto(&msgs, first, nil); err != nil {
+		t.Fatalf("ParseMessagesInto: %v", err)
+	}
+	if len(msgs) != 2 || msgs[1].Content[0].Text != "done" {
+		t.Fatalf("unexpected first parse: %+v", msgs)
+	}
+	want, err := enc.ParseMessagesFromCompletionTokens(second, nil)
+	if err != nil {
+		t.Fatalf("ParseMessagesFromCompletionTokens: %v", err)
+	}
+	backing := &msgs[0]
+	if err := enc.ParseMessagesInto(&msgs, second, nil); err != nil {
+		t.Fatalf("ParseMessagesInto reuse: %v", err)
+	}
+	if &msgs[0] != backing {
+		t.Fatalf("expected destination capacity to be reused")
+	}
+	if len(msgs) != 1 || msgs[0].Channel != want[0].Channel || msgs[0].Content[0].Text != want[0].Content[0].Text {
+		t.Fatalf("reused parse mismatch\n got: %+v\nwant: %+v", msgs, want)
+	}
+}
+
+func TestStreamParserKeepsContentTokens(t *testing.T) {
+	enc := mustEncoding(t)
+	first := enc.bpe.EncodeOrdinary("thinking")
+	second := enc.bpe.EncodeOrdinary("answer")
+	toks := enc.bpe.EncodeWithSpecialTokens("<|start|>assistant<|channel|>analysis<|message|>")
+	toks = append(toks, first...)
+	toks = append(toks, enc.bpe.EncodeWithSpecialTokens("<|end|><|start|>assistant<|channel|>final<|message|>")...)
+	toks = append(toks, second...)
+	toks = append(toks, enc.idReturn)
+
+	p, err := NewStreamParser(enc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetKeepContentTokens(true)
+	for _, tk := range toks {
+		if err := p.Process(tk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.ProcessEOS(); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.MessageContentTokens(0); !slices.Equal(got, first) {
+		t.Fatalf("message 0 tokens = %v, want %v", got, first)
+	}
+	if got := p.MessageContentTokens(1); !slices.Equal(got, second) {
+		t.Fatalf("message 1 tokens = %v, want %v", got, second)
+	}
+	if p.MessageContentTokens(2) != nil {
+		t.Fatalf("expected nil for out-of-range index")
+	}
+}
+
+func TestParseInterleavedToolCalls(t *testing.T) {
+	enc := mustEncoding(t)
+	// Completion as sampled after a "<|start|>assistant" prompt suffix.
+	completion := "<|channel|>commentary to=functions.get_weather <|constrain|>json<|message|>{\"city\":\"Paris\"}<|call|>" +
+		"<|start|>assistant<|channel|>commentary to=functions.get_time <|constrain|>json<|message|>{\"tz\":\"CET\"}<|call|>" +
+		"<|start|>assistant<|channel|>final<|message|>Checking both.<|return|>"
+	toks := enc.bpe.EncodeWithSpecialTokens(completion)
+	role := RoleAssistant
+
+	msgs, err := enc.ParseMessagesFromCompletionTokens(toks, &role)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d: %+v", len(msgs), msgs)
+	}
+	want := []struct{ channel, recipient, text string }{
+		{"commentary", "functions.get_weather", `{"city":"Paris"}`},
+		{"commentary", "functions.get_time", `{"tz":"CET"}`},
+		{"final", "", "Checking both."},
+	}
+	for i, w := range want {
+		m := msgs[i]
+		if m.Author.Role != RoleAssistant || m.Channel != w.channel || m.Recipient != w.recipient || m.Content[0].Text != w.text {
+			t.Fatalf("message %d mismatch: %+v", i, m)
+		}
+	}
+	if m := msgs[0]; m.ContentType != "<|constrain|>json" {
+		t.Fatalf("content type = %q", m.ContentType)
+	}
+
+	calls := ToolCalls(msgs)
+	if len(calls) != 2 || calls[0].Recipient != "functions.get_weather" || calls[1].Recipient != "functions.get_time" {
+		t.Fatalf("unexpected tool calls: %+v", calls)
+	}
+}
+
+func TestParseToolMessageKeepsRecipient(t *testing.T) {
+	enc := mustEncoding(t)
+	msg := Message{
+		Author:    Author{Role: RoleTool, Name: "functions.lookup_weather"},
+		Recipient: "functions.summarize",
+		Channel:   "commentary",
+		Content:   []Content{{Type: ContentText, Text: `{"temp":20}`}},
+	}
+	toks, err := enc.Render(msg)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	role := RoleTool
+	for _, hint := range []*Role{nil, &role} {
+		msgs, err := enc.ParseMessagesFromCompletionTokens(toks, hint)
+		if err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+		if len(msgs) != 1 {
+			t.Fatalf("expected 1 message, got %+v", msgs)
+		}
+		got := msgs[0]
+		if got.Author != msg.Author || got.Recipient != msg.Recipient || got.Channel != msg.Channel {
+			t.Fatalf("round-trip mismatch (hint=%v): %+v", hint != nil, got)
+		}
+	}
+
+	// With the role supplied out of band the header may lead with to=.
+	toks = enc.bpe.EncodeWithSpecialTokens("to=functions.summarize<|channel|>commentary<|message|>{}<|end|>")
+	msgs, err := enc.ParseMessagesFromCompletionTokens(toks, &role)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(msgs) != 1 || msgs[0].Recipient != "functions.summarize" || msgs[0].Author.Name != "" {
+		t.Fatalf("leading recipient mismatch: %+v", msgs)
+	}
+}
+
+func TestDeltaCollectorGroupsByChannel(t *testing.T) {
+	enc := mustEncoding(t)
+	completion := "<|channel|>analysis<|message|>Think first.<|end|>" +
+		"<|start|>assistant<|channel|>final<|message|>Answer.<|end|>" +
+		"<|start|>assistant<|channel|>analysis<|message|> More.<|end|>"
+	role := RoleAssistant
+	p, err := NewStreamParser(enc, &role)
+	if err != nil {
+		t.Fatalf("NewStreamParser: %v", err)
+	}
+	c := p.NewDeltaCollector()
+	for _, tok := range enc.bpe.EncodeWithSpecialTokens(completion) {
+		if err := c.Process(tok); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+	}
+	want := map[string]string{"analysis": "Think first. More.", "final": "Answer."}
+	got := c.Texts()
+	if len(got) != len(want) || got["analysis"] != want["analysis"] || got["final"] != want["final"] {
+		t.Fatalf("collected %q, want %q", got, want)
+	}
+	if len(p.Messages()) != 3 {
+		t.Fatalf("collector should drive the parser; got %d messages", len(p.Messages()))
+	}
+}
+
+func TestDeltaCollectorSeparatesRolesFromChannels(t *testing.T) {
+	enc := mustEncoding(t)
+	// A channel named like a role must not share text with unchanneled
+	// messages from that role.
+	completion := "<|channel|>assistant<|message|>on channel<|end|>" +
+		"<|start|>assistant<|message|>no channel<|end|>"
+	role := RoleAssistant
+	p, err := NewStreamParser(enc, &role)
+	if err != nil {
+		t.Fatalf("NewStreamParser: %v", err)
+	}
+	c := p.NewDeltaCollector()
+	for _, tok := range enc.bpe.EncodeWithSpecialTokens(completion) {
+		if err := c.Process(tok); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+	}
+	if got := c.Text("assistant"); got != "on channel" {
+		t.Fatalf("channel text = %q", got)
+	}
+	if got := c.RoleText(RoleAssistant); got != "no channel" {
+		t.Fatalf("role text = %q", got)
+	}
+	if len(c.Texts()) != 1 || len(c.RoleTexts()) != 1 {
+		t.Fatalf("collected %q and %q", c.Texts(), c.RoleTexts())
+	}
+}
+
+func TestDeltaCollectorDetectSplitSpecials(t *testing.T) {
+	enc := mustEncoding(t)
+	var toks []uint32
+	toks = append(toks, enc.bpe.EncodeWithSpecialTokens("<|channel|>final<|message|>")...)
+	toks = append(toks, enc.bpe.EncodeOrdinary("hi <|")...)
+	toks = append(toks, enc.bpe.EncodeWithSpecialTokens("<|end|><|start|>assistant<|channel|>analysis<|message|>")...)
+	for _, piece := range []string{"so <", "|en", "d|>"} {
+		toks = append(toks, enc.bpe.EncodeOrdinary(piece)...)
+	}
+	role := RoleAssistant
+	p, err := NewStreamParser(enc, &role)
+	if err != nil {
+		t.Fatalf("NewStreamParser: %v", err)
+	}
+	p.SetDetectSplitSpecials(true)
+	c := p.NewDeltaCollector()
+	for _, tok := range toks {
+		if err := c.Process(tok); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+	}
+	msgs := p.Messages()
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, want 2", len(msgs))
+	}
+	for _, m := range msgs {
+		if got := c.Text(m.Channel); got != m.Content[0].Text {
+			t.Fatalf("collected %s = %q, message text %q", m.Channel, got, m.Content[0].Text)
+		}
+	}
+	if c.Text("final") != "hi <|" || c.Text("analysis") != "so " {
+		t.Fatalf("collected %q", c.Texts())
+	}
+}
+
+func TestStreamParserParseJSON(t *testing.T) {
+	enc := mustEncoding(t)
+	completion := "<|channel|>commentary to=functions.a <|constrain|>json<|message|>{\"x\": [1, 2]}<|call|>" +
+		"<|start|>assistant<|channel|>commentary to=functions.b <|constrain|>json<|message|>{\"x\":<|call|>" +
+		"<|start|>assistant<|channel|>final<|message|>{}<|return|>"
+	role := RoleAssistant
+	p, err := NewStreamParser(enc, &role)
+	if err != nil {
+		t.Fatalf("NewStreamParser: %v", err)
+	}
+	p.SetParseJSON(true)
+	for _, tok := range enc.bpe.EncodeWithSpecialTokens(completion) {
+		if err := p.Process(tok); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+	}
+	msgs := p.Messages()
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(msgs))
+	}
+	if j := msgs[0].JSON; j == nil || !j.Valid || string(j.Raw) != `{"x": [1, 2]}` {
+		t.Fatalf("valid JSON not attached: %+v", j)
+	}
+	if j := msgs[1].JSON; j == nil || j.Valid || j.Raw != nil {
+		t.Fatalf("invalid JSON should be flagged: %+v", j)
+	}
+	if msgs[1].Content[0].Text != `{"x":` {
+		t.Fatalf("text content changed: %q", msgs[1].Content[0].Text)
+	}
+	if msgs[2].JSON != nil {
+		t.Fatalf("unconstrained message should not carry JSON: %+v", msgs[2].JSON)
+	}
+}
+
+func TestStreamParseChannel(t *testing.T) {
+	enc := mustEncoding(t)
+	completion := "<|start|>assistant<|channel|>analysis<|message|>Think.<|end|>" +
+		"<|start|>assistant<|channel|>final<|message|>Done."
+	toks := enc.bpe.EncodeWithSpecialTokens(completion)
+
+	in := make(chan uint32)
+	msgs, errs := enc.StreamParseChannel(context.Background(), in)
+	go func() {
+		for _, tok := range toks {
+			in <- tok
+		}
+		close(in)
+	}()
+	var got []Message
+	for m := range msgs {
+		got = append(got, m)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("stream error: %v", err)
+	}
+	if len(got) != 2 || got[0].Content[0].Text != "Think." || got[1].Channel != "final" || got[1].Content[0].Text != "Done." {
+		t.Fatalf("unexpected messages: %+v", got)
+	}
+
+	// A malformed stream reports an error and still drains the producer.
+	in = make(chan uint32)
+	msgs, errs = enc.StreamParseChannel(context.Background(), in)
+	go func() {
+		for _, tok := range enc.bpe.EncodeOrdinary("no start token") {
+			in <- tok
+		}
+		close(in)
+	}()
+	for range msgs {
+	}
+	if err := <-errs; err == nil {
+		t.Fatalf("expected error for stream without <|start|>")
+	}
+}
+
+func TestStreamParseChannelCancel(t *testing.T) {
+	enc := mustEncoding(t)
+	toks := enc.bpe.EncodeWithSpecialTokens(strings.Repeat("<|start|>user<|message|>hi<|end|>", 10))
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan uint32)
+	producerDone := make(chan struct{})
+	go func() {
+		defer close(producerDone)
+		for _, tok := range toks {
+			select {
+			case in <- tok:
+			case <-ctx.Done():
+				return
+			}
+		}
+		close(in)
+	}()
+	msgs, errs := enc.StreamParseChannel(ctx, in)
+	// Read one message, then abandon the stream.
+	if _, ok := <-msgs; !ok {
+		t.Fatal("expected a message")
+	}
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	// The goroutine has exited once errs is closed; msgs is closed too.
+	if _, ok := <-errs; ok {
+		t.Fatal("errs not closed")
+	}
+	for range msgs {
+	}
+	<-producerDone
+}
+
+func TestStreamParserImmediateContent(t *testing.T) {
+	enc := mustEncoding(t)
+	role := RoleAssistant
+	p, err := NewStreamParser(enc, &role)
+	if err != nil {
+		t.Fatalf("NewStreamParser: %v", err)
+	}
+	if err := p.SetImmediateContent("final", ""); err != nil {
+		t.Fatalf("SetImmediateContent: %v", err)
+	}
+	if p.CurrentChannel() != "final" {
+		t.Fatalf("expected content state on channel final, got %q", p.CurrentChannel())
+	}
+	toks := enc.bpe.EncodeWithSpecialTokens("hello world<|return|><|start|>assistant<|channel|>analysis<|message|>more")
+	for _, tok := range toks {
+		if err := p.Process(tok); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+	}
+	if err := p.ProcessEOS(); err != nil {
+		t.Fatalf("ProcessEOS: %v", err)
+	}
+	msgs := p.Messages()
+	if len(msgs) != 2 || msgs[0].Author.Role != RoleAssistant || msgs[0].Channel != "final" || msgs[0].Content[0].Text != "hello world" {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+	if msgs[1].Channel != "analysis" || msgs[1].Content[0].Text != "more" {
+		t.Fatalf("unexpected second message: %+v", msgs[1])
+	}
+
+	noHint, _ := NewStreamParser(enc, nil)
+	if err := noHint.SetImmediateContent("final", ""); err == nil {
+		t.Fatalf("expected error without role hint")
+	}
+	started, _ := NewStreamParser(enc, &role)
+	_ = started.Process(toks[0])
+	if err := started.SetImmediateContent("final", ""); err == nil {
+		t.Fatalf("expected error after processing tokens")
+	}
+}
+
+func TestStreamParserOptionsContentHints(t *testing.T) {
+	enc := mustEncoding(t)
+	role := RoleAssistant
+	p, err := NewStreamParserWithOptions(enc, StreamParserOptions{
+		Role:             &role,
+		ImmediateContent: true,
+		ChannelHint:      "commentary",
+		ContentTypeHint:  "<|constrain|>json",
+		ParseJSON:        true,
+	})
+	if err != nil {
+		t.Fatalf("NewStreamParserWithOptions: %v", err)
+	}
+	for _, tok := range enc.bpe.EncodeWithSpecialTokens(`{"q":"x"}<|call|>`) {
+		if err := p.Process(tok); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+	}
+	msgs := p.Messages()
+	if len(msgs) != 1 || msgs[0].Author.Role != RoleAssistant || msgs[0].Channel != "commentary" ||
+		msgs[0].ContentType != "<|constrain|>json" || msgs[0].JSON == nil || !msgs[0].JSON.Valid {
+		t.Fatalf("hints not applied: %+v", msgs)
+	}
+
+	if _, err := NewStreamParserWithOptions(enc, StreamParserOptions{ImmediateContent: true}); err == nil {
+		t.Fatal("expected error for immediate content without role")
+	}
+	if _, err := NewStreamParserWithOptions(enc, StreamParserOptions{Role: &role, ChannelHint: "final"}); err == nil {
+		t.Fatal("expected error for hint without immediate content")
+	}
+}
+
+func TestStreamParserStopInHeader(t *testing.T) {
+	enc := mustEncoding(t)
+	toks := enc.bpe.EncodeWithSpecialTokens("<|start|>assistant<|end|><|start|>user<|message|>hi<|end|>")
+	msgs, err := enc.ParseMessagesFromCompletionTokens(toks, nil)
+	if err != nil {
+		t.Fatalf("ParseMessagesFromCompletionTokens: %v", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %+v", msgs)
+	}
+	if msgs[0].Author.Role != RoleAssistant || len(msgs[0].Content) != 1 || msgs[0].Content[0].Text != "" {
+		t.Fatalf("unexpected truncated message: %+v", msgs[0])
+	}
+	if msgs[1].Author.Role != RoleUser || msgs[1].Content[0].Text != "hi" {
+		t.Fatalf("unexpected second message: %+v", msgs[1])
+	}
+
+	strict, _ := NewStreamParser(enc, nil)
+	strict.SetStrict(true)
+	var perr error
+	for _, tok := range toks {
+		if perr = strict.Process(tok); perr != nil {
+			break
+		}
+	}
+	if perr == nil {
+		t.Fatal("expected strict parser to reject stop token in header")
+	}
+}
+
+func TestStreamParserStartEndsMessage(t *testing.T) {
+	enc := mustEncoding(t)
+	toks := enc.bpe.EncodeWithSpecialTokens("<|start|>assistant<|channel|>analysis<|message|>thinking" +
+		"<|start|>assistant<|channel|>final<|message|>done<|return|>")
+
+	p, _ := NewStreamParser(enc, nil)
+	for _, tok := range toks {
+		if err := p.Process(tok); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+	}
+	if msgs := p.Messages(); len(msgs) != 1 || !strings.Contains(msgs[0].Content[0].Text, "<|start|>") {
+		t.Fatalf("default parser should keep <|start|> as content: %+v", msgs)
+	}
+
+	p, _ = NewStreamParserWithOptions(enc, StreamParserOptions{StartEndsMessage: true})
+	for _, tok := range toks {
+		if err := p.Process(tok); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+	}
+	msgs := p.Messages()
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %+v", msgs)
+	}
+	if msgs[0].Channel != "analysis" || msgs[0].Content[0].Text != "thinking" {
+		t.Fatalf("unterminated message: %+v", msgs[0])
+	}
+	if msgs[1].Channel != "final" || msgs[1].Content[0].Text != "done" {
+		t.Fatalf("recovered message: %+v", msgs[1])
+	}
+}
+
+func TestStreamParserDetectSplitSpecials(t *testing.T) {
+	enc := mustEncoding(t)
+	var toks []uint32
+	toks = append(toks, enc.bpe.EncodeWithSpecialTokens("<|start|>assistant<|message|>")...)
+	for _, piece := range []string{"hi <", "|en", "d|>"} {
+		toks = append(toks, enc.bpe.EncodeOrdinary(piece)...)
+	}
+	toks = append(toks, enc.bpe.EncodeWithSpecialTokens("<|start|>user<|message|>a <b<|end|>")...)
+
+	p, _ := NewStreamParser(enc, nil)
+	p.SetDetectSplitSpecials(true)
+	var deltas strings.Builder
+	for _, tok := range toks {
+		inContent := p.state == stContent
+		if err := p.Process(tok); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+		if inContent {
+			deltas.WriteString(p.LastContentDelta())
+		}
+	}
+	msgs := p.Messages()
+	if len(msgs) != 2 || msgs[0].Content[0].Text != "hi " || msgs[1].Content[0].Text != "a <b" {
+		t.Fatalf("unexpected messages: %+v", msgs)
+	}
+	if got := deltas.String(); got != "hi a <b" {
+		t.Fatalf("deltas = %q, want held bytes withheld and released", got)
+	}
+
+	plain, _ := NewStreamParser(enc, nil)
+	for _, tok := range toks[:len(toks)-len(enc.bpe.EncodeWithSpecialTokens("<|start|>user<|message|>a <b<|end|>"))] {
+		if err := plain.Process(tok); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+	}
+	if plain.CurrentContent() != "hi <|end|>" {
+		t.Fatalf("detection should be off by default: %q", plain.CurrentContent())
+	}
+}
+
+func TestParsePartial(t *testing.T) {
+	enc := mustEncoding(t)
+	full := enc.bpe.EncodeWithSpecialTokens("<|start|>user<|message|>hi<|end|><|start|>assistant<|channel|>final<|message|>hello there<|return|>")
+	want, err := enc.ParseMessagesFromCompletionTokens(full, nil)
+	if err != nil {
+		t.Fatalf("ParseMessagesFromCompletionTokens: %v", err)
+	}
+	for cut := 0; cut <= len(full); cut++ {
+		msgs, tail, err := enc.ParsePartial(full[:cut], nil)
+		if err != nil {
+			t.Fatalf("cut %d: ParsePartial: %v", cut, err)
+		}
+		rest, tail2, err := enc.ParsePartial(append(tail, full[cut:]...), nil)
+		if err != nil {
+			t.Fatalf("cut %d: ParsePartial rest: %v", cut, err)
+		}
+		if len(tail2) != 0 {
+			t.Fatalf("cut %d: leftover tail %v", cut, tail2)
+		}
+		got := append(msgs, rest...)
+		if len(got) != len(want) {
+			t.Fatalf("cut %d: got %d messages, want %d", cut, len(got), len(want))
+		}
+		for i := range got {
+			if got[i].Author != want[i].Author || got[i].Channel != want[i].Channel || got[i].Content[0].Text != want[i].Content[0].Text {
+				t.Fatalf("cut %d: message %d = %+v, want %+v", cut, i, got[i], want[i])
+			}
+		}
+	}
+
+	_, tail, _ := enc.ParsePartial(full[:3], nil)
+	tail[0] = 0
+	if full[0] != tokenizer.TokStart {
+		t.Fatal("tail aliases the input")
+	}
+}
+
+func TestParseBareConstrainRoundTrip(t *testing.T) {
+	enc := mustEncoding(t)
+	cases := []Message{
+		{Author: Author{Role: RoleAssistant}, Recipient: "functions.f", Channel: "commentary", ContentType: "<|constrain|>"},
+		{Author: Author{Role: RoleAssistant}, Channel: "final", ContentType: "<|constrain|>"},
+		{Author: Author{Role: RoleAssistant}, ContentType: "<|constrain|>"},
+		{Author: Author{Role: RoleTool, Name: "functions.f"}, Recipient: "assistant", ContentType: "<|constrain|>"},
+	}
+	for _, msg := range cases {
+		msg.Content = []Content{{Type: ContentText, Text: `{"a":1}`}}
+		toks, err := enc.Render(msg)
+		if err != nil {
+			t.Fatalf("Render: %v", err)
+		}
+		got, err := enc.ParseMessagesFromCompletionTokens(toks, nil)
+		if err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+		if len(got) != 1 || got[0].ContentType != "<|constrain|>" || got[0].Channel != msg.Channel ||
+			got[0].Recipient != msg.Recipient || got[0].Author != msg.Author || got[0].Content[0].Text != `{"a":1}` {
+			t.Fatalf("round trip of %+v gave %+v", msg, got)
+		}
+	}
+
+	// Model output may omit the space before the marker.
+	toks := enc.bpe.EncodeWithSpecialTokens("<|start|>assistant<|channel|>final<|constrain|><|message|>x<|end|>")
+	got, err := enc.ParseMessagesFromCompletionTokens(toks, nil)
+	if err != nil || len(got) != 1 || got[0].Channel != "final" || got[0].ContentType != "<|constrain|>" {
+		t.Fatalf("unspaced bare constrain: %+v %v", got, err)
+	}
+}
+
+func TestToolResultErrorRoundTrip(t *testing.T) {
+	enc := mustEncoding(t)
+	for _, isError := range []bool{false, true} {
+		msg := NewToolResult("functions.get_weather", "city not found", isError)
+		text, err := enc.RenderConversationString(Conversation{Messages: []Message{msg}}, nil)
+		if err != nil {
+			t.Fatalf("RenderConversationString: %v", err)
+		}
+		header := "<|start|>functions.get_weather to=assistant<|channel|>commentary<|message|>"
+		if isError {
+			header = "<|start|>functions.get_weather to=assistant<|channel|>commentary error<|message|>"
+		}
+		if !strings.HasPrefix(text, header) {
+			t.Fatalf("isError=%v rendered %q", isError, text)
+		}
+		toks, err := enc.Render(msg)
+		if err != nil {
+			t.Fatalf("Render: %v", err)
+		}
+		got, err := enc.ParseMessagesFromCompletionTokens(toks, nil)
+		if err != nil || len(got) != 1 {
+			t.Fatalf("Parse: %+v %v", got, err)
+		}
+		if IsToolError(got[0]) != isError || got[0].Author != msg.Author || got[0].Recipient != "assistant" {
+			t.Fatalf("isError=%v parsed %+v", isError, got[0])
+		}
+	}
+}
+
+func TestToolResultConstrainedJSONRoundTrip(t *testing.T) {
+	enc := mustEncoding(t)
+	for _, channel := range []string{"", "commentary"} {
+		msg := NewToolResult("functions.get_weather", `{"temp":21}`, false)
+		msg.Channel = channel
+		msg.ContentType = "<|constrain|>json"
+		toks, err := enc.Render(msg)
+		if err != nil {
+			t.Fatalf("channel %q: Render: %v", channel, err)
+		}
+		p, err := NewStreamParser(enc, nil)
+		if err != nil {
+			t.Fatalf("NewStreamParser: %v", err)
+		}
+		p.SetParseJSON(true)
+		for _, tok := range toks {
+			if err := p.Process(tok); err != nil {
+				t.Fatalf("channel %q: Process: %v", channel, err)
+			}
+		}
+		got := p.Messages()
+		if len(got) != 1 {
+			t.Fatalf("channel %q: got %d messages", channel, len(got))
+		}
+		m := got[0]
+		if m.Author != msg.Author || m.Recipient != "assistant" || m.Channel != channel || m.ContentType != "<|constrain|>json" {
+			t.Fatalf("channel %q: header mismatch: %+v", channel, m)
+		}
+		if m.JSON == nil || !m.JSON.Valid || string(m.JSON.Raw) != `{"temp":21}` {
+			t.Fatalf("channel %q: JSON not attached: %+v", channel, m.JSON)
+		}
+	}
+}
+
+func TestParseRoleHintWithRoleInHeader(t *testing.T) {
+	enc := mustEncoding(t)
+	cases := []struct {
+		role   Role
+		stream string
+		want   Message
+	}{
+		{RoleAssistant, "<|start|>assistant<|channel|>final<|message|>hi<|return|>",
+			Message{Author: Author{Role: RoleAssistant}, Channel: "final"}},
+		{RoleAssistant, "assistant<|channel|>analysis<|message|>hi<|end|>",
+			Message{Author: Author{Role: RoleAssistant}, Channel: "analysis"}},
+		{RoleAssistant, "assistant to=functions.f<|channel|>commentary <|constrain|>json<|message|>hi<|call|>",
+			Message{Author: Author{Role: RoleAssistant}, Recipient: "functions.f", Channel: "commentary", ContentType: "<|constrain|>json"}},
+		{RoleAssistant, "assistant:helper<|channel|>final<|message|>hi<|end|>",
+			Message{Author: Author{Role: RoleAssistant, Name: "helper"}, Channel: "final"}},
+		{RoleTool, "tool:functions.f to=assistant<|channel|>commentary<|message|>hi<|end|>",
+			Message{Author: Author{Role: RoleTool, Name: "functions.f"}, Recipient: "assistant", Channel: "commentary"}},
+		{RoleUser, "user<|message|>hi<|end|>",
+			Message{Author: Author{Role: RoleUser}}},
+		// Headers without the role literal.
+		{RoleAssistant, "<|channel|>final<|message|>hi<|end|>",
+			Message{Author: Author{Role: RoleAssistant}, Channel: "final"}},
+		{RoleAssistant, "final<|message|>hi<|end|>",
+			Message{Author: Author{Role: RoleAssistant}}},
+	}
+	for _, tc := range cases {
+		role := tc.role
+		msgs, err := enc.ParseMessagesFromCompletionTokens(enc.bpe.EncodeWithSpecialTokens(tc.stream), &role)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.stream, err)
+		}
+		if len(msgs) != 1 {
+			t.Fatalf("%q: got %d messages", tc.stream, len(msgs))
+		}
+		got := msgs[0]
+		if got.Author != tc.want.Author || got.Recipient != tc.want.Recipient || got.Channel != tc.want.Channel ||
+			got.ContentType != tc.want.ContentType || got.Content[0].Text != "hi" {
+			t.Fatalf("%q: got %+v, want %+v", tc.stream, got, tc.want)
+		}
+	}
+}
+
+func TestRecipientRoundTripsForEveryRole(t *testing.T) {
+	enc := mustEncoding(t)
+	for _, role := range []Role{RoleUser, RoleSystem, RoleDeveloper, RoleAssistant} {
+		for _, name := range []string{"", "alice"} {
+			for _, ch := range []string{"", "commentary"} {
+				want := Message{
+					Author:    Author{Role: role, Name: name},
+					Recipient: "functions.lookup",
+					Channel:   ch,
+					Content:   []Content{{Type: ContentText, Text: "x"}},
+				}
+				toks, err := enc.Render(want)
+				if err != nil {
+					t.Fatalf("%s/%q/%q: render: %v", role, name, ch, err)
+				}
+				got, err := enc.ParseMessagesFromCompletionTokens(toks, nil)
+				if err != nil || len(got) != 1 {
+					t.Fatalf("%s/%q/%q: parse: %v (%d messages)", role, name, ch, err, len(got))
+				}
+				if got[0].Author != want.Author || got[0].Recipient != want.Recipient || got[0].Channel != want.Channel {
+					t.Fatalf("%s/%q/%q: round trip mismatch: %+v", role, name, ch, got[0])
+				}
+			}
+		}
+	}
+}
+
+func TestStreamParserOnHeaderComplete(t *testing.T) {
+	enc := mustEncoding(t)
+	completion := "<|channel|>analysis<|message|>think<|end|>" +
+		"<|start|>assistant to=functions.f<|channel|>commentary <|constrain|>json<|message|>{}<|call|>"
+	role := RoleAssistant
+	p, err := NewStreamParser(enc, &role)
+	if err != nil {
+		t.Fatalf("NewStreamParser: %v", err)
+	}
+	var got []Header
+	var contentSeen []int
+	p.OnHeaderComplete(func(h Header) {
+		got = append(got, h)
+		// The callback runs before any content of the message is parsed.
+		contentSeen = append(contentSeen, len(p.CurrentContent()))
+	})
+	for _, tok := range enc.bpe.EncodeWithSpecialTokens(completion) {
+		if err := p.Process(tok); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+	}
+	want := []Header{
+		{Author: Author{Role: RoleAssistant}, Channel: "analysis"},
+		{Author: Author{Role: RoleAssistant}, Recipient: "functions.f", Channel: "commentary", ContentType: "<|constrain|>json"},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("headers\n got: %+v\nwant: %+v", got, want)
+	}
+	if !slices.Equal(contentSeen, []int{0, 0}) {
+		t.Fatalf("callback ran after content: %v", contentSeen)
+	}
+}
+
+func TestNewStreamParserWithOptions(t *testing.T) {
+	enc := mustEncoding(t)
+	completion := "<|channel|>analysis<|message|>think<|end|>" +
+		"<|start|>assistant to=functions.f<|channel|>commentary <|constrain|>json<|message|>{\"a\":1}<|call|>"
+	role := RoleAssistant
+	var headers []Header
+	var done []Message
+	p, err := NewStreamParserWithOptions(enc, StreamParserOptions{
+		Role:              &role,
+		KeepContentTokens: true,
+		ParseJSON:         true,
+		OnHeaderComplete:  func(h Header) { headers = append(headers, h) },
+		OnMessageComplete: func(m Message) { done = append(done, m) },
+	})
+	if err != nil {
+		t.Fatalf("NewStreamParserWithOptions: %v", err)
+	}
+	for _, tok := range enc.bpe.EncodeWithSpecialTokens(completion) {
+		if err := p.Process(tok); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+	}
+	if len(headers) != 2 || len(done) != 2 {
+		t.Fatalf("callbacks: %d headers, %d messages", len(headers), len(done))
+	}
+	msgs := p.Messages()
+	for i := range msgs {
+		if !msgs[i].Equal(done[i]) {
+			t.Fatalf("message %d: callback got %+v, parser has %+v", i, done[i], msgs[i])
+		}
+	}
+	if done[1].JSON == nil || !done[1].JSON.Valid {
+		t.Fatalf("ParseJSON not applied: %+v", done[1].JSON)
+	}
+	if p.MessageContentTokens(0) == nil {
+		t.Fatal("KeepContentTokens not applied")
+	}
+
+	// Strict mode rejects a header ended by a stop token.
+	p, _ = NewStreamParserWithOptions(enc, StreamParserOptions{Role: &role, Strict: true})
+	var procErr error
+	for _, tok := range enc.bpe.EncodeWithSpecialTokens("<|channel|>final<|end|>") {
+		if procErr = p.Process(tok); procErr != nil {
+			break
+		}
+	}
+	if procErr == nil {
+		t.Fatal("expected strict-mode error")
+	}
+}
+
+func TestAssistantWithToolCallRoundTrip(t *testing.T) {
+	enc := mustEncoding(t)
+	pair := AssistantWithToolCall("Let me check the weather.", "functions.get_weather", json.RawMessage(`{"city":"Oslo"}`))
+	conv := Conversation{Messages: append([]Message{
+		{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "Weather in Oslo?"}}},
+	}, pair...)}
+	cfg := &RenderConversationConfig{AutoDropAnalysis: true, ValidateConstrainedContent: true}
+	text, err := enc.RenderConversationString(conv, cfg)
+	if err != nil {
+		t.Fatalf("RenderConversationString: %v", err)
+	}
+	want := "<|start|>assistant<|channel|>commentary<|message|>Let me check the weather.<|end|>" +
+		"<|start|>assistant to=functions.get_weather<|channel|>commentary <|constrain|>json<|message|>{\"city\":\"Oslo\"}<|call|>"
+	if !strings.HasSuffix(text, want) {
+		t.Fatalf("rendered %q", text)
+	}
+	toks, err := enc.RenderConversation(conv, cfg)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	got, err := enc.ParseMessagesFromCompletionTokens(toks, nil)
+	if err != nil || len(got) != 3 {
+		t.Fatalf("parse: %d messages, %v", len(got), err)
+	}
+	for i, m := range got[1:] {
+		p := pair[i]
+		if m.Author != p.Author || m.Recipient != p.Recipient || m.Channel != p.Channel || m.ContentType != p.ContentType || m.Content[0].Text != p.Content[0].Text {
+			t.Fatalf("message %d: got %+v, want %+v", i, m, p)
+		}
+	}
+}
+
+func TestUnmarshalToolArgs(t *testing.T) {
+	type weatherArgs struct {
+		City string `json:"city"`
+		Days int    `json:"days"`
+	}
+	call := AssistantWithToolCall("", "functions.get_weather", json.RawMessage(`{"city":"Oslo","days":3}`))[1]
+	got, err := UnmarshalToolArgs[weatherArgs](call)
+	if err != nil || got != (weatherArgs{City: "Oslo", Days: 3}) {
+		t.Fatalf("UnmarshalToolArgs = %+v, %v", got, err)
+	}
+
+	bad := call
+	bad.Content = []Content{{Type: ContentText, Text: `{"city":`}}
+	if _, err := UnmarshalToolArgs[weatherArgs](bad); err == nil || !strings.Contains(err.Error(), "functions.get_weather") {
+		t.Fatalf("expected JSON error naming the tool, got %v", err)
+	}
+	notCall := Message{Author: Author{Role: RoleAssistant}, Channel: "final", Content: []Content{{Type: ContentText, Text: "{}"}}}
+	if _, err := UnmarshalToolArgs[weatherArgs](notCall); err == nil {
+		t.Fatal("expected error for a message without a recipient")
+	}
+}
+
+func TestStreamParserKeepRawHeader(t *testing.T) {
+	enc := mustEncoding(t)
+	completion := "<|start|>assistant<|channel|>final lang=de<|message|>hallo<|end|>"
+	toks := enc.bpe.EncodeWithSpecialTokens(completion)
+	for _, keep := range []bool{false, true} {
+		p, err := NewStreamParser(enc, nil)
+		if err != nil {
+			t.Fatalf("NewStreamParser: %v", err)
+		}
+		p.SetKeepRawHeader(keep)
+		for _, tok := range toks {
+			if err := p.Process(tok); err != nil {
+				t.Fatalf("Process: %v", err)
+			}
+		}
+		msgs := p.Messages()
+		if len(msgs) != 1 || msgs[0].Channel != "final" || msgs[0].Content[0].Text != "hallo" {
+			t.Fatalf("keep=%v: structured parse changed: %+v", keep, msgs)
+		}
+		want := ""
+		if keep {
+			want = "assistant<|channel|>final lang=de"
+		}
+		if msgs[0].RawHeader != want {
+			t.Fatalf("keep=%v: RawHeader = %q, want %q", keep, msgs[0].RawHeader, want)
+		}
+	}
+}
+
+func TestParseReader(t *testing.T) {
+	enc := mustEncoding(t)
+	toks := enc.bpe.EncodeWithSpecialTokens("<|start|>assistant<|channel|>analysis<|message|>hmm<|end|>" +
+		"<|start|>assistant<|channel|>final<|message|>done<|return|>")
+	want, err := enc.ParseMessagesFromCompletionTokens(toks, nil)
+	if err != nil {
+		t.Fatalf("ParseMessagesFromCompletionTokens: %v", err)
+	}
+	wire := func(order binary.AppendByteOrder) []byte {
+		var b []byte
+		for _, tok := range toks {
+			b = order.AppendUint32(b, tok)
+		}
+		return b
+	}
+
+	le := wire(binary.LittleEndian)
+	msgs, err := enc.ParseReader(iotest.OneByteReader(bytes.NewReader(le)), nil, nil)
+	if err != nil || len(msgs) != len(want) || !msgs[1].Equal(want[1]) {
+		t.Fatalf("little-endian: %+v %v", msgs, err)
+	}
+	msgs, err = enc.ParseReader(bytes.NewReader(wire(binary.BigEndian)), nil, binary.BigEndian)
+	if err != nil || len(msgs) != len(want) || !msgs[0].Equal(want[0]) {
+		t.Fatalf("big-endian: %+v %v", msgs, err)
+	}
+
+	// A stream cut inside the last token keeps the messages before it.
+	msgs, err = enc.ParseReader(bytes.NewReader(le[:len(le)-2]), nil, nil)
+	if !errors.Is(err, io.ErrUnexpectedEOF) || len(msgs) != 2 || !msgs[0].Equal(want[0]) {
+		t.Fatalf("truncated stream: %+v %v", msgs, err)
+	}
+	if _, err := enc.ParseReader(iotest.ErrReader(errors.New("boom")), nil, nil); err == nil || err.Error() != "boom" {
+		t.Fatalf("read error not returned: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package harmony
+
+import "strings"
+
+// renderSink receives rendered output either as token ids or as text with
+// special-token literals, so token and string renders share one code path.
+type renderSink interface {
+	// writeText emits ordinary text (never interpreted as special tokens).
+	writeText(s string)
+	// writeSpecial emits a formatting/special token by id.
+	writeSpecial(id uint32)
+}
+
+// tokenSink encodes text with the ordinary tokenizer and appends ids to out.
+type tokenSink struct {
+	e   *Encoding
+	out *[]uint32
+}
+
+func (t *tokenSink) writeText(s string)     { t.e.renderText(s, t.out) }
+func (t *tokenSink) writeSpecial(id uint32) { *t.out = append(*t.out, id) }
+
+// stringSink appends text verbatim and specials as their literal spelling
+// (e.g. "<|start|>").
+type stringSink struct {
+	e   *Encoding
+	buf []byte
+}
+
+func (s *stringSink) writeText(text string) { s.buf = append(s.buf, text...) }
+func (s *stringSink) writeSpecial(id uint32) {
+	one := [...]uint32{id}
+	// Formatting ids always decode; an unknown id is a programming error
+	// surfaced by the token path, so the string path stays best-effort.
+	_ = s.e.bpe.DecodeBytesInto(&s.buf, one[:])
+}
+
+// teeSink forwards everything to both a token and a string sink.
+type teeSink struct {
+	toks *tokenSink
+	str  *stringSink
+}
+
+func (t teeSink) writeText(s string)     { t.toks.writeText(s); t.str.writeText(s) }
+func (t teeSink) writeSpecial(id uint32) { t.toks.writeSpecial(id); t.str.writeSpecial(id) }
+
+// newlineSink rewrites "\r\n" and lone "\r" to "\n" in text before
+// forwarding it; specials pass through unchanged.
+type newlineSink struct{ renderSink }
+
+func (n newlineSink) writeText(s string) { n.renderSink.writeText(normalizeNewlines(s)) }
+
+func normalizeNewlines(s string) string {
+	if !strings.Contains(s, "\r") {
+		return s
+	}
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\r", "\n")
+}
+
+// sanitizeContent applies the SanitizeContent and StripZeroWidthSpace
+// options to text content: it drops a leading U+FEFF (byte order mark) and
+// every U+200B (zero width space) respectively.
+func sanitizeContent(s string, opts renderOptions) string {
+	if opts.sanitizeContent {
+		s = strings.TrimPrefix(s, "\ufeff")
+	}
+	if opts.stripZeroWidthSpace && strings.Contains(s, "\u200b") {
+		s = strings.ReplaceAll(s, "\u200b", "")
+	}
+	return s
+}
+
+// RenderConversationString renders the conversation as a prompt string with
+// special-token literals (e.g. "<|start|>user<|message|>...<|end|>") for
+// serving backends that tokenize prompts themselves. It applies the same
+// structure and auto-drop rules as RenderConversation, and inserts
+// cfg.StringMessageSeparator between messages.
+func (e *Encoding) RenderConversationString(conv Conversation, cfg *RenderConversationConfig) (string, error) {
+	renderIdx, opts, err := e.planConversation(conv, cfg)
+	if err != nil {
+		return "", err
+	}
+	sep := ""
+	if cfg != nil {
+		sep = cfg.StringMessageSeparator
+	}
+	sink := &stringSink{e: e}
+	for n, idx := range renderIdx {
+		if n > 0 {
+			sink.writeText(sep)
+		}
+		if err := e.renderMessageTo(conv.Messages[idx], opts, sink); err != nil {
+			return "", err
+		}
+	}
+	return string(sink.buf), nil
+}
+
+// RenderConversationDebug renders the conversation once into both tokens (as
+// RenderConversation) and the prompt text with special-token literals (as
+// RenderConversationString), so the two are always consistent.
+func (e *Encoding) RenderConversationDebug(conv Conversation, cfg *RenderConversationConfig) ([]uint32, string, error) {
+	renderIdx, opts, err := e.planConversation(conv, cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	var out []uint32
+	sink := teeSink{toks: &tokenSink{e: e, out: &out}, str: &stringSink{e: e}}
+	for _, idx := range renderIdx {
+		if err := e.renderMessageTo(conv.Messages[idx], opts, sink); err != nil {
+			return nil, "", err
+		}
+	}
+	return out, string(sink.str.buf), nil
+}
+
+// RenderedSystemText returns the human-readable body text of the leading
+// system and developer messages as they would be rendered, without framing
+// tokens. Bodies are separated by a blank line. It is intended for prompt
+// debugging views.
+func (e *Encoding) RenderedSystemText(conv Conversation, cfg *RenderConversationConfig) (string, error) {
+	renderIdx, opts, err := e.planConversation(conv, cfg)
+	if err != nil {
+		return "", err
+	}
+	sink := &stringSink{e: e}
+	for n, idx := range renderIdx {
+		msg := conv.Messages[idx]
+		if msg.Author.Role != RoleSystem && msg.Author.Role != RoleDeveloper {
+			break
+		}
+		if n > 0 {
+			sink.writeText("\n\n")
+		}
+		if err := e.renderContents(msg.Content, opts, sink); err != nil {
+			return "", err
+		}
+	}
+	return string(sink.buf), nil
+}
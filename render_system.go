@@ -1,10 +1,13 @@
 package harmony
 
-import "strings"
+import (
+	"strconv"
+	"strings"
+)
 
 // renderSystemContent renders the system content block: identity, dates, reasoning,
-// tools section headers and channel metadata directly into the token stream.
-func (e *Encoding) renderSystemContent(sys SystemContent, opts renderOptions, out *[]uint32) {
+// tools section headers and channel metadata into the sink.
+func (e *Encoding) renderSystemContent(sys SystemContent, opts renderOptions, sink renderSink) {
 	body := e.acquireBuilder()
 	// Pre-size to reduce reallocations; heuristic using estimators
 	// The estimators approximate source sizes; double for formatting overhead.
@@ -27,41 +30,77 @@ func (e *Encoding) renderSystemContent(sys SystemContent, opts renderOptions, ou
 		mid = *sys.ModelIdentity
 	}
 	kc := "2024-06"
+	showKC := !opts.omitKnowledgeCutoff
 	if sys.KnowledgeCutoff != nil && *sys.KnowledgeCutoff != "" {
 		kc = *sys.KnowledgeCutoff
+	} else if opts.omitDefaultKnowledgeCutoff {
+		showKC = false
+	}
+	kcLabel := "Knowledge cutoff"
+	if opts.knowledgeCutoffLabel != "" {
+		kcLabel = opts.knowledgeCutoffLabel
+	}
+	dateLabel := "Current date"
+	if opts.currentDateLabel != "" {
+		dateLabel = opts.currentDateLabel
+	}
+	date := opts.autoStartDate
+	if sys.ConversationStartDate != nil {
+		date = *sys.ConversationStartDate
+	}
+	hasDate := date != ""
+	if !opts.omitModelIdentity || showKC || hasDate {
+		addSection(func(sb *strings.Builder) {
+			// Lines of this section are newline-separated; sep stays empty
+			// until the first line is written.
+			sep := ""
+			if !opts.omitModelIdentity {
+				sb.WriteString(mid)
+				sep = "\n"
+			}
+			if showKC {
+				sb.WriteString(sep)
+				sb.WriteString(kcLabel)
+				sb.WriteString(": ")
+				sb.WriteString(kc)
+				sep = "\n"
+			}
+			if hasDate {
+				sb.WriteString(sep)
+				sb.WriteString(dateLabel)
+				sb.WriteString(": ")
+				sb.WriteString(date)
+			}
+		})
 	}
-	addSection(func(sb *strings.Builder) {
-		sb.WriteString(mid)
-		sb.WriteByte('\n')
-		sb.WriteString("Knowledge cutoff: ")
-		sb.WriteString(kc)
-		if sys.ConversationStartDate != nil && *sys.ConversationStartDate != "" {
-			sb.WriteByte('\n')
-			sb.WriteString("Current date: ")
-			sb.WriteString(*sys.ConversationStartDate)
-		}
-	})
 
 	eff := "medium"
 	if sys.ReasoningEffort != nil {
 		eff = strings.ToLower(string(*sys.ReasoningEffort))
 	}
-	addSection(func(sb *strings.Builder) {
-		sb.WriteString("Reasoning: ")
-		sb.WriteString(eff)
-	})
+	if !opts.omitReasoning {
+		addSection(func(sb *strings.Builder) {
+			sb.WriteString("Reasoning: ")
+			sb.WriteString(eff)
+			if sys.ReasoningBudget != nil {
+				sb.WriteString(" (budget: ")
+				sb.WriteString(strconv.Itoa(*sys.ReasoningBudget))
+				sb.WriteByte(')')
+			}
+		})
+	}
 
-	if len(sys.Tools) > 0 {
+	if hasToolsSection(sys.Tools, opts) {
 		addSection(func(sb *strings.Builder) {
-			e.writeToolsSection(sb, sys.Tools)
+			e.writeToolsSection(sb, sys.Tools, opts)
 		})
 	}
 
 	chanCfg := sys.ChannelConfig
-	if chanCfg == nil {
+	if chanCfg == nil && !opts.noDefaultChannels {
 		chanCfg = &ChannelConfig{ValidChannels: []string{"analysis", "commentary", "final"}, ChannelRequired: true}
 	}
-	if len(chanCfg.ValidChannels) > 0 {
+	if chanCfg != nil && len(chanCfg.ValidChannels) > 0 {
 		channels := strings.Join(chanCfg.ValidChannels, ", ")
 		addSection(func(sb *strings.Builder) {
 			sb.WriteString("# Valid channels: ")
@@ -76,6 +115,13 @@ func (e *Encoding) renderSystemContent(sys SystemContent, opts renderOptions, ou
 		})
 	}
 
-	e.renderText(body.String(), out)
+	for _, extra := range sys.ExtraSections {
+		if extra == "" {
+			continue
+		}
+		addSection(func(sb *strings.Builder) { sb.WriteString(extra) })
+	}
+
+	sink.writeText(body.String())
 	e.releaseBuilder(body)
 }
@@ -3,14 +3,17 @@ package harmony
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
 )
 
-// renderDeveloperContent renders developer instructions and the tools section directly into tokens.
-func (e *Encoding) renderDeveloperContent(dev DeveloperContent, out *[]uint32) {
+// renderDeveloperContent renders developer instructions and the tools section into the sink.
+func (e *Encoding) renderDeveloperContent(dev DeveloperContent, opts renderOptions, sink renderSink) {
 	body := e.acquireBuilder()
 	// Pre-size builder to reduce growth churn
 	if sz := estimateDeveloperContentSize(&dev); sz > 0 {
@@ -20,23 +23,74 @@ func (e *Encoding) renderDeveloperContent(dev DeveloperContent, out *[]uint32) {
 		body.Grow(sz*2 + 128)
 	}
 	if dev.Instructions != nil && *dev.Instructions != "" {
-		body.WriteString("# Instructions\n\n")
+		header := "# Instructions"
+		if opts.instructionsHeader != "" {
+			header = opts.instructionsHeader
+		}
+		body.WriteString(header)
+		body.WriteString("\n\n")
 		body.WriteString(*dev.Instructions)
 	}
-	if len(dev.Tools) > 0 {
+	if hasToolsSection(dev.Tools, opts) {
 		if body.Len() > 0 {
 			body.WriteString("\n\n")
 		}
-		e.writeToolsSection(body, dev.Tools)
+		e.writeToolsSection(body, dev.Tools, opts)
 	}
-	e.renderText(body.String(), out)
+	sink.writeText(body.String())
 	e.releaseBuilder(body)
 }
 
+// mergeDeveloperContents combines a run of developer content items into one
+// block: non-empty instructions are joined with a blank line under a single
+// "# Instructions" header and tool namespaces are unioned. A namespace key
+// declared by more than one item is reported as a *DuplicateNameError.
+func mergeDeveloperContents(items []Content) (DeveloperContent, error) {
+	if len(items) == 1 {
+		if items[0].Developer == nil {
+			return DeveloperContent{}, errors.New("nil DeveloperContent")
+		}
+		return *items[0].Developer, nil
+	}
+	var merged DeveloperContent
+	var parts []string
+	seen := map[string]int{}
+	for _, c := range items {
+		if c.Developer == nil {
+			return DeveloperContent{}, errors.New("nil DeveloperContent")
+		}
+		if c.Developer.Instructions != nil && *c.Developer.Instructions != "" {
+			parts = append(parts, *c.Developer.Instructions)
+		}
+		if c.Developer.Tools != nil && merged.Tools == nil {
+			merged.Tools = make(map[string]ToolNamespaceConfig, len(c.Developer.Tools))
+		}
+		for k, ns := range c.Developer.Tools {
+			merged.Tools[k] = ns
+			seen[k]++
+		}
+	}
+	if dups := duplicates(seen); len(dups) > 0 {
+		return DeveloperContent{}, &DuplicateNameError{Kind: "namespace", Names: dups}
+	}
+	if len(parts) > 0 {
+		instr := strings.Join(parts, "\n\n")
+		merged.Instructions = &instr
+	}
+	return merged, nil
+}
+
+// hasToolsSection reports whether tools renders a tools section: when it
+// declares any namespace, or when it is empty but non-nil and the
+// EmptyToolsSection option is set.
+func hasToolsSection(tools map[string]ToolNamespaceConfig, opts renderOptions) bool {
+	return len(tools) > 0 || tools != nil && opts.emptyToolsSection
+}
+
 // writeToolsSection renders tool namespaces and their tools in a TypeScript-like
 // schema description used by Harmony prompts.
-func (e *Encoding) writeToolsSection(body *strings.Builder, tools map[string]ToolNamespaceConfig) {
-	if len(tools) == 0 {
+func (e *Encoding) writeToolsSection(body *strings.Builder, tools map[string]ToolNamespaceConfig, opts renderOptions) {
+	if !hasToolsSection(tools, opts) {
 		return
 	}
 
@@ -45,8 +99,20 @@ func (e *Encoding) writeToolsSection(body *strings.Builder, tools map[string]Too
 		names = append(names, n)
 	}
 	sort.Strings(names)
+	ret := "any"
+	if opts.toolReturnType != "" {
+		ret = opts.toolReturnType
+	}
 
-	body.WriteString("# Tools")
+	if opts.toolsHeader != "" {
+		body.WriteString(opts.toolsHeader)
+	} else {
+		body.WriteString("# Tools")
+	}
+	if len(tools) == 0 && opts.emptyToolsNote != "" {
+		body.WriteString("\n\n")
+		body.WriteString(opts.emptyToolsNote)
+	}
 	for _, nsName := range names {
 		body.WriteString("\n\n")
 		ns := tools[nsName]
@@ -71,13 +137,15 @@ func (e *Encoding) writeToolsSection(body *strings.Builder, tools map[string]Too
 				tool := &ns.Tools[idx]
 				writeCommentLines(buf, tool.Description)
 				if len(tool.Parameters) == 0 {
-					fmt.Fprintf(buf, "type %s = () => any;\n\n", tool.Name)
+					fmt.Fprintf(buf, "type %s = () => %s;\n\n", tool.Name, ret)
 				} else {
-					schema, ordered, err := tool.parsedParameters()
+					schema, orders, err := tool.parsedParameters()
 					if err != nil || schema == nil {
 						buf.WriteString("type ")
 						buf.WriteString(tool.Name)
-						buf.WriteString(" = (_: any) => any;\n\n")
+						buf.WriteString(" = (_: any) => ")
+						buf.WriteString(ret)
+						buf.WriteString(";\n\n")
 					} else {
 						rootDesc := ""
 						if m, ok := schema.(map[string]any); ok {
@@ -93,8 +161,10 @@ func (e *Encoding) writeToolsSection(body *strings.Builder, tools map[string]Too
 						} else {
 							fmt.Fprintf(buf, " {")
 						}
-						e.renderSchemaObjectWithOrder(buf, schema, "\n", ordered)
-						buf.WriteString("\n}) => any;\n\n")
+						e.renderSchemaObjectWithOrder(buf, schema, "\n", tool.PropertyOrder, orders)
+						buf.WriteString("\n}) => ")
+						buf.WriteString(ret)
+						buf.WriteString(";\n\n")
 					}
 				}
 				// spacing handled by previous WriteString; no extra work
@@ -109,7 +179,9 @@ func (e *Encoding) writeToolsSection(body *strings.Builder, tools map[string]Too
 
 // writeToolsSectionStream was removed (unused) to satisfy linters.
 
-func (t *ToolDescription) parsedParameters() (any, []string, error) {
+// parsedParameters returns the decoded Parameters schema and the source key
+// order of its objects, parsing once per ToolDescription.
+func (t *ToolDescription) parsedParameters() (any, propertyOrders, error) {
 	if t == nil || len(t.Parameters) == 0 {
 		return nil, nil, nil
 	}
@@ -117,18 +189,12 @@ func (t *ToolDescription) parsedParameters() (any, []string, error) {
 		t.parsed = &toolParsedCache{}
 	}
 	t.parsed.once.Do(func() {
-		var v any
-		if err := json.Unmarshal(t.Parameters, &v); err != nil {
-			t.parsed.err = err
-			return
-		}
-		t.parsed.value = v
-		t.parsed.orderedKeys = orderedPropertyKeys(t.Parameters)
+		t.parsed.value, t.parsed.orders, t.parsed.err = decodeOrdered(t.Parameters)
 	})
-	return t.parsed.value, t.parsed.orderedKeys, t.parsed.err
+	return t.parsed.value, t.parsed.orders, t.parsed.err
 }
 
-// writeCommentLines writes text as comment lines (prefix "// ") efficiently
+// writeCommentLines writes text as comment lines (see writeCommentLine) efficiently
 // without allocating a slice of lines.
 func writeCommentLines(buf *bytes.Buffer, text string) {
 	start := 0
@@ -136,35 +202,53 @@ func writeCommentLines(buf *bytes.Buffer, text string) {
 		i := strings.IndexByte(text[start:], '\n')
 		if i < 0 {
 			// last line (may be empty)
-			line := text[start:]
-			fmt.Fprintf(buf, "// %s\n", line)
+			writeCommentLine(buf, "", text[start:])
+			buf.WriteByte('\n')
 			break
 		}
-		line := text[start : start+i]
-		fmt.Fprintf(buf, "// %s\n", line)
+		writeCommentLine(buf, "", text[start:start+i])
+		buf.WriteByte('\n')
 		start += i + 1
 	}
 }
 
+// writeCommentLine writes prefix followed by "// line", or just "//" when
+// line is empty so blank lines in multi-paragraph descriptions carry no
+// trailing space.
+func writeCommentLine(buf *bytes.Buffer, prefix, line string) {
+	buf.WriteString(prefix)
+	if line == "" {
+		buf.WriteString("//")
+		return
+	}
+	buf.WriteString("// ")
+	buf.WriteString(line)
+}
+
 // toolParsedCache holds memoized parsing state for ToolDescription.Parameters.
 // It is reachable only through a pointer from ToolDescription so that copying
 // ToolDescription values does not copy synchronization primitives.
 type toolParsedCache struct {
-	once        sync.Once
-	value       any
-	err         error
-	orderedKeys []string
+	once   sync.Once
+	value  any
+	err    error
+	orders propertyOrders
 }
 
 // renderSchemaObject expects a JSON object schema with optional properties/required/oneOf
 // renderSchemaObject wrapper removed (unused) to satisfy linters
 
 // renderSchemaObjectWithOrder renders a JSON Schema object and, when provided,
-// uses the given key order for the immediate properties object.
-func (e *Encoding) renderSchemaObjectWithOrder(buf *bytes.Buffer, schema any, indent string, orderedKeys []string) {
+// uses the given key order for the immediate properties object. Otherwise,
+// as for all nested objects, properties follow their order in the source
+// JSON recorded in orders.
+func (e *Encoding) renderSchemaObjectWithOrder(buf *bytes.Buffer, schema any, indent string, orderedKeys []string, orders propertyOrders) {
 	m, _ := schema.(map[string]any)
 	// Render properties
 	props, _ := m["properties"].(map[string]any)
+	if len(orderedKeys) == 0 {
+		orderedKeys = orders.keys(props)
+	}
 	var requiredSet map[string]struct{}
 	if reqArr, ok := m["required"].([]any); ok {
 		requiredSet = make(map[string]struct{}, len(reqArr))
@@ -179,17 +263,27 @@ func (e *Encoding) renderSchemaObjectWithOrder(buf *bytes.Buffer, schema any, in
 	// property order: respect provided order if present, otherwise sort by name
 	var keys []string
 	if len(orderedKeys) > 0 {
-		keys = append(keys, orderedKeys...)
-		// include any missing keys (defensive)
-		inSet := make(map[string]struct{}, len(keys))
-		for _, k := range keys {
+		// skip keys the schema does not declare (explicit orders may be stale)
+		inSet := make(map[string]struct{}, len(orderedKeys))
+		for _, k := range orderedKeys {
+			if _, ok := props[k]; !ok {
+				continue
+			}
+			if _, dup := inSet[k]; dup {
+				continue
+			}
+			keys = append(keys, k)
 			inSet[k] = struct{}{}
 		}
+		// include any missing keys (defensive), sorted for determinism
+		var missing []string
 		for k := range props {
 			if _, ok := inSet[k]; !ok {
-				keys = append(keys, k)
+				missing = append(missing, k)
 			}
 		}
+		sort.Strings(missing)
+		keys = append(keys, missing...)
 	} else {
 		keys = make([]string, 0, len(props))
 		for k := range props {
@@ -209,7 +303,7 @@ func (e *Encoding) renderSchemaObjectWithOrder(buf *bytes.Buffer, schema any, in
 		// Description and examples
 		if desc, ok := getString(val, "description"); ok && desc != "" {
 			for _, line := range strings.Split(desc, "\n") {
-				fmt.Fprintf(buf, "%s// %s", indent, line)
+				writeCommentLine(buf, indent, line)
 			}
 		}
 		if exsv, ok := mget(val, "examples"); ok {
@@ -237,7 +331,7 @@ func (e *Encoding) renderSchemaObjectWithOrder(buf *bytes.Buffer, schema any, in
 
 				propDesc, _ := getString(val, "description")
 				for i, variant := range oneOf {
-					fmt.Fprintf(buf, "%s | %s", indent, e.schemaToTS(variant, indent+"   "))
+					fmt.Fprintf(buf, "%s | %s", indent, e.schemaToTS(variant, indent+"   ", orders))
 					// inline comments for variant description/default if present
 					var trailing []string
 					if d, ok := getString(variant, "description"); ok && d != "" {
@@ -275,7 +369,7 @@ func (e *Encoding) renderSchemaObjectWithOrder(buf *bytes.Buffer, schema any, in
 		}
 
 		// Normal type
-		ts := e.schemaToTS(val, indent+"    ")
+		ts := e.schemaToTS(val, indent+"    ", orders)
 		if nullable && !strings.Contains(ts, "null") {
 			ts += " | null"
 		}
@@ -289,7 +383,7 @@ func (e *Encoding) renderSchemaObjectWithOrder(buf *bytes.Buffer, schema any, in
 	}
 }
 
-func (e *Encoding) schemaToTS(schema any, indent string) string {
+func (e *Encoding) schemaToTS(schema any, indent string, orders propertyOrders) string {
 	// Handle map schema
 	if m, ok := schema.(map[string]any); ok {
 		// type as string or array
@@ -298,7 +392,7 @@ func (e *Encoding) schemaToTS(schema any, indent string) string {
 			case "object":
 				buf := e.acquireBuffer()
 				buf.WriteString("{")
-				e.renderSchemaObjectWithOrder(buf, m, indent, nil)
+				e.renderSchemaObjectWithOrder(buf, m, indent, nil, orders)
 				buf.WriteString("\n")
 				buf.WriteString(indent[:len(indent)-1]) // approximate outdent for closing brace
 				buf.WriteString("}")
@@ -319,7 +413,7 @@ func (e *Encoding) schemaToTS(schema any, indent string) string {
 				return "boolean"
 			case "array":
 				if items, ok := m["items"]; ok {
-					return e.schemaToTS(items, indent) + "[]"
+					return e.schemaToTS(items, indent, orders) + "[]"
 				}
 				return "Array<any>"
 			}
@@ -339,7 +433,7 @@ func (e *Encoding) schemaToTS(schema any, indent string) string {
 		if oneOf, ok := m["oneOf"].([]any); ok && len(oneOf) > 0 {
 			types := make([]string, 0, len(oneOf))
 			for _, v := range oneOf {
-				types = append(types, e.schemaToTS(v, indent))
+				types = append(types, e.schemaToTS(v, indent, orders))
 			}
 			return strings.Join(types, " | ")
 		}
@@ -405,62 +499,79 @@ func defaultCommentLiteral(schema any, def any) string {
 	}
 }
 
-// orderedPropertyKeys extracts the key order from the "properties" object in a schema JSON blob.
-func orderedPropertyKeys(raw json.RawMessage) []string {
-	if len(raw) == 0 {
+// propertyOrders maps each object decoded by decodeOrdered, by map identity,
+// to its keys in source order, which encoding/json does not keep.
+type propertyOrders map[uintptr][]string
+
+// keys returns the source key order of m, or nil if unknown.
+func (o propertyOrders) keys(m map[string]any) []string {
+	if o == nil || m == nil {
 		return nil
 	}
+	return o[reflect.ValueOf(m).Pointer()]
+}
+
+// decodeOrdered decodes raw into the same tree json.Unmarshal builds for an
+// any and records the key order of every object in it.
+func decodeOrdered(raw json.RawMessage) (any, propertyOrders, error) {
 	dec := json.NewDecoder(bytes.NewReader(raw))
-	// read opening '{'
+	orders := propertyOrders{}
+	v, err := decodeOrderedValue(dec, orders)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, nil, errors.New("invalid character after top-level value")
+	}
+	return v, orders, nil
+}
+
+func decodeOrderedValue(dec *json.Decoder, orders propertyOrders) (any, error) {
 	tok, err := dec.Token()
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	if d, ok := tok.(json.Delim); !ok || d != '{' {
-		return nil
+	d, ok := tok.(json.Delim)
+	if !ok {
+		return tok, nil
 	}
-	for dec.More() {
-		// read key
-		tk, err := dec.Token()
-		if err != nil {
-			return nil
-		}
-		key, _ := tk.(string)
-		if key == "properties" {
-			// next token should be '{'
-			t2, err := dec.Token()
+	switch d {
+	case '{':
+		m := map[string]any{}
+		var keys []string
+		for dec.More() {
+			kt, err := dec.Token()
 			if err != nil {
-				return nil
+				return nil, err
 			}
-			if d2, ok := t2.(json.Delim); !ok || d2 != '{' {
-				return nil
+			k, _ := kt.(string)
+			v, err := decodeOrderedValue(dec, orders)
+			if err != nil {
+				return nil, err
 			}
-			var out []string
-			for dec.More() {
-				tk2, err := dec.Token()
-				if err != nil {
-					return out
-				}
-				k2, _ := tk2.(string)
-				if k2 == "" {
-					return out
-				}
-				out = append(out, k2)
-				// skip value
-				var skip any
-				if err := dec.Decode(&skip); err != nil {
-					return out
-				}
+			if _, dup := m[k]; !dup {
+				keys = append(keys, k)
+			}
+			m[k] = v
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		orders[reflect.ValueOf(m).Pointer()] = keys
+		return m, nil
+	case '[':
+		arr := []any{}
+		for dec.More() {
+			v, err := decodeOrderedValue(dec, orders)
+			if err != nil {
+				return nil, err
 			}
-			// consume closing '}'
-			_, _ = dec.Token()
-			return out
+			arr = append(arr, v)
 		}
-		// skip non-properties value
-		var skip any
-		if err := dec.Decode(&skip); err != nil {
-			return nil
+		if _, err := dec.Token(); err != nil {
+			return nil, err
 		}
+		return arr, nil
 	}
-	return nil
+	return nil, fmt.Errorf("unexpected delimiter %q", d)
 }
@@ -0,0 +1,133 @@
+package harmony
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// StreamParseChannel parses tokens as they arrive on the tokens channel and
+// sends each message on the returned message channel once it is finalized.
+// When tokens is closed, any in-progress message is flushed (as with
+// ProcessEOS) and both returned channels are closed.
+//
+// At most one error is sent. After a parse error no further messages are
+// sent, but the remaining tokens are drained so the producer never blocks.
+//
+// The consumer must drain the message channel until it is closed, or cancel
+// ctx to stop early. Once ctx is done the goroutine sends ctx.Err(), closes
+// both channels and stops reading tokens, so a producer that may outlive the
+// consumer should select on ctx.Done() as well.
+func (e *Encoding) StreamParseChannel(ctx context.Context, tokens <-chan uint32) (<-chan Message, <-chan error) {
+	msgs := make(chan Message)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(msgs)
+		fail := func(err error) {
+			e.emitErr(err, parseErrorEvent)
+			errs <- err
+		}
+		p, err := NewStreamParser(e, nil)
+		if err != nil {
+			fail(err)
+			return
+		}
+		sent := 0
+		flush := func(n int) bool {
+			for ; sent < n; sent++ {
+				select {
+				case msgs <- p.messages[sent]:
+				case <-ctx.Done():
+					errs <- ctx.Err()
+					return false
+				}
+			}
+			return true
+		}
+		for {
+			var tok uint32
+			var ok bool
+			select {
+			case tok, ok = <-tokens:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+			if !ok {
+				break
+			}
+			if err := p.Process(tok); err != nil {
+				fail(err)
+				for {
+					select {
+					case _, ok := <-tokens:
+						if !ok {
+							return
+						}
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			// The last message is still open while its content streams.
+			done := len(p.messages)
+			if p.state == stContent {
+				done--
+			}
+			if !flush(done) {
+				return
+			}
+		}
+		if err := p.ProcessEOS(); err != nil {
+			fail(err)
+			return
+		}
+		flush(len(p.messages))
+	}()
+	return msgs, errs
+}
+
+// ParseReader parses a raw token stream read from r, each token a 4-byte
+// unsigned integer in the given byte order (nil means little-endian, as
+// written by WriteTrainingRecord and RenderConversationAs), until EOF. Short
+// reads are buffered. If the stream ends inside a token, the messages of the
+// complete tokens are still returned, flushed as by ProcessEOS, together
+// with an error wrapping io.ErrUnexpectedEOF. For length-prefixed records
+// from WriteTrainingRecord, read each with ReadTrainingRecord instead.
+func (e *Encoding) ParseReader(r io.Reader, role *Role, order binary.ByteOrder) ([]Message, error) {
+	if order == nil {
+		order = binary.LittleEndian
+	}
+	p, err := NewStreamParser(e, role)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(r)
+	var b [4]byte
+	var tail error
+	for {
+		n, err := io.ReadFull(br, b[:])
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			tail = fmt.Errorf("stream ends %d bytes into a token: %w", n, err)
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := p.Process(order.Uint32(b[:])); err != nil {
+			e.emitErr(err, parseErrorEvent)
+			return nil, err
+		}
+	}
+	if err := p.ProcessEOS(); err != nil {
+		e.emitErr(err, parseErrorEvent)
+		return nil, err
+	}
+	return p.messages, tail
+}
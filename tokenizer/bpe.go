@@ -2,6 +2,9 @@ package tokenizer
 
 import (
 	"errors"
+	"io"
+	"slices"
+	"strings"
 	"sync"
 )
 
@@ -10,12 +13,18 @@ type Rank = uint32
 
 type coreBPE struct {
 	enc        map[string]Rank // key: raw bytes as string
-	dec        tokenStore
+	dec        *storeImpl
 	specialEnc map[string]Rank
 	specialDec map[Rank][]byte
-	seg        Segmenter
-	partsPool  sync.Pool
-	tokenPool  sync.Pool
+	// allSpecials is the allowed set holding every special, built once for
+	// EncodeWithSpecialTokens. It is read-only and never handed to callers.
+	allSpecials map[string]struct{}
+	seg         Segmenter
+	// skipReserved marks a core built without the reserved specials; its
+	// reserved-range ids still decode to their "<|reserved_N|>" literal.
+	skipReserved bool
+	partsPool    sync.Pool
+	tokenPool    sync.Pool
 }
 
 func newCoreBPE(encoderPairs [][2]any, specials map[string]Rank, seg Segmenter) (*coreBPE, error) {
@@ -25,24 +34,33 @@ func newCoreBPE(encoderPairs [][2]any, specials map[string]Rank, seg Segmenter)
 		r, _ := p[1].(Rank)
 		enc[string(b)] = r
 	}
-	dec, err := newTokenStore(encoderPairs)
+	return newCoreBPEFromVocab(enc, tokensByID(encoderPairs), specials, seg)
+}
+
+// newCoreBPEFromVocab builds a core from the encoder map and its inverse,
+// byID[rank] holding the token bytes (nil for unused ranks).
+func newCoreBPEFromVocab(enc map[string]Rank, byID [][]byte, specials map[string]Rank, seg Segmenter) (*coreBPE, error) {
+	dec, err := newTokenStore(byID)
 	if err != nil {
 		return nil, err
 	}
 	specialEnc := make(map[string]Rank, len(specials))
 	specialDec := make(map[Rank][]byte, len(specials))
+	allSpecials := make(map[string]struct{}, len(specials))
 	for k, v := range specials {
 		specialEnc[k] = v
 		specialDec[v] = []byte(k)
+		allSpecials[k] = struct{}{}
 	}
 	return &coreBPE{
-		enc:        enc,
-		dec:        dec,
-		specialEnc: specialEnc,
-		specialDec: specialDec,
-		seg:        seg,
-		partsPool:  sync.Pool{New: func() any { b := make([]part, 0, 64); return &b }},
-		tokenPool:  sync.Pool{New: func() any { b := make([]uint32, 0, 32); return &b }},
+		enc:         enc,
+		dec:         dec,
+		specialEnc:  specialEnc,
+		specialDec:  specialDec,
+		allSpecials: allSpecials,
+		seg:         seg,
+		partsPool:   sync.Pool{New: func() any { b := make([]part, 0, 64); return &b }},
+		tokenPool:   sync.Pool{New: func() any { b := make([]uint32, 0, 32); return &b }},
 	}, nil
 }
 
@@ -54,51 +72,173 @@ func (b *coreBPE) DecodeBytes(tokens []uint32) ([]byte, error) {
 	return out, nil
 }
 
+// decodeBufPool holds scratch buffers for DecodeUTF8 inputs too long for
+// its stack buffer.
+var decodeBufPool = sync.Pool{New: func() any { return new([]byte) }}
+
+// decodeBufMax bounds the capacity of buffers returned to decodeBufPool.
+const decodeBufMax = 64 << 10
+
+// DecodeUTF8 decodes up to decodeStackTokens tokens into a stack buffer of
+// decodeStackBytes first; short message content, as decoded by the stream
+// parser, fits in it.
+const (
+	decodeStackTokens = 64
+	decodeStackBytes  = 256
+)
+
+// DecodeUTF8 decodes tokens into a string, costing a single allocation for
+// the string itself.
 func (b *coreBPE) DecodeUTF8(tokens []uint32) (string, error) {
-	bs, err := b.DecodeBytes(tokens)
-	if err != nil {
-		return "", err
+	if len(tokens) == 0 {
+		return "", nil
+	}
+	if len(tokens) <= decodeStackTokens {
+		// Fast path: short runs of ordinary tokens decode into a stack
+		// buffer, skipping the pool round trip. append moves to the heap
+		// if the bytes outgrow it; specials and unknown ids take the
+		// general path below.
+		var arr [decodeStackBytes]byte
+		if buf, n := b.dec.appendTokens(arr[:0], tokens); n == len(tokens) {
+			return string(buf), nil
+		}
 	}
-	return string(bs), nil
+	buf := decodeBufPool.Get().(*[]byte)
+	*buf = (*buf)[:0]
+	err := b.DecodeBytesInto(buf, tokens)
+	s := ""
+	if err == nil {
+		s = string(*buf)
+	}
+	if cap(*buf) <= decodeBufMax {
+		decodeBufPool.Put(buf)
+	}
+	return s, err
 }
 
+// decodePresizeMin is the token count from which DecodeBytesInto sums token
+// lengths to grow dst once; below it the extra pass costs more than it saves.
+const decodePresizeMin = 64
+
 // DecodeBytesInto appends the decoded bytes for the provided tokens
-// into dst, avoiding intermediate slice allocations.
+// into dst, avoiding intermediate slice allocations. On error, bytes for
+// tokens preceding the invalid one may already have been appended.
 func (b *coreBPE) DecodeBytesInto(dst *[]byte, tokens []uint32) error {
-	buf := *dst
+	if len(tokens) >= decodePresizeMin {
+		// Grow once for long inputs instead of reallocating as dst fills up.
+		*dst = slices.Grow(*dst, b.dec.tokensLen(tokens))
+	}
+	// Copy runs of ordinary tokens in one store call each; specials in
+	// between are looked up separately.
+	for len(tokens) > 0 {
+		var n int
+		*dst, n = b.dec.appendTokens(*dst, tokens)
+		tokens = tokens[n:]
+		if len(tokens) == 0 {
+			break
+		}
+		if !b.appendSpecial(dst, tokens[0]) {
+			return errors.New("invalid token for decoding")
+		}
+		tokens = tokens[1:]
+	}
+	return nil
+}
+
+// DecodeBytesLenient decodes tokens like DecodeBytes, but substitutes
+// placeholder(id) for each unknown token instead of failing, and returns the
+// number of substitutions. A nil placeholder substitutes U+FFFD.
+func (b *coreBPE) DecodeBytesLenient(tokens []uint32, placeholder func(id uint32) string) ([]byte, int) {
+	var out []byte
+	subs := 0
 	for _, t := range tokens {
-		if b.dec.AppendInto(&buf, t) {
+		if b.appendToken(&out, t) {
 			continue
 		}
-		if v, ok := b.specialDec[t]; ok {
-			buf = append(buf, v...)
-			continue
+		if placeholder != nil {
+			out = append(out, placeholder(t)...)
+		} else {
+			out = append(out, "\uFFFD"...)
 		}
-		return errors.New("invalid token for decoding")
+		subs++
 	}
-	*dst = buf
-	return nil
+	return out, subs
 }
 
-func (b *coreBPE) IsSpecialToken(id uint32) bool { _, ok := b.specialDec[id]; return ok }
+// appendToken appends the bytes of token t to dst and reports whether t is
+// known.
+func (b *coreBPE) appendToken(dst *[]byte, t uint32) bool {
+	return b.dec.AppendInto(dst, t) || b.appendSpecial(dst, t)
+}
 
-func (b *coreBPE) EncodeWithSpecialTokens(text string) []uint32 {
-	allowed := make(map[string]struct{}, len(b.specialEnc))
-	for s := range b.specialEnc {
-		allowed[s] = struct{}{}
+// appendSpecial appends the literal of special token t to dst and reports
+// whether t is a special.
+func (b *coreBPE) appendSpecial(dst *[]byte, t uint32) bool {
+	if v, ok := b.specialDec[t]; ok {
+		*dst = append(*dst, v...)
+		return true
+	}
+	if b.reservedFallback(t) {
+		// Reserved specials were left out of specialDec; compute the
+		// literal on demand instead.
+		*dst = append(*dst, reservedLiteral(t)...)
+		return true
+	}
+	return false
+}
+
+// IsOrdinaryToken reports whether id is in the ordinary (BPE) vocabulary.
+func (b *coreBPE) IsOrdinaryToken(id uint32) bool { return b.dec.tokenLen(id) > 0 }
+
+func (b *coreBPE) IsSpecialToken(id uint32) bool {
+	_, ok := b.specialDec[id]
+	return ok || b.reservedFallback(id)
+}
+
+// reservedFallback reports whether id is a reserved id that decodes to its
+// computed literal: only in cores built without the reserved specials, and
+// only when neither the vocabulary nor another special holds the id.
+func (b *coreBPE) reservedFallback(id uint32) bool {
+	if !b.skipReserved || !isReserved(id) || b.dec.tokenLen(id) > 0 {
+		return false
+	}
+	_, taken := b.specialDec[id]
+	return !taken
+}
+
+// SpecialTokenID returns the id of the special token spelled lit. In a core
+// built without the reserved specials, reserved literals still resolve,
+// matching how their ids decode.
+func (b *coreBPE) SpecialTokenID(lit string) (uint32, bool) {
+	if id, ok := b.specialEnc[lit]; ok {
+		return id, true
 	}
-	toks, _ := b.Encode(text, allowed)
+	if id, ok := reservedID(lit); ok && b.reservedFallback(id) {
+		return id, true
+	}
+	return 0, false
+}
+
+// SpecialTokenLiteral returns the literal text of the special token id.
+func (b *coreBPE) SpecialTokenLiteral(id uint32) (string, bool) {
+	if v, ok := b.specialDec[id]; ok {
+		return string(v), true
+	}
+	if b.reservedFallback(id) {
+		return reservedLiteral(id), true
+	}
+	return "", false
+}
+
+func (b *coreBPE) EncodeWithSpecialTokens(text string) []uint32 {
+	toks, _ := b.Encode(text, b.allSpecials)
 	return toks
 }
 
 // EncodeWithSpecialTokensInto appends tokens for text allowing all special
 // tokens directly when present.
 func (b *coreBPE) EncodeWithSpecialTokensInto(text string, out *[]uint32) int {
-	allowed := make(map[string]struct{}, len(b.specialEnc))
-	for s := range b.specialEnc {
-		allowed[s] = struct{}{}
-	}
-	return b.encodeInto(text, allowed, out)
+	return b.encodeInto(text, b.allSpecials, out)
 }
 
 func (b *coreBPE) EncodeOrdinary(text string) []uint32 {
@@ -116,75 +256,90 @@ func (b *coreBPE) EncodeIntoOrdinary(text string, out *[]uint32) int {
 // specials may be emitted directly.
 func (b *coreBPE) Encode(text string, allowedSpecial map[string]struct{}) ([]uint32, int) {
 	var out []uint32
+	lastPieceLen := b.encodeFunc(text, allowedSpecial, func(t uint32) { out = append(out, t) })
+	return out, lastPieceLen
+}
+
+// encodeInto is the in-place variant of Encode.
+func (b *coreBPE) encodeInto(text string, allowedSpecial map[string]struct{}, out *[]uint32) int {
+	return b.encodeFunc(text, allowedSpecial, func(t uint32) { *out = append(*out, t) })
+}
+
+// EncodeFunc encodes text and calls emit for each token as it is produced,
+// without collecting the result. allowedSpecial has the same meaning as in Encode.
+func (b *coreBPE) EncodeFunc(text string, allowedSpecial map[string]struct{}, emit func(uint32)) {
+	b.encodeFunc(text, allowedSpecial, emit)
+}
+
+// encodeFunc drives segmentation and BPE merging for all encode variants and
+// returns the number of tokens emitted for the last piece.
+func (b *coreBPE) encodeFunc(text string, allowedSpecial map[string]struct{}, emit func(uint32)) int {
 	lastPieceLen := 0
 	i := 0
 	hasSpecials := len(allowedSpecial) > 0
+	limit := len(text)
+	if hasSpecials {
+		limit = 0 // computed lazily below
+	}
 	for i < len(text) {
-		// Special token check at position i
+		// Special token check at position i. Ordinary text is segmented only up
+		// to the next special so that a special following punctuation (e.g.
+		// "}<|call|>") is not swallowed by a segment.
 		if hasSpecials {
 			if tok, n := b.matchSpecialAt(text, i, allowedSpecial); n > 0 {
-				out = append(out, tok)
+				emit(tok)
 				i += n
 				lastPieceLen = 0
 				continue
 			}
+			if limit <= i {
+				limit = b.nextSpecialStart(text, i, allowedSpecial)
+			}
 		}
 		// Next segment
 		start := i
-		end := b.seg.Next(text, i)
+		end := b.seg.Next(text[:limit], i)
 		if end <= start { // safety
 			end = start + 1
 		}
 		piece := text[start:end]
 		if id, ok := b.enc[piece]; ok {
-			out = append(out, id)
+			emit(id)
 			lastPieceLen = 1
 		} else {
 			toks, release := b.bytePairEncode(piece)
-			out = append(out, toks...)
+			for _, t := range toks {
+				emit(t)
+			}
 			lastPieceLen = len(toks)
 			release()
 		}
 		i = end
 	}
-	return out, lastPieceLen
+	return lastPieceLen
 }
 
-// encodeInto is the in-place variant of Encode.
-func (b *coreBPE) encodeInto(text string, allowedSpecial map[string]struct{}, out *[]uint32) int {
-	lastPieceLen := 0
-	i := 0
-	hasSpecials := len(allowedSpecial) > 0
-	for i < len(text) {
-		if hasSpecials {
-			if tok, n := b.matchSpecialAt(text, i, allowedSpecial); n > 0 {
-				*out = append(*out, tok)
-				i += n
-				lastPieceLen = 0
-				continue
-			}
+// nextSpecialStart returns the offset of the first allowed special at or after
+// i, or len(s) if there is none. All Harmony specials begin with "<|".
+func (b *coreBPE) nextSpecialStart(s string, i int, allowed map[string]struct{}) int {
+	for i < len(s) {
+		j := strings.Index(s[i:], "<|")
+		if j < 0 {
+			break
 		}
-		start := i
-		end := b.seg.Next(text, i)
-		if end <= start {
-			end = start + 1
-		}
-		piece := text[start:end]
-		if id, ok := b.enc[piece]; ok {
-			*out = append(*out, id)
-			lastPieceLen = 1
-		} else {
-			toks, release := b.bytePairEncode(piece)
-			*out = append(*out, toks...)
-			lastPieceLen = len(toks)
-			release()
+		i += j
+		if _, n := b.matchSpecialAt(s, i, allowed); n > 0 {
+			return i
 		}
-		i = end
+		i++
 	}
-	return lastPieceLen
+	return len(s)
 }
 
 func (b *coreBPE) matchSpecialAt(s string, i int, allowed map[string]struct{}) (uint32, int) {
+	if !strings.HasPrefix(s[i:], "<|") {
+		return 0, 0
+	}
 	// Linear probe: all Harmony specials are distinct and short; optimize later with trie if needed.
 	// Longest first to ensure greedy match.
 	// Note: only emit if present in allowed set.
@@ -242,7 +397,22 @@ func (b *coreBPE) getRank(piece string, parts []part, i int) uint32 {
 	return ^uint32(0)
 }
 
+// largePieceThreshold is the piece length above which bytePairMerge switches
+// from rescanning all parts after each merge (cheap for short pieces) to a
+// heap, which avoids quadratic time on long unsplittable input.
+const largePieceThreshold = 256
+
+// bytePairMerge merges the bytes of piece by ascending rank, leftmost first
+// on ties, and returns the resulting part boundaries followed by a sentinel
+// at len(piece).
 func (b *coreBPE) bytePairMerge(piece string) ([]part, func()) {
+	if len(piece) > largePieceThreshold {
+		return b.bytePairMergeHeap(piece)
+	}
+	return b.bytePairMergeScan(piece)
+}
+
+func (b *coreBPE) bytePairMergeScan(piece string) ([]part, func()) {
 	parts, release := b.acquireParts(len(piece) + 2)
 	parts = parts[:0]
 	minRank := struct {
@@ -288,6 +458,126 @@ func (b *coreBPE) bytePairMerge(piece string) ([]part, func()) {
 	return parts, release
 }
 
+// bytePairMergeHeap is the O(n log n) variant of bytePairMergeScan. Parts are
+// kept in a linked list indexed by their start offset (a part's start never
+// changes: merging removes the right-hand part), and candidate merges sit in
+// a min-heap keyed by rank then start, which gives the same leftmost
+// tie-break as the scan. Entries whose rank no longer matches are skipped.
+func (b *coreBPE) bytePairMergeHeap(piece string) ([]part, func()) {
+	n := len(piece)
+	next := make([]int32, n+1)
+	prev := make([]int32, n+1)
+	rank := make([]uint32, n+1)
+	h := make(mergeHeap, 0, n)
+	for i := 0; i <= n; i++ {
+		next[i] = int32(i + 1)
+		prev[i] = int32(i - 1)
+		rank[i] = ^uint32(0)
+		if i+2 <= n {
+			if r, ok := b.enc[piece[i:i+2]]; ok {
+				rank[i] = r
+				h = append(h, mergeKey(r, i))
+			}
+		}
+	}
+	h.init()
+	// pairRank is the rank of the token formed by part i and its successor.
+	pairRank := func(i int32) uint32 {
+		j := next[i]
+		if int(j) >= n {
+			return ^uint32(0)
+		}
+		if r, ok := b.enc[piece[i:next[j]]]; ok {
+			return r
+		}
+		return ^uint32(0)
+	}
+	update := func(i int32) {
+		rank[i] = pairRank(i)
+		if rank[i] != ^uint32(0) {
+			h.push(mergeKey(rank[i], int(i)))
+		}
+	}
+	for len(h) > 0 {
+		k := h.pop()
+		r, i := uint32(k>>32), int32(uint32(k))
+		if rank[i] != r {
+			continue // stale: i was merged into its left neighbor or re-ranked
+		}
+		// Merge i with its successor j by unlinking j.
+		j := next[i]
+		next[i] = next[j]
+		prev[next[j]] = i
+		rank[j] = ^uint32(0)
+		update(i)
+		if p := prev[i]; p >= 0 {
+			update(p)
+		}
+	}
+
+	parts, release := b.acquireParts(n + 1)
+	parts = parts[:0]
+	for i := int32(0); ; i = next[i] {
+		parts = append(parts, part{start: int(i), rank: rank[i]})
+		if int(i) == n {
+			break
+		}
+	}
+	return parts, release
+}
+
+// mergeHeap is a binary min-heap of mergeKey values.
+type mergeHeap []uint64
+
+func mergeKey(rank uint32, start int) uint64 { return uint64(rank)<<32 | uint64(uint32(start)) }
+
+func (h mergeHeap) init() {
+	for i := len(h)/2 - 1; i >= 0; i-- {
+		h.down(i)
+	}
+}
+
+func (h *mergeHeap) push(k uint64) {
+	*h = append(*h, k)
+	s := *h
+	for i := len(s) - 1; i > 0; {
+		p := (i - 1) / 2
+		if s[p] <= s[i] {
+			break
+		}
+		s[p], s[i] = s[i], s[p]
+		i = p
+	}
+}
+
+func (h *mergeHeap) pop() uint64 {
+	s := *h
+	top := s[0]
+	last := len(s) - 1
+	s[0] = s[last]
+	*h = s[:last]
+	h.down(0)
+	return top
+}
+
+func (h mergeHeap) down(i int) {
+	for {
+		l := 2*i + 1
+		if l >= len(h) {
+			return
+		}
+		m := l
+		if r := l + 1; r < len(h) && h[r] < h[l] {
+			m = r
+		}
+		if h[i] <= h[m] {
+			return
+		}
+		h[i], h[m] = h[m], h[i]
+		i = m
+	}
+}
+
 func (b *coreBPE) acquireParts(capHint int) ([]part, func()) {
 	var p *[]part
 	if v := b.partsPool.Get(); v != nil {
@@ -335,3 +625,67 @@ func (b *coreBPE) acquireTokens(capHint int) ([]uint32, func()) {
 	}
 	return *p, release
 }
+
+// encodeReaderHoldback is the minimum number of trailing bytes kept back
+// when encoding from a reader. Segmentation rules look a few bytes past a
+// segment (contractions, whitespace before a word, a split UTF-8 sequence),
+// so text near the end of what has been read may still change segments.
+const encodeReaderHoldback = 16
+
+// EncodeReader encodes the ordinary text read from r, calling emit for each
+// token. Specials are not recognized. The tokens match EncodeOrdinary of the
+// whole text, but only the unfinished tail is buffered between reads.
+func (b *coreBPE) EncodeReader(r io.Reader, emit func(uint32)) error {
+	// pending holds the text after the last cut; strings.Builder exposes it
+	// as a string without copying.
+	var pending strings.Builder
+	var starts []int
+	chunk := make([]byte, 16<<10)
+	// need is how many bytes to read before segmenting again. After a scan
+	// that finds no cut it is the pending length, so a single long segment
+	// is rescanned only each time it doubles and the total work stays linear.
+	need, read := 0, 0
+	for {
+		n, err := r.Read(chunk)
+		pending.Write(chunk[:n])
+		read += n
+		if errors.Is(err, io.EOF) {
+			b.encodeFunc(pending.String(), nil, emit)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 || read < need {
+			continue
+		}
+		read = 0
+		s := pending.String()
+		// Cut at a segment start with at least two segments and the
+		// holdback after it, so everything before the cut is final.
+		starts = starts[:0]
+		for i := 0; i < len(s); {
+			starts = append(starts, i)
+			next := b.seg.Next(s, i)
+			if next <= i {
+				next = i + 1
+			}
+			i = next
+		}
+		cut := 0
+		for k := len(starts) - 3; k >= 0; k-- {
+			if len(s)-starts[k+1] >= encodeReaderHoldback {
+				cut = starts[k+1]
+				break
+			}
+		}
+		if cut == 0 {
+			need = len(s)
+			continue
+		}
+		need = 0
+		b.encodeFunc(s[:cut], nil, emit)
+		pending = strings.Builder{}
+		pending.WriteString(s[cut:])
+	}
+}
@@ -83,3 +83,47 @@ func BenchmarkBytePairMerge(b *testing.B) {
 		release()
 	}
 }
+
+// BenchmarkEncodePiece_LongNoBreak encodes a 10k-byte piece with no segment
+// breaks, which is quadratic with a rescanning merge.
+func BenchmarkEncodePiece_LongNoBreak(b *testing.B) {
+	core := loadBenchCore(b)
+	piece := strings.Repeat("abcdefghij", 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		toks, release := core.bytePairEncode(piece)
+		if len(toks) == 0 {
+			b.Fatal("expected tokens")
+		}
+		release()
+	}
+}
+
+func BenchmarkDecodeLarge(b *testing.B) {
+	core := loadBenchCore(b)
+	text := strings.Repeat("The assistant reviewed 42 tool results, merged them, and wrote a summary. ", 6000)
+	toks := core.EncodeOrdinary(text)
+	b.SetBytes(int64(len(text)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out []byte
+		if err := core.DecodeBytesInto(&out, toks); err != nil || len(out) != len(text) {
+			b.Fatalf("decode: %v (%d bytes)", err, len(out))
+		}
+	}
+}
+
+func BenchmarkEncodeWithSpecialTokensIntoSmall(b *testing.B) {
+	core := loadBenchCore(b)
+	out := make([]uint32, 0, 16)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		out = out[:0]
+		if core.EncodeWithSpecialTokensInto("assistant<|channel|>final", &out); len(out) == 0 {
+			b.Fatal("expected tokens")
+		}
+	}
+}
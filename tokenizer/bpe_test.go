@@ -0,0 +1,249 @@
+package tokenizer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// newByteCore builds a core over single-byte tokens plus the given merges,
+// which are assigned ranks after the byte range.
+func newByteCore(t *testing.T, merges ...string) *coreBPE {
+	t.Helper()
+	pairs := make([][2]any, 0, 256+len(merges))
+	for i := 0; i < 256; i++ {
+		pairs = append(pairs, [2]any{[]byte{byte(i)}, uint32(i)})
+	}
+	for i, m := range merges {
+		pairs = append(pairs, [2]any{[]byte(m), uint32(256 + i)})
+	}
+	core, err := newCoreBPE(pairs, buildHarmonySpecials(), NewO200kSegmenter())
+	if err != nil {
+		t.Fatalf("newCoreBPE: %v", err)
+	}
+	return core
+}
+
+func TestEncodeFuncMatchesEncode(t *testing.T) {
+	core := newByteCore(t, "he", "ll", "hell", "hello")
+	text := "hello<|start|>world 123"
+	allowed := map[string]struct{}{"<|start|>": {}}
+
+	want, _ := core.Encode(text, allowed)
+	var got []uint32
+	core.EncodeFunc(text, allowed, func(tok uint32) { got = append(got, tok) })
+	if !slices.Equal(got, want) {
+		t.Fatalf("EncodeFunc mismatch\n got: %v\nwant: %v", got, want)
+	}
+	if !slices.Contains(got, TokStart) {
+		t.Fatalf("expected allowed special to be emitted: %v", got)
+	}
+}
+
+func TestDecodeReservedWithoutTable(t *testing.T) {
+	pairs := [][2]any{{[]byte("a"), uint32(0)}}
+	core, err := newCoreBPE(pairs, buildHarmonyBaseSpecials(), NewO200kSegmenter())
+	if err != nil {
+		t.Fatalf("newCoreBPE: %v", err)
+	}
+	// Without the flag the reserved range is not special: custom
+	// vocabularies may use those ids for anything.
+	if core.IsSpecialToken(ReservedStart) {
+		t.Fatal("reserved fallback applied to a core built with NewCoreBPE")
+	}
+	if _, err := core.DecodeBytes([]uint32{ReservedStart}); err == nil {
+		t.Fatal("expected error for an unknown reserved-range id")
+	}
+	core.skipReserved = true
+	got, err := core.DecodeUTF8([]uint32{0, ReservedStart, ReservedEnd})
+	if err != nil || got != "a<|reserved_200014|><|reserved_201088|>" {
+		t.Fatalf("decode: %q %v", got, err)
+	}
+	if !core.IsSpecialToken(ReservedStart) || core.IsSpecialToken(ReservedEnd+1) {
+		t.Fatal("IsSpecialToken disagrees with reserved range")
+	}
+	if _, err := core.DecodeBytes([]uint32{ReservedEnd + 1}); err == nil {
+		t.Fatal("expected error past the reserved range")
+	}
+	vocab, err := core.Vocab()
+	if err != nil {
+		t.Fatalf("Vocab: %v", err)
+	}
+	if len(vocab) != ReservedEnd+1 || string(vocab[ReservedStart]) != "<|reserved_200014|>" || string(vocab[TokStart]) != "<|start|>" {
+		t.Fatalf("Vocab does not report reserved ids as they decode: len %d, %q", len(vocab), vocab[ReservedStart])
+	}
+}
+
+func TestDecodeUTF8Multibyte(t *testing.T) {
+	core := newByteCore(t)
+	text := "ascii, café, 日本語 🎉<|end|>"
+	toks := core.EncodeWithSpecialTokens(text)
+	got, err := core.DecodeUTF8(toks)
+	if err != nil || got != text {
+		t.Fatalf("decode: %q %v", got, err)
+	}
+	// Later decodes reuse the scratch buffer and must not change got.
+	if _, err := core.DecodeUTF8(core.EncodeWithSpecialTokens("overwrite the pooled buffer")); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got != text {
+		t.Fatalf("decoded string changed to %q", got)
+	}
+	// Without specials, short and long content decode on the stack path and
+	// must match the general one.
+	for _, s := range []string{"café 日本語", strings.Repeat("é", 60)} {
+		if got, err := core.DecodeUTF8(core.EncodeOrdinary(s)); err != nil || got != s {
+			t.Fatalf("decode %q: %q %v", s, got, err)
+		}
+	}
+	if _, err := core.DecodeUTF8([]uint32{'a', ReservedEnd + 1}); err == nil {
+		t.Fatal("expected error for unknown token")
+	}
+}
+
+func TestDecodeBytesLenient(t *testing.T) {
+	core := newByteCore(t)
+	toks := []uint32{'h', 'i', ReservedEnd + 1, TokEnd, ReservedEnd + 7}
+
+	got, subs := core.DecodeBytesLenient(toks, nil)
+	if string(got) != "hi\uFFFD<|end|>\uFFFD" || subs != 2 {
+		t.Fatalf("nil placeholder: %q, %d", got, subs)
+	}
+	unk := func(id uint32) string { return fmt.Sprintf("<unk:%d>", id) }
+	got, subs = core.DecodeBytesLenient(toks, unk)
+	if want := fmt.Sprintf("hi<unk:%d><|end|><unk:%d>", ReservedEnd+1, ReservedEnd+7); string(got) != want || subs != 2 {
+		t.Fatalf("custom placeholder: %q, %d", got, subs)
+	}
+	got, subs = core.DecodeBytesLenient(toks[:2], unk)
+	if string(got) != "hi" || subs != 0 {
+		t.Fatalf("valid stream: %q, %d", got, subs)
+	}
+}
+
+func TestEncodeSpecialAfterPunctuation(t *testing.T) {
+	core := newByteCore(t)
+	allowed := map[string]struct{}{"<|call|>": {}, "<|start|>": {}}
+	for _, text := range []string{"{}<|call|>", "a <|start|>b", "x<|notspecial|><|call|>"} {
+		toks, _ := core.Encode(text, allowed)
+		decoded, err := core.DecodeUTF8(toks)
+		if err != nil {
+			t.Fatalf("DecodeUTF8: %v", err)
+		}
+		if decoded != text {
+			t.Fatalf("round-trip mismatch: %q -> %q", text, decoded)
+		}
+		if !slices.Contains(toks, TokCall) && !slices.Contains(toks, TokStart) {
+			t.Fatalf("special not recognized in %q: %v", text, toks)
+		}
+	}
+}
+
+func TestExplainMatchesEncodeOrdinary(t *testing.T) {
+	core := newByteCore(t, "he", "ll", "hell", "lo", "wo")
+	text := "hello world"
+	got := core.Explain(text)
+	want := core.EncodeOrdinary(text)
+	if len(got) != len(want) {
+		t.Fatalf("Explain returned %d tokens, EncodeOrdinary %d", len(got), len(want))
+	}
+	var joined []byte
+	for i, ex := range got {
+		if ex.Token != want[i] {
+			t.Fatalf("token %d = %d, want %d", i, ex.Token, want[i])
+		}
+		joined = append(joined, ex.Bytes...)
+	}
+	if string(joined) != text {
+		t.Fatalf("bytes do not cover text: %q", joined)
+	}
+	if got[0].Segment != "hello" || string(got[0].Bytes) != "hell" || got[len(got)-1].Segment != "world" {
+		t.Fatalf("unexpected explanation: %+v", got)
+	}
+}
+
+func TestBytePairMergeHeapMatchesScan(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	randText := func(n int) string {
+		buf := make([]byte, n)
+		for i := range buf {
+			buf[i] = "abcd"[rng.IntN(4)]
+		}
+		return string(buf)
+	}
+	seen := map[string]bool{}
+	var merges []string
+	for len(merges) < 200 {
+		m := randText(2 + rng.IntN(5))
+		if !seen[m] {
+			seen[m] = true
+			merges = append(merges, m)
+		}
+	}
+	core := newByteCore(t, merges...)
+
+	for iter := 0; iter < 300; iter++ {
+		piece := randText(2 + rng.IntN(700))
+		want, releaseWant := core.bytePairMergeScan(piece)
+		got, releaseGot := core.bytePairMergeHeap(piece)
+		if len(got) != len(want) {
+			t.Fatalf("piece %q: heap produced %d parts, scan %d", piece, len(got), len(want))
+		}
+		for i := range want {
+			if got[i].start != want[i].start {
+				t.Fatalf("piece %q: part %d starts at %d, scan %d", piece, i, got[i].start, want[i].start)
+			}
+		}
+		releaseWant()
+		releaseGot()
+	}
+}
+
+func TestEncodeReaderMatchesEncodeOrdinary(t *testing.T) {
+	words := []string{"don't", "we'll", "hello", " world", "123", "4567", "  ", "\n\n", " \n", "héllo", "日本", "!!", "/", "\t", " "}
+	core := newByteCore(t, append(words, "do", "on", "n'", "'t", "'ll", "ll", "12", "45", "67")...)
+	rng := rand.New(rand.NewPCG(3, 4))
+	for iter := 0; iter < 200; iter++ {
+		var sb strings.Builder
+		for n := rng.IntN(200); n > 0; n-- {
+			sb.WriteString(words[rng.IntN(len(words))])
+		}
+		text := sb.String()
+		want := core.EncodeOrdinary(text)
+		readers := map[string]io.Reader{
+			"one-byte": iotest.OneByteReader(strings.NewReader(text)),
+			"half":     iotest.HalfReader(strings.NewReader(text)),
+			"whole":    strings.NewReader(text),
+		}
+		for name, r := range readers {
+			var got []uint32
+			if err := core.EncodeReader(r, func(tok uint32) { got = append(got, tok) }); err != nil {
+				t.Fatalf("%s: EncodeReader: %v", name, err)
+			}
+			if !slices.Equal(got, want) {
+				t.Fatalf("%s: EncodeReader differs for %q\n got: %v\nwant: %v", name, text, got, want)
+			}
+		}
+	}
+
+	// One long segment never yields a cut; with small reads it must not be
+	// rescanned from the start on every read.
+	long := strings.Repeat("hello", 1<<16)
+	want := core.EncodeOrdinary(long)
+	var got []uint32
+	if err := core.EncodeReader(iotest.OneByteReader(strings.NewReader(long)), func(tok uint32) { got = append(got, tok) }); err != nil {
+		t.Fatalf("long segment: EncodeReader: %v", err)
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("long segment: EncodeReader differs (%d vs %d tokens)", len(got), len(want))
+	}
+
+	errBoom := errors.New("boom")
+	if err := core.EncodeReader(iotest.ErrReader(errBoom), func(uint32) {}); !errors.Is(err, errBoom) {
+		t.Fatalf("expected read error, got %v", err)
+	}
+}
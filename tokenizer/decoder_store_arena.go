@@ -2,74 +2,124 @@
 
 package tokenizer
 
-import "arena"
+import (
+	"arena"
+	"sync"
+)
 
 // Arena-backed token store. All storage lives in a dedicated arena.
 // AppendInto copies from the arena blob into the destination to avoid
 // leaking arena-backed slices to the heap.
+//
+// Lifecycle: the arena is freed exactly once by Close. Readers hold mu for
+// reading while copying out of the blob, so Close waits for in-flight
+// decodes and any AppendInto after Close reports the id as missing instead
+// of touching freed memory.
 type arenaStore struct {
-	a    *arena.Arena
-	blob []byte
-	off  []uint32
+	mu     sync.RWMutex
+	closed bool
+	a      *arena.Arena
+	blob   []byte
+	off    []uint32
 }
 
-func newTokenStore(pairs [][2]any) (tokenStore, error) {
+// storeImpl is the tokenStore selected by build tags; see the heap store.
+type storeImpl = arenaStore
+
+var _ tokenStore = (*arenaStore)(nil)
+
+// newTokenStore copies byID into a new arena.
+func newTokenStore(byID [][]byte) (*storeImpl, error) {
 	a := arena.NewArena()
-	// Determine max id and collect per-id lengths
-	maxID := uint32(0)
-	for _, p := range pairs {
-		id, _ := p[1].(uint32)
-		if id > maxID {
-			maxID = id
-		}
-	}
-	size := int(maxID) + 1
-	lens := arena.MakeSlice[uint32](a, size, size)
+	size := len(byID)
 	total := 0
-	for _, p := range pairs {
-		b, _ := p[0].([]byte)
-		id, _ := p[1].(uint32)
-		if lens[int(id)] == 0 {
-			lens[int(id)] = uint32(len(b))
-			total += len(b)
-		}
+	for _, b := range byID {
+		total += len(b)
 	}
 	blob := arena.MakeSlice[byte](a, total, total)
 	off := arena.MakeSlice[uint32](a, size+1, size+1)
 	pos := 0
-	for i := 0; i < size; i++ {
+	for i, b := range byID {
 		off[i] = uint32(pos)
-		n := int(lens[i])
-		if n > 0 {
-			// find the bytes for id i (second pass)
-			// Note: this is O(nIds + nPairs); still fine for one-time init.
-			for _, p := range pairs {
-				id, _ := p[1].(uint32)
-				if int(id) != i {
-					continue
-				}
-				b, _ := p[0].([]byte)
-				copy(blob[pos:pos+n], b)
-				break
-			}
-			pos += n
-		}
+		pos += copy(blob[pos:], b)
 	}
 	off[size] = uint32(pos)
 	return &arenaStore{a: a, blob: blob, off: off}, nil
 }
 
 func (s *arenaStore) AppendInto(dst *[]byte, id uint32) bool {
-	if int(id) >= len(s.off)-1 {
-		return false
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ok bool
+	*dst, ok = s.appendLocked(*dst, id)
+	return ok
+}
+
+func (s *arenaStore) appendTokens(dst []byte, ids []uint32) ([]byte, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i, id := range ids {
+		var ok bool
+		if dst, ok = s.appendLocked(dst, id); !ok {
+			return dst, i
+		}
+	}
+	return dst, len(ids)
+}
+
+// appendLocked is AppendInto for callers holding mu.
+func (s *arenaStore) appendLocked(dst []byte, id uint32) ([]byte, bool) {
+	if s.closed || int(id) >= len(s.off)-1 {
+		return dst, false
 	}
 	a := s.off[id]
 	b := s.off[id+1]
 	if a == b {
-		return false
+		return dst, false
 	}
-	*dst = append(*dst, s.blob[a:b]...)
-	return true
+	return append(dst, s.blob[a:b]...), true
 }
 
-func (s *arenaStore) Close() { s.a.Free() }
+func (s *arenaStore) tokenLen(id uint32) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lenLocked(id)
+}
+
+func (s *arenaStore) tokensLen(ids []uint32) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, id := range ids {
+		n += s.lenLocked(id)
+	}
+	return n
+}
+
+// lenLocked is tokenLen for callers holding mu.
+func (s *arenaStore) lenLocked(id uint32) int {
+	if s.closed || int(id) >= len(s.off)-1 {
+		return 0
+	}
+	return int(s.off[id+1] - s.off[id])
+}
+
+func (s *arenaStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0
+	}
+	return len(s.off) - 1
+}
+
+func (s *arenaStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.blob, s.off = nil, nil
+	s.a.Free()
+}
@@ -10,25 +10,16 @@ type heapStore struct {
 	arr [][]byte // direct references to token byte slices
 }
 
-func newTokenStore(pairs [][2]any) (tokenStore, error) {
-	// Determine max id and collect per-id bytes
-	maxID := uint32(0)
-	for _, p := range pairs {
-		id, _ := p[1].(uint32)
-		if id > maxID {
-			maxID = id
-		}
-	}
-	size := int(maxID) + 1
-	tmp := make([][]byte, size)
-	for _, p := range pairs {
-		b, _ := p[0].([]byte)
-		id, _ := p[1].(uint32)
-		if tmp[int(id)] == nil {
-			tmp[int(id)] = b
-		}
-	}
-	return &heapStore{arr: tmp}, nil
+// storeImpl is the tokenStore selected by build tags. Cores hold it by
+// concrete type so token slices passed to it do not escape to the heap, as
+// they would through an interface call.
+type storeImpl = heapStore
+
+var _ tokenStore = (*heapStore)(nil)
+
+// newTokenStore keeps byID as is; it must not be modified afterwards.
+func newTokenStore(byID [][]byte) (*storeImpl, error) {
+	return &heapStore{arr: byID}, nil
 }
 
 func (s *heapStore) AppendInto(dst *[]byte, id uint32) bool {
@@ -43,4 +34,31 @@ func (s *heapStore) AppendInto(dst *[]byte, id uint32) bool {
 	return true
 }
 
+func (s *heapStore) appendTokens(dst []byte, ids []uint32) ([]byte, int) {
+	for i, id := range ids {
+		if int(id) >= len(s.arr) || s.arr[id] == nil {
+			return dst, i
+		}
+		dst = append(dst, s.arr[id]...)
+	}
+	return dst, len(ids)
+}
+
+func (s *heapStore) tokensLen(ids []uint32) int {
+	n := 0
+	for _, id := range ids {
+		n += s.tokenLen(id)
+	}
+	return n
+}
+
+func (s *heapStore) tokenLen(id uint32) int {
+	if int(id) >= len(s.arr) {
+		return 0
+	}
+	return len(s.arr[id])
+}
+
+func (s *heapStore) Len() int { return len(s.arr) }
+
 func (s *heapStore) Close() {}
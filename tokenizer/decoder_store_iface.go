@@ -2,10 +2,50 @@ package tokenizer
 
 // tokenStore abstracts storage of base token byte sequences.
 // Implementations must not let references to internal storage escape.
+//
+// A store is owned by the coreBPE that created it and lives as long as that
+// core; shared encodings never close it. Close is only for callers that own a
+// store outright. Implementations must be safe for concurrent AppendInto calls
+// and repeated Close; stores that release memory in Close must return false
+// from AppendInto afterwards rather than reading released storage.
 type tokenStore interface {
 	// AppendInto appends the bytes for token id into dst and returns true
 	// if the id existed. Returns false when id is unknown.
 	AppendInto(dst *[]byte, id uint32) bool
-	// Close releases any resources held by the store.
+	// appendTokens appends the bytes of the leading tokens of ids up to the
+	// first unknown one to dst and returns the extended slice and how many
+	// tokens it consumed. Stores that lock take the lock once per call
+	// rather than once per token. dst is passed by value so that callers can
+	// decode into stack buffers.
+	appendTokens(dst []byte, ids []uint32) ([]byte, int)
+	// tokenLen returns the byte length of token id, or 0 when unknown.
+	tokenLen(id uint32) int
+	// tokensLen returns the summed byte length of ids, counting unknown ids
+	// as 0. It is used to presize decode buffers.
+	tokensLen(ids []uint32) int
+	// Len returns one past the largest id the store can hold, or 0 after
+	// Close.
+	Len() int
+	// Close releases any resources held by the store. It may race with
+	// AppendInto and is idempotent.
 	Close()
 }
+
+// tokensByID indexes the token bytes of pairs by id; when an id repeats, the
+// first pair wins.
+func tokensByID(pairs [][2]any) [][]byte {
+	maxID := uint32(0)
+	for _, p := range pairs {
+		id, _ := p[1].(uint32)
+		maxID = max(maxID, id)
+	}
+	byID := make([][]byte, int(maxID)+1)
+	for _, p := range pairs {
+		b, _ := p[0].([]byte)
+		id, _ := p[1].(uint32)
+		if byID[id] == nil {
+			byID[id] = b
+		}
+	}
+	return byID
+}
@@ -0,0 +1,40 @@
+package tokenizer
+
+// TokenExplain describes one token produced by ordinary encoding, for
+// tokenizer inspection tools.
+type TokenExplain struct {
+	// Token is the token id, which is also its BPE merge rank.
+	Token Rank
+	// Bytes are the raw bytes the token stands for.
+	Bytes []byte
+	// Segment is the pre-tokenizer segment the token was merged from.
+	Segment string
+}
+
+// Explain encodes text without specials and reports, per token, its id,
+// bytes, and source segment. The tokens match EncodeOrdinary. It is meant for
+// diagnostics and is not optimized.
+func (b *coreBPE) Explain(text string) []TokenExplain {
+	var out []TokenExplain
+	add := func(seg, piece string) {
+		out = append(out, TokenExplain{Token: b.enc[piece], Bytes: []byte(piece), Segment: seg})
+	}
+	for i := 0; i < len(text); {
+		end := b.seg.Next(text, i)
+		if end <= i {
+			end = i + 1
+		}
+		seg := text[i:end]
+		if _, ok := b.enc[seg]; ok || len(seg) == 1 {
+			add(seg, seg)
+		} else {
+			parts, release := b.bytePairMerge(seg)
+			for w := 0; w+1 < len(parts); w++ {
+				add(seg, seg[parts[w].start:parts[w+1].start])
+			}
+			release()
+		}
+		i = end
+	}
+	return out
+}
@@ -0,0 +1,9 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package tokenizer
+
+import "os"
+
+// lockFile is a no-op where flock is unavailable; concurrent downloads still
+// never expose a partial file because the cache is replaced by rename.
+func lockFile(path string, perm os.FileMode) (func(), error) { return func() {}, nil }
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -22,19 +23,40 @@ const (
 	envCacheDir    = "TIKTOKEN_GO_CACHE_DIR"
 	envOffline     = "TIKTOKEN_OFFLINE"
 	envHTTPTimeout = "TIKTOKEN_HTTP_TIMEOUT" // seconds
+	envSkipVerify  = "TIKTOKEN_SKIP_VERIFY"
+	envDirPerm     = "TIKTOKEN_GO_CACHE_DIR_PERM"  // octal, e.g. 0700
+	envFilePerm    = "TIKTOKEN_GO_CACHE_FILE_PERM" // octal, e.g. 0600
 	expectedO200k  = "446a9538cb6c348e3516120d7c08b09f57c36495e2acfffe59a5bf8b0cfb1a2d"
 )
 
+// permFromEnv parses an octal permission from the environment variable name,
+// falling back to def when it is unset.
+func permFromEnv(name string, def os.FileMode) (os.FileMode, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	p, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || p > 0o777 {
+		return 0, fmt.Errorf("invalid %s %q: want octal permission bits such as 0700", name, v)
+	}
+	return os.FileMode(p), nil
+}
+
 // resolveCacheDir respects the Go-specific cache override or falls back to a predictable temp directory.
 func resolveCacheDir() (string, error) {
+	perm, err := permFromEnv(envDirPerm, 0o755)
+	if err != nil {
+		return "", err
+	}
 	if d := os.Getenv(envCacheDir); d != "" {
-		if err := os.MkdirAll(d, 0o755); err != nil {
+		if err := os.MkdirAll(d, perm); err != nil {
 			return "", err
 		}
 		return d, nil
 	}
 	primary := filepath.Join(os.TempDir(), "tiktoken-go-cache")
-	if err := os.MkdirAll(primary, 0o755); err != nil {
+	if err := os.MkdirAll(primary, perm); err != nil {
 		return "", err
 	}
 	return primary, nil
@@ -81,38 +103,166 @@ func downloadToFile(url, dest string) (string, error) {
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
+// downloadCached downloads url into path unless another process does so
+// first. Concurrent loaders serialize on an advisory lock next to path; the
+// winner writes a temp file, checks its hash against want and renames it
+// into place, so path is never observed partially written. The others find
+// the finished file once they get the lock.
+func downloadCached(url, path, want string, verify bool) error {
+	perm, err := permFromEnv(envFilePerm, 0o644)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockFile(path+".lock", perm)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := os.Stat(path); err == nil {
+		if !verify {
+			return nil
+		}
+		if sum, err := fileSHA256(path); err == nil && strings.EqualFold(sum, want) {
+			return nil
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	_ = tmp.Close()
+	defer func() { _ = os.Remove(tmpPath) }() // no-op after a successful rename
+	sum, err := downloadToFile(url, tmpPath)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(sum, want) {
+		return fmt.Errorf("hash mismatch: got %s want %s", sum, want)
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// fileSHA256 returns the hex SHA-256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
 // LoadO200k reads or downloads o200k_base.tiktoken and returns encoder pairs.
 // Each line: base64_token + space + rank.
+//
+// A cached file is re-hashed on every load and downloaded again if it does
+// not match the expected checksum; set TIKTOKEN_SKIP_VERIFY=1 to skip the
+// check. Files under TIKTOKEN_ENCODINGS_BASE are used as-is.
 func LoadO200k() (pairs [][2]interface{}, err error) {
-	// Resolve file path
-	var path string
+	path, err := o200kPath()
+	if err != nil {
+		return nil, err
+	}
+	err = readTiktoken(path, func(tok []byte, rank uint32) {
+		pairs = append(pairs, [2]interface{}{tok, rank})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pairs, nil
+}
+
+// LoadO200kCore reads or downloads o200k_base.tiktoken like LoadO200k and
+// builds a Core from it while reading, without materializing the pairs
+// slice, which lowers peak memory during loading.
+func LoadO200kCore(specials map[string]uint32, seg Segmenter) (*Core, error) {
+	path, err := o200kPath()
+	if err != nil {
+		return nil, err
+	}
+	enc := make(map[string]Rank, TokStartOfText)
+	byID := make([][]byte, 0, TokStartOfText)
+	err = readTiktoken(path, func(tok []byte, rank uint32) {
+		enc[string(tok)] = rank
+		if int(rank) >= len(byID) {
+			byID = slices.Grow(byID, int(rank)+1-len(byID))[:rank+1]
+		}
+		if byID[rank] == nil {
+			byID[rank] = tok
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newCoreBPEFromVocab(enc, byID, specials, seg)
+}
+
+// LoadO200kCoreWithoutReserved is LoadO200kCore for specials built from
+// HarmonySpecialsWithoutReserved: ids in the reserved range that no special
+// holds still decode to their "<|reserved_N|>" literal. Cores from
+// LoadO200kCore and NewCoreBPE treat unknown ids in that range as invalid.
+func LoadO200kCoreWithoutReserved(specials map[string]uint32, seg Segmenter) (*Core, error) {
+	b, err := LoadO200kCore(specials, seg)
+	if err != nil {
+		return nil, err
+	}
+	b.skipReserved = true
+	return b, nil
+}
+
+// o200kPath returns the path of a usable o200k_base.tiktoken, downloading it
+// into the cache when it is missing or fails verification.
+func o200kPath() (string, error) {
 	if b := os.Getenv(envEncBase); b != "" {
 		// treat as directory
-		path = filepath.Join(b, "o200k_base.tiktoken")
-	} else {
-		cacheDir, e := resolveCacheDir()
+		return filepath.Join(b, "o200k_base.tiktoken"), nil
+	}
+	cacheDir, e := resolveCacheDir()
+	if e != nil {
+		return "", e
+	}
+	path := filepath.Join(cacheDir, "o200k_base.tiktoken")
+	_, e = os.Stat(path)
+	missing := errors.Is(e, os.ErrNotExist)
+	corrupt := ""
+	if !missing && os.Getenv(envSkipVerify) != "1" {
+		sum, e := fileSHA256(path)
 		if e != nil {
-			return nil, e
+			return "", e
 		}
-		path = filepath.Join(cacheDir, "o200k_base.tiktoken")
-		if _, e := os.Stat(path); errors.Is(e, os.ErrNotExist) {
-			if os.Getenv(envOffline) == "1" {
-				return nil, fmt.Errorf("o200k file missing and TIKTOKEN_OFFLINE=1; set %s to local dir containing o200k_base.tiktoken or unset offline", envEncBase)
-			}
-			url := baseURL() + "o200k_base.tiktoken"
-			sum, e := downloadToFile(url, path)
-			if e != nil {
-				return nil, e
-			}
-			if !strings.EqualFold(sum, expectedO200k) {
-				return nil, fmt.Errorf("hash mismatch: got %s want %s", sum, expectedO200k)
+		if !strings.EqualFold(sum, expectedO200k) {
+			corrupt = sum
+		}
+	}
+	if missing || corrupt != "" {
+		if os.Getenv(envOffline) == "1" {
+			if corrupt != "" {
+				return "", fmt.Errorf("cached o200k file hash mismatch (got %s want %s) and TIKTOKEN_OFFLINE=1; remove %s or set %s=1", corrupt, expectedO200k, path, envSkipVerify)
 			}
+			return "", fmt.Errorf("o200k file missing and TIKTOKEN_OFFLINE=1; set %s to local dir containing o200k_base.tiktoken or unset offline", envEncBase)
+		}
+		url := baseURL() + "o200k_base.tiktoken"
+		if e := downloadCached(url, path, expectedO200k, os.Getenv(envSkipVerify) != "1"); e != nil {
+			return "", e
 		}
 	}
+	return path, nil
+}
 
+// readTiktoken calls fn with the decoded token and rank of each line of the
+// tiktoken file at path. Each token slice is newly allocated.
+func readTiktoken(path string, fn func(tok []byte, rank uint32)) error {
 	f, e := os.Open(path)
 	if e != nil {
-		return nil, e
+		return e
 	}
 	defer func() { _ = f.Close() }()
 	r := bufio.NewReader(f)
@@ -120,7 +270,7 @@ func LoadO200k() (pairs [][2]interface{}, err error) {
 	for {
 		line, e := r.ReadString('\n')
 		if e != nil && !errors.Is(e, io.EOF) {
-			return nil, e
+			return e
 		}
 		if line == "" && errors.Is(e, io.EOF) {
 			break
@@ -132,23 +282,23 @@ func LoadO200k() (pairs [][2]interface{}, err error) {
 		}
 		sp := strings.IndexByte(line, ' ')
 		if sp <= 0 {
-			return nil, fmt.Errorf("invalid vocab at line %d", lineNo)
+			return fmt.Errorf("invalid vocab at line %d", lineNo)
 		}
 		b64 := line[:sp]
 		rankStr := line[sp+1:]
 		tok, de := base64.StdEncoding.DecodeString(b64)
 		if de != nil {
-			return nil, fmt.Errorf("b64 decode line %d: %w", lineNo, de)
+			return fmt.Errorf("b64 decode line %d: %w", lineNo, de)
 		}
 		// parse rank (uint32) — use strconv to avoid fmt scanning allocations
 		rank, se := strconv.ParseUint(rankStr, 10, 32)
 		if se != nil {
-			return nil, fmt.Errorf("rank parse line %d: %w", lineNo, se)
+			return fmt.Errorf("rank parse line %d: %w", lineNo, se)
 		}
-		pairs = append(pairs, [2]interface{}{tok, uint32(rank)})
+		fn(tok, uint32(rank))
 		if errors.Is(e, io.EOF) {
 			break
 		}
 	}
-	return pairs, nil
+	return nil
 }
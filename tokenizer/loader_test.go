@@ -1,8 +1,15 @@
 package tokenizer
 
 import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -35,3 +42,119 @@ func TestLoaderDownloadTimeout(t *testing.T) {
 		}
 	}
 }
+
+func TestLoaderVerifiesCachedFile(t *testing.T) {
+	t.Setenv(envOffline, "1")
+	cacheDir := t.TempDir()
+	t.Setenv(envCacheDir, cacheDir)
+	t.Setenv(envEncBase, "")
+	if err := os.WriteFile(filepath.Join(cacheDir, "o200k_base.tiktoken"), []byte("YQ== 0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := LoadO200k()
+	if err == nil || !strings.Contains(err.Error(), "hash mismatch") {
+		t.Fatalf("expected hash mismatch for corrupt cache, got %v", err)
+	}
+
+	t.Setenv(envSkipVerify, "1")
+	pairs, err := LoadO200k()
+	if err != nil {
+		t.Fatalf("LoadO200k with verification skipped: %v", err)
+	}
+	if len(pairs) != 1 {
+		t.Fatalf("expected 1 pair, got %d", len(pairs))
+	}
+}
+
+func TestLoadO200kCoreMatchesPairs(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(envEncBase, dir)
+	// Ranks are sparse and out of order; "YQ==" ("a") repeats with a later rank.
+	vocab := "YQ== 3\nYg== 0\nYWI= 7\nYQ== 9\n"
+	if err := os.WriteFile(filepath.Join(dir, "o200k_base.tiktoken"), []byte(vocab), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := LoadO200k()
+	if err != nil {
+		t.Fatalf("LoadO200k: %v", err)
+	}
+	want, err := NewCoreBPE(pairs, HarmonySpecials(), NewO200kSegmenter())
+	if err != nil {
+		t.Fatalf("NewCoreBPE: %v", err)
+	}
+	got, err := LoadO200kCore(HarmonySpecials(), NewO200kSegmenter())
+	if err != nil {
+		t.Fatalf("LoadO200kCore: %v", err)
+	}
+	wantVocab, _ := want.Vocab()
+	gotVocab, _ := got.Vocab()
+	if fmt.Sprint(gotVocab) != fmt.Sprint(wantVocab) {
+		t.Fatalf("vocab\n got: %q\nwant: %q", gotVocab, wantVocab)
+	}
+	text := "abba<|start|>"
+	if g, w := got.EncodeWithSpecialTokens(text), want.EncodeWithSpecialTokens(text); fmt.Sprint(g) != fmt.Sprint(w) {
+		t.Fatalf("encode: got %v want %v", g, w)
+	}
+	if !got.IsOrdinaryToken(7) || got.IsOrdinaryToken(1) || got.IsOrdinaryToken(TokStart) {
+		t.Fatal("IsOrdinaryToken disagrees with the vocabulary")
+	}
+}
+
+func TestDownloadCachedConcurrent(t *testing.T) {
+	body := []byte("YQ== 0\n")
+	want := fmt.Sprintf("%x", sha256.Sum256(body))
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = w.Write(body)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "o200k_base.tiktoken")
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- downloadCached(srv.URL, path, want, true)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("downloadCached: %v", err)
+		}
+	}
+	if got, err := os.ReadFile(path); err != nil || string(got) != string(body) {
+		t.Fatalf("cached file = %q, %v", got, err)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("expected a single download, got %d", n)
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmps) != 0 {
+		t.Fatalf("temp files left behind: %v", tmps)
+	}
+
+	bad := filepath.Join(dir, "bad.tiktoken")
+	if err := downloadCached(srv.URL, bad, strings.Repeat("0", 64), true); err == nil || !strings.Contains(err.Error(), "hash mismatch") {
+		t.Fatalf("expected hash mismatch, got %v", err)
+	}
+	if _, err := os.Stat(bad); !os.IsNotExist(err) {
+		t.Fatalf("mismatched download must not be cached: %v", err)
+	}
+}
+
+func TestCachePermFromEnv(t *testing.T) {
+	t.Setenv(envFilePerm, "0600")
+	if p, err := permFromEnv(envFilePerm, 0o644); err != nil || p != 0o600 {
+		t.Fatalf("permFromEnv = %o, %v", p, err)
+	}
+	t.Setenv(envFilePerm, "rw")
+	if _, err := permFromEnv(envFilePerm, 0o644); err == nil {
+		t.Fatal("expected error for non-octal permission")
+	}
+}
@@ -12,3 +12,13 @@ func NewCoreBPE(pairs [][2]any, specials map[string]uint32, seg Segmenter) (*Cor
 
 // HarmonySpecials returns the default special tokens used by Harmony tokenizers.
 func HarmonySpecials() map[string]uint32 { return buildHarmonySpecials() }
+
+// HarmonySpecialsWithoutReserved returns the named Harmony special tokens
+// without the <|reserved_N|> range. A Core built from it with
+// LoadO200kCoreWithoutReserved still decodes reserved ids to their literal,
+// but does not match reserved literals when encoding with specials.
+func HarmonySpecialsWithoutReserved() map[string]uint32 { return buildHarmonyBaseSpecials() }
+
+// O200kChecksum returns the SHA-256 (hex) of the o200k_base vocabulary file
+// this package expects.
+func O200kChecksum() string { return expectedO200k }
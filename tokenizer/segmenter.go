@@ -9,10 +9,31 @@ import (
 // Next returns the end index (exclusive) of the next segment starting at i.
 type Segmenter interface{ Next(s string, i int) int }
 
-type o200kSegmenter struct{}
+// defaultMaxDigitRun is the o200k cap on digits per number segment.
+const defaultMaxDigitRun = 3
+
+type o200kSegmenter struct {
+	maxDigitRun int
+}
+
+// SegmenterOptions tunes the O200k segmentation rules for tokenizer variants.
+type SegmenterOptions struct {
+	// MaxDigitRun caps the number of digits grouped into one segment.
+	// Zero or negative selects the o200k default of 3.
+	MaxDigitRun int
+}
 
 // NewO200kSegmenter creates a new O200k segmenter for tokenization.
-func NewO200kSegmenter() Segmenter { return &o200kSegmenter{} }
+func NewO200kSegmenter() Segmenter { return &o200kSegmenter{maxDigitRun: defaultMaxDigitRun} }
+
+// NewO200kSegmenterWithOptions creates an O200k-style segmenter with the
+// given overrides. NewO200kSegmenter remains the canonical configuration.
+func NewO200kSegmenterWithOptions(opts SegmenterOptions) Segmenter {
+	if opts.MaxDigitRun <= 0 {
+		opts.MaxDigitRun = defaultMaxDigitRun
+	}
+	return &o200kSegmenter{maxDigitRun: opts.MaxDigitRun}
+}
 
 func (o *o200kSegmenter) Next(s string, i int) int {
 	// NOTE: This is a minimal, correct-but-not-yet-optimized segmentation.
@@ -51,7 +72,7 @@ func (o *o200kSegmenter) Next(s string, i int) int {
 	if end := ruleLettersWithContraction(s, i); end > i {
 		return end
 	}
-	if end := ruleNumbers(s, i); end > i {
+	if end := ruleNumbers(s, i, o.maxDigitRun); end > i {
 		return end
 	}
 	if end := rulePunctRun(s, i); end > i {
@@ -158,13 +179,13 @@ func hasCaseInsensitiveSuffixAt(s string, i int, suf string) bool {
 	return true
 }
 
-func ruleNumbers(s string, i int) int {
+func ruleNumbers(s string, i, maxRun int) int {
 	j := i
 	count := 0
 	for j < len(s) {
 		b := s[j]
 		if b < utf8.RuneSelf {
-			if !isASCIIDigit(b) || count >= 3 {
+			if !isASCIIDigit(b) || count >= maxRun {
 				break
 			}
 			j++
@@ -172,7 +193,7 @@ func ruleNumbers(s string, i int) int {
 			continue
 		}
 		r, sz := utf8DecodeRuneInString(s[j:])
-		if !isN(r) || count >= 3 {
+		if !isN(r) || count >= maxRun {
 			break
 		}
 		j += sz
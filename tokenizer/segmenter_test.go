@@ -64,6 +64,28 @@ func TestSegmenterASCIIEquivalence(t *testing.T) {
 	}
 }
 
+func TestSegmenterMaxDigitRunOption(t *testing.T) {
+	cases := []struct {
+		opts   SegmenterOptions
+		expect []string
+	}{
+		{SegmenterOptions{}, []string{"123", "456", "7"}},
+		{SegmenterOptions{MaxDigitRun: 1}, []string{"1", "2", "3", "4", "5", "6", "7"}},
+		{SegmenterOptions{MaxDigitRun: 4}, []string{"1234", "567"}},
+	}
+	for _, tc := range cases {
+		got := collectSegments(NewO200kSegmenterWithOptions(tc.opts), "1234567")
+		if len(got) != len(tc.expect) {
+			t.Fatalf("MaxDigitRun=%d: got %v want %v", tc.opts.MaxDigitRun, got, tc.expect)
+		}
+		for i := range got {
+			if got[i] != tc.expect[i] {
+				t.Fatalf("MaxDigitRun=%d: got %v want %v", tc.opts.MaxDigitRun, got, tc.expect)
+			}
+		}
+	}
+}
+
 func collectSegments(seg Segmenter, text string) []string {
 	var out []string
 	for i := 0; i < len(text); {
@@ -1,6 +1,10 @@
 package tokenizer
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 // Harmony special token ids and reserved ranges (must exactly match the upstream spec).
 const (
@@ -23,7 +27,18 @@ const (
 )
 
 func buildHarmonySpecials() map[string]uint32 {
-	m := map[string]uint32{
+	m := buildHarmonyBaseSpecials()
+	// Reserved mapping
+	for id := uint32(ReservedStart); id <= uint32(ReservedEnd); id++ {
+		m[reservedLiteral(id)] = id
+	}
+	return m
+}
+
+// buildHarmonyBaseSpecials returns the named Harmony specials without the
+// reserved range.
+func buildHarmonyBaseSpecials() map[string]uint32 {
+	return map[string]uint32{
 		"<|startoftext|>": TokStartOfText,
 		"<|endoftext|>":   TokEndOfText,
 		"<|return|>":      TokReturn,
@@ -34,10 +49,24 @@ func buildHarmonySpecials() map[string]uint32 {
 		"<|message|>":     TokMessage,
 		"<|call|>":        TokCall,
 	}
-	// Reserved mapping
-	for id := uint32(ReservedStart); id <= uint32(ReservedEnd); id++ {
-		key := fmt.Sprintf("<|reserved_%d|>", id)
-		m[key] = id
+}
+
+func isReserved(id uint32) bool { return id >= ReservedStart && id <= ReservedEnd }
+
+func reservedLiteral(id uint32) string { return fmt.Sprintf("<|reserved_%d|>", id) }
+
+// reservedID parses a "<|reserved_N|>" literal in the reserved range.
+func reservedID(lit string) (uint32, bool) {
+	s, ok := strings.CutPrefix(lit, "<|reserved_")
+	if !ok {
+		return 0, false
 	}
-	return m
+	if s, ok = strings.CutSuffix(s, "|>"); !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || !isReserved(uint32(n)) || reservedLiteral(uint32(n)) != lit {
+		return 0, false
+	}
+	return uint32(n), true
 }
@@ -2,7 +2,10 @@
 
 package tokenizer
 
-import "testing"
+import (
+	"sync"
+	"testing"
+)
 
 func TestArenaStoreAppendIntoSmallVocab(t *testing.T) {
 	pairs := [][2]any{
@@ -10,7 +13,7 @@ func TestArenaStoreAppendIntoSmallVocab(t *testing.T) {
 		{[]byte("bye"), uint32(2)},
 	}
 
-	store, err := newTokenStore(pairs)
+	store, err := newTokenStore(tokensByID(pairs))
 	if err != nil {
 		t.Fatalf("newTokenStore: %v", err)
 	}
@@ -33,3 +36,52 @@ func TestArenaStoreAppendIntoSmallVocab(t *testing.T) {
 		t.Fatalf("unexpected success for missing id")
 	}
 }
+
+func TestArenaStoreConcurrentDecodeAndClose(t *testing.T) {
+	pairs := [][2]any{
+		{[]byte("hi"), uint32(1)},
+		{[]byte("bye"), uint32(2)},
+	}
+	store, err := newTokenStore(tokensByID(pairs))
+	if err != nil {
+		t.Fatalf("newTokenStore: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var dst []byte
+			for i := 0; i < 1000; i++ {
+				dst = dst[:0]
+				if store.AppendInto(&dst, 1) && string(dst) != "hi" {
+					t.Errorf("unexpected bytes %q", dst)
+					return
+				}
+			}
+		}()
+	}
+	store.Close()
+	wg.Wait()
+
+	var dst []byte
+	if store.AppendInto(&dst, 1) {
+		t.Fatalf("expected AppendInto after Close to fail")
+	}
+	store.Close()
+}
+
+func TestArenaVocabAfterClose(t *testing.T) {
+	core, err := newCoreBPE([][2]any{{[]byte("a"), uint32(0)}}, nil, NewO200kSegmenter())
+	if err != nil {
+		t.Fatalf("newCoreBPE: %v", err)
+	}
+	if v, err := core.Vocab(); err != nil || string(v[0]) != "a" {
+		t.Fatalf("Vocab before Close: %q %v", v, err)
+	}
+	core.dec.Close()
+	if _, err := core.Vocab(); err == nil {
+		t.Fatal("expected error after Close")
+	}
+}
@@ -1,6 +1,9 @@
 package tokenizer
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestHeapStoreAppendIntoSmallVocab(t *testing.T) {
 	pairs := [][2]any{
@@ -8,7 +11,7 @@ func TestHeapStoreAppendIntoSmallVocab(t *testing.T) {
 		{[]byte("bye"), uint32(2)},
 	}
 
-	store, err := newTokenStore(pairs)
+	store, err := newTokenStore(tokensByID(pairs))
 	if err != nil {
 		t.Fatalf("newTokenStore: %v", err)
 	}
@@ -31,3 +34,65 @@ func TestHeapStoreAppendIntoSmallVocab(t *testing.T) {
 		t.Fatalf("unexpected success for missing id")
 	}
 }
+
+func TestStoreAppendTokens(t *testing.T) {
+	store, err := newTokenStore(tokensByID([][2]any{{[]byte("hi"), uint32(1)}, {[]byte("bye"), uint32(2)}}))
+	if err != nil {
+		t.Fatalf("newTokenStore: %v", err)
+	}
+	t.Cleanup(store.Close)
+	if dst, n := store.appendTokens(nil, []uint32{1, 2, 1, 7, 2}); n != 3 || string(dst) != "hibyehi" {
+		t.Fatalf("appendTokens consumed %d, wrote %q", n, dst)
+	}
+	if n := store.tokensLen([]uint32{1, 2, 7}); n != 5 {
+		t.Fatalf("tokensLen = %d, want 5", n)
+	}
+}
+
+func TestCoreVocab(t *testing.T) {
+	pairs := [][2]any{
+		{[]byte("a"), uint32(0)},
+		{[]byte("bc"), uint32(2)},
+	}
+	core, err := newCoreBPE(pairs, map[string]Rank{"<|end|>": 5}, NewO200kSegmenter())
+	if err != nil {
+		t.Fatalf("newCoreBPE: %v", err)
+	}
+	vocab, err := core.Vocab()
+	if err != nil {
+		t.Fatalf("Vocab: %v", err)
+	}
+	want := []string{"a", "", "bc", "", "", "<|end|>"}
+	if len(vocab) != len(want) {
+		t.Fatalf("len(vocab) = %d, want %d", len(vocab), len(want))
+	}
+	for id, w := range want {
+		if string(vocab[id]) != w || (w == "") != (vocab[id] == nil) {
+			t.Fatalf("vocab[%d] = %q, want %q", id, vocab[id], w)
+		}
+	}
+	vocab[0][0] = 'z'
+	if got, _ := core.DecodeUTF8([]uint32{0}); got != "a" {
+		t.Fatalf("Vocab exposed internal storage: decode = %q", got)
+	}
+}
+
+func TestDecodeBytesIntoLarge(t *testing.T) {
+	pairs := [][2]any{{[]byte("ab"), uint32(0)}, {[]byte("c"), uint32(1)}}
+	core, err := newCoreBPE(pairs, map[string]Rank{"<|end|>": 2}, NewO200kSegmenter())
+	if err != nil {
+		t.Fatalf("newCoreBPE: %v", err)
+	}
+	var toks []uint32
+	for i := range 3 * decodePresizeMin {
+		toks = append(toks, uint32(i%3))
+	}
+	dst := []byte("x")
+	if err := core.DecodeBytesInto(&dst, toks); err != nil {
+		t.Fatalf("DecodeBytesInto: %v", err)
+	}
+	want := "x" + strings.Repeat("abc<|end|>", decodePresizeMin)
+	if string(dst) != want {
+		t.Fatalf("decoded %d bytes, want %d", len(dst), len(want))
+	}
+}
@@ -0,0 +1,40 @@
+package tokenizer
+
+import "errors"
+
+// Vocab returns the decode table indexed by token id: ordinary tokens from
+// the store followed by the special tokens, whose entries hold their literal
+// text. Ids with no token are nil. The slices are copies.
+func (b *coreBPE) Vocab() ([][]byte, error) {
+	n := b.dec.Len()
+	if n == 0 {
+		return nil, errors.New("decode table is closed")
+	}
+	for id := range b.specialDec {
+		if int(id) >= n {
+			n = int(id) + 1
+		}
+	}
+	out := make([][]byte, n)
+	for id := range b.dec.Len() {
+		var tok []byte
+		if b.dec.AppendInto(&tok, uint32(id)) {
+			out[id] = tok
+		}
+	}
+	for id, lit := range b.specialDec {
+		out[id] = append([]byte(nil), lit...)
+	}
+	if b.skipReserved {
+		// Report reserved ids as they decode, like the full special table.
+		if n <= ReservedEnd {
+			out = append(out, make([][]byte, ReservedEnd+1-n)...)
+		}
+		for id := uint32(ReservedStart); id <= ReservedEnd; id++ {
+			if b.reservedFallback(id) {
+				out[id] = []byte(reservedLiteral(id))
+			}
+		}
+	}
+	return out, nil
+}
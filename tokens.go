@@ -0,0 +1,136 @@
+package harmony
+
+import (
+	"fmt"
+	"slices"
+	"unicode/utf8"
+)
+
+// Tokens is a Harmony token sequence. Render methods return []uint32, which
+// converts to Tokens without copying: harmony.Tokens(toks). RenderTokens,
+// RenderConversationTokens and RenderConversationForCompletionTokens return
+// Tokens directly.
+type Tokens []uint32
+
+// RenderTokens is Render returning Tokens.
+func (e *Encoding) RenderTokens(msg Message) (Tokens, error) {
+	return e.Render(msg)
+}
+
+// RenderConversationTokens is RenderConversation returning Tokens.
+func (e *Encoding) RenderConversationTokens(conv Conversation, cfg *RenderConversationConfig) (Tokens, error) {
+	return e.RenderConversation(conv, cfg)
+}
+
+// RenderConversationForCompletionTokens is RenderConversationForCompletion
+// returning Tokens.
+func (e *Encoding) RenderConversationForCompletionTokens(conv Conversation, next Role, cfg *RenderConversationConfig) (Tokens, error) {
+	return e.RenderConversationForCompletion(conv, next, cfg)
+}
+
+// Len returns the number of tokens.
+func (t Tokens) Len() int { return len(t) }
+
+// Contains reports whether id occurs in the sequence.
+func (t Tokens) Contains(id uint32) bool { return slices.Contains(t, id) }
+
+// Decode decodes the tokens, including formatting tokens, into a string.
+func (t Tokens) Decode(e *Encoding) (string, error) { return e.DecodeUTF8(t) }
+
+// Split breaks a rendered sequence into per-message slices, each running from
+// <|start|> through its terminating <|end|>, <|call|> or <|return|>. A
+// trailing unterminated message (e.g. a completion header) is returned as the
+// last element. The slices alias t.
+func (t Tokens) Split(e *Encoding) ([]Tokens, error) {
+	var out []Tokens
+	start := -1
+	for i, tok := range t {
+		if start == -1 {
+			if tok != e.idStart {
+				return nil, fmt.Errorf("token %d: expected <|start|>, got %d", i, tok)
+			}
+			start = i
+			continue
+		}
+		if _, stop := e.stopAll[tok]; stop {
+			out = append(out, t[start:i+1:i+1])
+			start = -1
+		}
+	}
+	if start != -1 {
+		out = append(out, t[start:len(t):len(t)])
+	}
+	return out, nil
+}
+
+// CommonTokenPrefixLen returns the number of leading tokens a and b share.
+func CommonTokenPrefixLen(a, b []uint32) int {
+	n := min(len(a), len(b))
+	for i := range n {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// SharedPrefixTokens renders c1 and c2 with RenderConversation and returns
+// the length of their common token prefix, i.e. how much of a KV cache built
+// for one render can be reused for the other.
+func (e *Encoding) SharedPrefixTokens(c1, c2 Conversation, cfg *RenderConversationConfig) (int, error) {
+	a, err := e.RenderConversation(c1, cfg)
+	if err != nil {
+		return 0, err
+	}
+	b, err := e.RenderConversation(c2, cfg)
+	if err != nil {
+		return 0, err
+	}
+	return CommonTokenPrefixLen(a, b), nil
+}
+
+// TruncateText returns the longest head of text, cut on a rune boundary,
+// that encodes as content to at most maxTokens tokens, together with its
+// token count. Text within the limit is returned unchanged. It is meant for
+// clamping large tool results before they are rendered.
+func (e *Encoding) TruncateText(text string, maxTokens int) (string, int, error) {
+	if maxTokens < 0 {
+		return "", 0, fmt.Errorf("negative token limit: %d", maxTokens)
+	}
+	var toks []uint32
+	e.bpe.EncodeIntoOrdinary(text, &toks)
+	if len(toks) <= maxTokens {
+		return text, len(toks), nil
+	}
+	var b []byte
+	var recount []uint32
+	// Re-encoding a head can merge differently at the cut, so shrink until
+	// the head itself fits.
+	for n := maxTokens; n > 0; n-- {
+		b = b[:0]
+		if err := e.bpe.DecodeBytesInto(&b, toks[:n]); err != nil {
+			return "", 0, err
+		}
+		b = trimPartialRune(b)
+		recount = recount[:0]
+		e.bpe.EncodeIntoOrdinary(string(b), &recount)
+		if len(recount) <= maxTokens {
+			return string(b), len(recount), nil
+		}
+	}
+	return "", 0, nil
+}
+
+// trimPartialRune drops an incomplete UTF-8 sequence at the end of b, as left
+// by a token boundary inside a multibyte rune.
+func trimPartialRune(b []byte) []byte {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return b[:i]
+			}
+			return b
+		}
+	}
+	return b
+}
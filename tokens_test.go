@@ -0,0 +1,132 @@
+package harmony
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/euforicio/harmony-go/tokenizer"
+)
+
+func TestTokensSplit(t *testing.T) {
+	enc := mustEncoding(t)
+	conv := Conversation{Messages: []Message{
+		{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "ping"}}},
+		{Author: Author{Role: RoleAssistant}, Channel: "final", Content: []Content{{Type: ContentText, Text: "pong"}}},
+	}}
+	raw, err := enc.RenderConversationForCompletion(conv, RoleAssistant, nil)
+	if err != nil {
+		t.Fatalf("RenderConversationForCompletion: %v", err)
+	}
+	toks := Tokens(raw)
+	if toks.Len() != len(raw) || !toks.Contains(tokenizer.TokEnd) {
+		t.Fatalf("unexpected Len/Contains results")
+	}
+
+	parts, err := toks.Split(enc)
+	if err != nil {
+		t.Fatalf("Split: %v", err)
+	}
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 parts, got %d", len(parts))
+	}
+	last, err := parts[2].Decode(enc)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if last != "<|start|>assistant" {
+		t.Fatalf("unexpected trailing header %q", last)
+	}
+	first, _ := parts[0].Decode(enc)
+	if first != "<|start|>user<|message|>ping<|end|>" {
+		t.Fatalf("unexpected first message %q", first)
+	}
+
+	if _, err := Tokens(raw[1:]).Split(enc); err == nil {
+		t.Fatalf("expected error when sequence does not begin with <|start|>")
+	}
+
+	direct, err := enc.RenderConversationForCompletionTokens(conv, RoleAssistant, nil)
+	if err != nil || !slices.Equal(direct, toks) {
+		t.Fatalf("RenderConversationForCompletionTokens: %v %v", direct, err)
+	}
+	msgParts, err := enc.RenderTokens(conv.Messages[0])
+	if err != nil || !slices.Equal(msgParts, parts[0]) {
+		t.Fatalf("RenderTokens: %v %v", msgParts, err)
+	}
+	full, err := enc.RenderConversationTokens(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversationTokens: %v", err)
+	}
+	if split, err := full.Split(enc); err != nil || len(split) != 2 {
+		t.Fatalf("RenderConversationTokens split: %d parts, %v", len(split), err)
+	}
+}
+
+func TestCommonTokenPrefixLen(t *testing.T) {
+	cases := []struct {
+		a, b []uint32
+		want int
+	}{
+		{nil, nil, 0},
+		{[]uint32{1, 2}, nil, 0},
+		{[]uint32{1, 2, 3}, []uint32{1, 2}, 2},
+		{[]uint32{1, 2, 3}, []uint32{1, 9, 3}, 1},
+		{[]uint32{1, 2, 3}, []uint32{1, 2, 3}, 3},
+	}
+	for _, tc := range cases {
+		if got := CommonTokenPrefixLen(tc.a, tc.b); got != tc.want {
+			t.Errorf("CommonTokenPrefixLen(%v, %v) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+	if n := testing.AllocsPerRun(10, func() { CommonTokenPrefixLen(cases[4].a, cases[4].b) }); n != 0 {
+		t.Fatalf("allocs = %v", n)
+	}
+}
+
+func TestSharedPrefixTokens(t *testing.T) {
+	enc := mustEncoding(t)
+	turn1 := Conversation{Messages: []Message{
+		{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "ping"}}},
+	}}
+	turn2 := Conversation{Messages: append(slices.Clone(turn1.Messages),
+		Message{Author: Author{Role: RoleAssistant}, Channel: "final", Content: []Content{{Type: ContentText, Text: "pong"}}},
+	)}
+	first, err := enc.RenderConversation(turn1, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+	n, err := enc.SharedPrefixTokens(turn1, turn2, nil)
+	if err != nil || n != len(first) {
+		t.Fatalf("SharedPrefixTokens = %d, %v; want %d", n, err, len(first))
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	enc := mustEncoding(t)
+	text := "naïve café — 日本語のテキスト 🎉🎉 done"
+	var all []uint32
+	enc.bpe.EncodeIntoOrdinary(text, &all)
+
+	if got, n, err := enc.TruncateText(text, len(all)); err != nil || got != text || n != len(all) {
+		t.Fatalf("text within limit changed: %q %d %v", got, n, err)
+	}
+	for limit := range len(all) {
+		got, n, err := enc.TruncateText(text, limit)
+		if err != nil {
+			t.Fatalf("limit %d: %v", limit, err)
+		}
+		if !utf8.ValidString(got) || !strings.HasPrefix(text, got) {
+			t.Fatalf("limit %d: %q is not a rune-aligned head", limit, got)
+		}
+		var toks []uint32
+		enc.bpe.EncodeIntoOrdinary(got, &toks)
+		if n != len(toks) || n > limit {
+			t.Fatalf("limit %d: count %d, re-encoded %d", limit, n, len(toks))
+		}
+	}
+	if _, _, err := enc.TruncateText(text, -1); err == nil {
+		t.Fatal("expected error for negative limit")
+	}
+}
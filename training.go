@@ -0,0 +1,143 @@
+package harmony
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// WriteTrainingRecord renders conv with RenderConversationForTraining and
+// writes it to w as one length-prefixed record: a little-endian uint32 token
+// count followed by each token as a little-endian uint32. It returns the
+// number of bytes written.
+func (e *Encoding) WriteTrainingRecord(w io.Writer, conv Conversation, cfg *RenderConversationConfig) (int, error) {
+	toks, err := e.RenderConversationForTraining(conv, cfg)
+	if err != nil {
+		return 0, err
+	}
+	buf := e.acquireBuffer()
+	defer e.releaseBuffer(buf)
+	buf.Grow(4 * (len(toks) + 1))
+	b := buf.AvailableBuffer()
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(toks)))
+	for _, t := range toks {
+		b = binary.LittleEndian.AppendUint32(b, t)
+	}
+	return w.Write(b)
+}
+
+// ReadTrainingRecord reads one record written by WriteTrainingRecord from r
+// and returns its tokens. It returns io.EOF when r is exhausted before the
+// record starts and io.ErrUnexpectedEOF when the record is cut short.
+func ReadTrainingRecord(r io.Reader) ([]uint32, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(hdr[:])
+	// Grow with the data read rather than trusting a possibly corrupt count.
+	toks := make([]uint32, 0, min(n, 1<<16))
+	var buf [4096]byte
+	for remaining := int(n); remaining > 0; {
+		chunk := buf[:4*min(remaining, len(buf)/4)]
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		for i := 0; i < len(chunk); i += 4 {
+			toks = append(toks, binary.LittleEndian.Uint32(chunk[i:]))
+		}
+		remaining -= len(chunk) / 4
+	}
+	return toks, nil
+}
+
+// TokenFormatKind selects how RenderConversationAs serializes token ids.
+type TokenFormatKind string
+
+// Supported token serializations: fixed-width little-endian integers and a
+// JSON array of integers.
+const (
+	TokenFormatLE   TokenFormatKind = "le"
+	TokenFormatJSON TokenFormatKind = "json"
+)
+
+// TokenFormat describes the token serialization of RenderConversationAs. The
+// zero value writes each id as a little-endian uint32.
+type TokenFormat struct {
+	// Kind defaults to TokenFormatLE.
+	Kind TokenFormatKind
+	// Width is the byte width of each id: 2, 4 (default) or 8. Signed
+	// limits ids to the signed range of that width, for consumers that read
+	// int16/int32/int64. JSON output is range-checked the same way.
+	Width  int
+	Signed bool
+	// Offset is added to every id, for frameworks that reserve low ids.
+	Offset int64
+}
+
+// RenderConversationAs renders conv like RenderConversation and serializes
+// the tokens in format. Each id is shifted by format.Offset; an id that then
+// falls outside the range of the chosen integer width is an error.
+func (e *Encoding) RenderConversationAs(conv Conversation, cfg *RenderConversationConfig, format TokenFormat) ([]byte, error) {
+	width := format.Width
+	if width == 0 {
+		width = 4
+	}
+	if format.Kind != "" && format.Kind != TokenFormatLE && format.Kind != TokenFormatJSON {
+		return nil, fmt.Errorf("unsupported token format: %q", format.Kind)
+	}
+	if width != 2 && width != 4 && width != 8 {
+		return nil, fmt.Errorf("unsupported token width: %d", width)
+	}
+	toks, err := e.RenderConversation(conv, cfg)
+	if err != nil {
+		return nil, err
+	}
+	lo, hi := int64(0), int64(math.MaxInt64)
+	switch {
+	case format.Signed && width < 8:
+		hi = 1<<(8*width-1) - 1
+		lo = -hi - 1
+	case format.Signed:
+		lo = math.MinInt64
+	case width < 8:
+		hi = 1<<(8*width) - 1
+	}
+	var b []byte
+	if format.Kind == TokenFormatJSON {
+		b = make([]byte, 0, 7*len(toks)+2)
+		b = append(b, '[')
+	} else {
+		b = make([]byte, 0, width*len(toks))
+	}
+	for i, t := range toks {
+		v := int64(t) + format.Offset
+		if (format.Offset > 0 && v < int64(t)) || v < lo || v > hi {
+			return nil, fmt.Errorf("token %d: id %d with offset %d out of range", i, t, format.Offset)
+		}
+		if format.Kind == TokenFormatJSON {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = strconv.AppendInt(b, v, 10)
+			continue
+		}
+		switch width {
+		case 2:
+			b = binary.LittleEndian.AppendUint16(b, uint16(v))
+		case 4:
+			b = binary.LittleEndian.AppendUint32(b, uint32(v))
+		default:
+			b = binary.LittleEndian.AppendUint64(b, uint64(v))
+		}
+	}
+	if format.Kind == TokenFormatJSON {
+		b = append(b, ']')
+	}
+	return b, nil
+}
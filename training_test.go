@@ -0,0 +1,128 @@
+package harmony
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestWriteTrainingRecord(t *testing.T) {
+	enc := mustEncoding(t)
+	conv := Conversation{Messages: []Message{
+		{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "ping"}}},
+		{Author: Author{Role: RoleAssistant}, Channel: "final", Content: []Content{{Type: ContentText, Text: "pong"}}},
+	}}
+	want, err := enc.RenderConversationForTraining(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversationForTraining: %v", err)
+	}
+
+	var buf bytes.Buffer
+	n, err := enc.WriteTrainingRecord(&buf, conv, nil)
+	if err != nil {
+		t.Fatalf("WriteTrainingRecord: %v", err)
+	}
+	if n != buf.Len() || n != 4*(len(want)+1) {
+		t.Fatalf("unexpected byte count: n=%d buffered=%d tokens=%d", n, buf.Len(), len(want))
+	}
+	raw := buf.Bytes()
+	if got := binary.LittleEndian.Uint32(raw); int(got) != len(want) {
+		t.Fatalf("length prefix = %d, want %d", got, len(want))
+	}
+	got := make([]uint32, len(want))
+	for i := range got {
+		got[i] = binary.LittleEndian.Uint32(raw[4+4*i:])
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("record tokens mismatch\n got: %v\nwant: %v", got, want)
+	}
+}
+
+func TestRenderConversationAs(t *testing.T) {
+	enc := mustEncoding(t)
+	conv := Conversation{Messages: []Message{
+		{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "ping"}}},
+	}}
+	want, err := enc.RenderConversation(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversation: %v", err)
+	}
+
+	raw, err := enc.RenderConversationAs(conv, nil, TokenFormat{})
+	if err != nil || len(raw) != 4*len(want) {
+		t.Fatalf("default format: %d bytes, %v", len(raw), err)
+	}
+	for i, tok := range want {
+		if got := binary.LittleEndian.Uint32(raw[4*i:]); got != tok {
+			t.Fatalf("token %d = %d, want %d", i, got, tok)
+		}
+	}
+
+	raw, err = enc.RenderConversationAs(conv, nil, TokenFormat{Width: 8, Offset: 3})
+	if err != nil || len(raw) != 8*len(want) {
+		t.Fatalf("width 8: %d bytes, %v", len(raw), err)
+	}
+	if got := binary.LittleEndian.Uint64(raw); got != uint64(want[0])+3 {
+		t.Fatalf("offset not applied: %d", got)
+	}
+
+	raw, err = enc.RenderConversationAs(conv, nil, TokenFormat{Kind: TokenFormatJSON, Offset: -1})
+	if err != nil {
+		t.Fatalf("JSON: %v", err)
+	}
+	var ids []int64
+	if err := json.Unmarshal(raw, &ids); err != nil || len(ids) != len(want) {
+		t.Fatalf("JSON output %s: %v", raw, err)
+	}
+	for i, tok := range want {
+		if ids[i] != int64(tok)-1 {
+			t.Fatalf("JSON token %d = %d, want %d", i, ids[i], int64(tok)-1)
+		}
+	}
+
+	for name, f := range map[string]TokenFormat{
+		"width 2 too narrow": {Width: 2},
+		"signed overflow":    {Signed: true, Offset: 1 << 31},
+		"negative id":        {Offset: -1 << 32},
+		"bad width":          {Width: 3},
+		"bad kind":           {Kind: "csv"},
+	} {
+		if _, err := enc.RenderConversationAs(conv, nil, f); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestReadTrainingRecordRoundTrip(t *testing.T) {
+	enc := mustEncoding(t)
+	conv := Conversation{Messages: []Message{
+		{Author: Author{Role: RoleUser}, Content: []Content{{Type: ContentText, Text: "ping"}}},
+		{Author: Author{Role: RoleAssistant}, Channel: "final", Content: []Content{{Type: ContentText, Text: "pong"}}},
+	}}
+	want, err := enc.RenderConversationForTraining(conv, nil)
+	if err != nil {
+		t.Fatalf("RenderConversationForTraining: %v", err)
+	}
+	var buf bytes.Buffer
+	for range 2 {
+		if _, err := enc.WriteTrainingRecord(&buf, conv, nil); err != nil {
+			t.Fatalf("WriteTrainingRecord: %v", err)
+		}
+	}
+	data := slices.Clone(buf.Bytes())
+	for i := range 2 {
+		got, err := ReadTrainingRecord(&buf)
+		if err != nil || !slices.Equal(got, want) {
+			t.Fatalf("record %d: %v %v", i, got, err)
+		}
+	}
+	if _, err := ReadTrainingRecord(&buf); err != io.EOF {
+		t.Fatalf("expected io.EOF after the last record, got %v", err)
+	}
+	if _, err := ReadTrainingRecord(bytes.NewReader(data[:len(data)/2-2])); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF for a cut record, got %v", err)
+	}
+}
@@ -2,6 +2,8 @@ package harmony
 
 import (
 	"encoding/json"
+	"strings"
+	"time"
 )
 
 // Role identifies the author class of a message in a Harmony conversation.
@@ -33,6 +35,16 @@ const (
 	ReasoningHigh   ReasoningEffort = "high"
 )
 
+// Valid reports whether r is one of the known effort levels, ignoring case
+// as rendering lowercases it.
+func (r ReasoningEffort) Valid() bool {
+	switch ReasoningEffort(strings.ToLower(string(r))) {
+	case ReasoningLow, ReasoningMedium, ReasoningHigh:
+		return true
+	}
+	return false
+}
+
 // ChannelConfig configures valid channels and whether a channel is required.
 type ChannelConfig struct {
 	ValidChannels   []string `json:"valid_channels"`
@@ -44,6 +56,10 @@ type ToolDescription struct {
 	Name        string          `json:"name"`
 	Description string          `json:"description"`
 	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	// PropertyOrder optionally fixes the render order of the top-level
+	// parameter properties. It takes precedence over the key order found in
+	// Parameters, which is lost when the schema was marshaled from a map.
+	PropertyOrder []string `json:"property_order,omitempty"`
 	// parsed caches derive from Parameters; kept behind a pointer so copying
 	// ToolDescription values does not copy synchronization primitives.
 	parsed *toolParsedCache `json:"-"`
@@ -58,18 +74,25 @@ type ToolNamespaceConfig struct {
 
 // SystemContent encodes system instructions and metadata for the conversation.
 type SystemContent struct {
-	ModelIdentity         *string                        `json:"model_identity,omitempty"`
-	ReasoningEffort       *ReasoningEffort               `json:"reasoning_effort,omitempty"`
-	Tools                 map[string]ToolNamespaceConfig `json:"tools,omitempty"`
+	ModelIdentity   *string          `json:"model_identity,omitempty"`
+	ReasoningEffort *ReasoningEffort `json:"reasoning_effort,omitempty"`
+	// ReasoningBudget is an optional numeric reasoning budget rendered after
+	// the effort, e.g. "Reasoning: high (budget: 2048)".
+	ReasoningBudget       *int                           `json:"reasoning_budget,omitempty"`
+	Tools                 map[string]ToolNamespaceConfig `json:"tools,omitzero"`
 	ConversationStartDate *string                        `json:"conversation_start_date,omitempty"`
 	KnowledgeCutoff       *string                        `json:"knowledge_cutoff,omitempty"`
 	ChannelConfig         *ChannelConfig                 `json:"channel_config,omitempty"`
+	// ExtraSections are rendered verbatim after the built-in sections, each
+	// as its own blank-line separated section, in order. Empty entries are
+	// skipped.
+	ExtraSections []string `json:"extra_sections,omitempty"`
 }
 
 // DeveloperContent carries developer instructions and tool declarations.
 type DeveloperContent struct {
 	Instructions *string                        `json:"instructions,omitempty"`
-	Tools        map[string]ToolNamespaceConfig `json:"tools,omitempty"`
+	Tools        map[string]ToolNamespaceConfig `json:"tools,omitzero"`
 }
 
 // ContentType enumerates renderable content kinds in a message.
@@ -96,11 +119,30 @@ type Content struct {
 // a list of structured Content items in JSON. Author is flattened as role/name.
 // Message.content is string or []Content in JSON; we implement custom codec.
 type Message struct {
-	Author      Author    `json:"role"` // Flattened: role + optional name
+	Author Author `json:"role"` // Flattened: role + optional name
+	// Recipient renders as " to=<recipient>" after the author in the header
+	// and is valid on every role; parsing recovers it for each role. Tool
+	// messages address the assistant this way.
 	Recipient   string    `json:"recipient,omitempty"`
 	Content     []Content `json:"content"`
 	Channel     string    `json:"channel,omitempty"`
 	ContentType string    `json:"content_type,omitempty"`
+	// JSON is set by a StreamParser with SetParseJSON(true) on messages whose
+	// content type is <|constrain|>json. It is never rendered or serialized.
+	JSON *JSONContent `json:"-"`
+	// RawHeader is set by a StreamParser with SetKeepRawHeader(true) to the
+	// decoded header text as received, before normalization, for headers the
+	// structured fields cannot fully describe. It is never rendered or
+	// serialized.
+	RawHeader string `json:"-"`
+}
+
+// JSONContent is the parsed body of a constrained-JSON message.
+type JSONContent struct {
+	// Raw is the message text as JSON; nil when Valid is false.
+	Raw json.RawMessage
+	// Valid reports whether the text parsed as JSON.
+	Valid bool
 }
 
 // Conversation is an ordered list of messages.
@@ -116,6 +158,104 @@ func (c *Conversation) FromMessages(msgs []Message) {
 // RenderConversationConfig controls rendering behavior (e.g., analysis dropping).
 type RenderConversationConfig struct {
 	AutoDropAnalysis bool `json:"auto_drop_analysis"`
+	// ValidateConstrainedContent checks messages whose content type is
+	// <|constrain|>json or <|constrain|>regex and fails the render when the
+	// text content is not valid JSON or a compilable regular expression.
+	ValidateConstrainedContent bool `json:"validate_constrained_content,omitempty"`
+	// KnowledgeCutoffLabel and CurrentDateLabel replace the English labels
+	// "Knowledge cutoff" and "Current date" in the system message. The ": "
+	// separator and the values from SystemContent are unchanged. Empty keeps
+	// the defaults.
+	KnowledgeCutoffLabel string `json:"knowledge_cutoff_label,omitempty"`
+	CurrentDateLabel     string `json:"current_date_label,omitempty"`
+	// AutoConversationStartDate fills in today's date as YYYY-MM-DD for
+	// system messages whose ConversationStartDate is nil. Now supplies the
+	// clock and defaults to time.Now. Off by default so renders stay
+	// deterministic.
+	AutoConversationStartDate bool             `json:"auto_conversation_start_date,omitempty"`
+	Now                       func() time.Time `json:"-"`
+	// InstructionsHeader and ToolsHeader replace the "# Instructions" and
+	// "# Tools" heading lines in developer and system messages, e.g.
+	// "# Anweisungen". The surrounding blank lines are unchanged. Empty keeps
+	// the defaults.
+	InstructionsHeader string `json:"instructions_header,omitempty"`
+	ToolsHeader        string `json:"tools_header,omitempty"`
+	// EmptyToolsSection renders the tools heading for a system or developer
+	// message whose Tools map is empty but non-nil, i.e. declared with no
+	// tools, followed by EmptyToolsNote as its own paragraph when set (e.g.
+	// "No tools are available."). A nil Tools map still renders nothing.
+	EmptyToolsSection bool   `json:"empty_tools_section,omitempty"`
+	EmptyToolsNote    string `json:"empty_tools_note,omitempty"`
+	// ToolReturnType replaces the "any" return type of rendered tool
+	// signatures, e.g. "Promise<any>" for "type f = () => Promise<any>;".
+	// Empty keeps "any".
+	ToolReturnType string `json:"tool_return_type,omitempty"`
+	// OmitModelIdentity, OmitKnowledgeCutoff and OmitReasoning drop the
+	// model identity line, the knowledge cutoff line and the "Reasoning:"
+	// section from system messages. The remaining sections keep their
+	// blank-line separation; the current date line is kept whenever set.
+	OmitModelIdentity   bool `json:"omit_model_identity,omitempty"`
+	OmitKnowledgeCutoff bool `json:"omit_knowledge_cutoff,omitempty"`
+	OmitReasoning       bool `json:"omit_reasoning,omitempty"`
+	// OmitDefaultKnowledgeCutoff drops the knowledge cutoff line only when
+	// SystemContent.KnowledgeCutoff is nil or empty, instead of falling back
+	// to "2024-06". An explicit cutoff still renders.
+	OmitDefaultKnowledgeCutoff bool `json:"omit_default_knowledge_cutoff,omitempty"`
+	// EmptyChannelIsFinal makes RenderConversationForTraining treat a
+	// trailing assistant message without a channel or recipient as the final
+	// answer and end it with <|return|>, for prompts that leave the final
+	// channel implicit. Without it only Channel "final" counts.
+	EmptyChannelIsFinal bool `json:"empty_channel_is_final,omitempty"`
+	// ChannelRequiredWarnOnly reports assistant messages without a channel
+	// in a conversation whose system message sets ChannelConfig with
+	// ChannelRequired as RenderWarning events instead of failing the render.
+	ChannelRequiredWarnOnly bool `json:"channel_required_warn_only,omitempty"`
+	// AllowFunctionCallsOutsideCommentary disables the check that assistant
+	// calls to the functions namespace use the commentary channel when
+	// function tools are declared.
+	AllowFunctionCallsOutsideCommentary bool `json:"allow_function_calls_outside_commentary,omitempty"`
+	// ValidateReasoningEffort rejects system messages whose ReasoningEffort
+	// is neither a known level (see ReasoningEffort.Valid) nor listed in
+	// ExtraReasoningEfforts, with an *InvalidReasoningEffortError. Off by
+	// default, so any value renders.
+	ValidateReasoningEffort bool              `json:"validate_reasoning_effort,omitempty"`
+	ExtraReasoningEfforts   []ReasoningEffort `json:"extra_reasoning_efforts,omitempty"`
+	// NormalizeNewlines rewrites "\r\n" and lone "\r" to "\n" in message
+	// content before tokenization. Headers and special tokens are untouched.
+	NormalizeNewlines bool `json:"normalize_newlines,omitempty"`
+	// NoDefaultChannels stops system messages without a ChannelConfig from
+	// getting the default analysis/commentary/final channel config, so no
+	// "# Valid channels:" line is rendered. An explicit ChannelConfig still
+	// renders as usual.
+	NoDefaultChannels bool `json:"no_default_channels,omitempty"`
+	// OmitTrailingMessageToken makes RenderConversationForCompletionWithHeader
+	// stop after the pre-filled header instead of appending <|message|>.
+	OmitTrailingMessageToken bool `json:"omit_trailing_message_token,omitempty"`
+	// AllowSpecialLiteralsInContent disables the check that rejects text
+	// content containing structural special-token literals such as
+	// "<|channel|>". Such text is encoded as ordinary text, never as the
+	// special token, so it usually indicates a bug.
+	AllowSpecialLiteralsInContent bool `json:"allow_special_literals_in_content,omitempty"`
+	// DetectRenderedContent rejects text content framed like a rendered
+	// message (<|start|> followed later by <|message|>), which usually means
+	// decoded render output was passed back in as content. The error
+	// suggests passing the original messages instead. It applies even when
+	// AllowSpecialLiteralsInContent is set.
+	DetectRenderedContent bool `json:"detect_rendered_content,omitempty"`
+	// StringMessageSeparator is inserted between messages by
+	// RenderConversationString only, e.g. "\n" for readable transcripts.
+	// Token renders and RenderConversationDebug never include it. Empty
+	// concatenates messages directly.
+	StringMessageSeparator string `json:"string_message_separator,omitempty"`
+	// SanitizeContent strips a leading U+FEFF (UTF-8 byte order mark) from
+	// text content before encoding. Other code points, including
+	// U+200C/U+200D which carry meaning in some scripts and emoji, are kept.
+	// System and developer content are unchanged.
+	SanitizeContent bool `json:"sanitize_content,omitempty"`
+	// StripZeroWidthSpace removes every U+200B (zero width space) from text
+	// content before encoding, independently of SanitizeContent. It is off by
+	// default because some text uses U+200B deliberately as a break hint.
+	StripZeroWidthSpace bool `json:"strip_zero_width_space,omitempty"`
 }
 
 // MarshalJSON implements the JSON shape used by the Harmony format, where
@@ -0,0 +1,386 @@
+package harmony
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// DuplicateNameError reports tool or namespace names that are declared more
+// than once and would render as conflicting declarations.
+type DuplicateNameError struct {
+	// Kind is "tool" for duplicate tools within a namespace or "namespace"
+	// for namespaces declared more than once across a conversation.
+	Kind string
+	// Namespace is the enclosing namespace for duplicate tools.
+	Namespace string
+	// Names lists each conflicting name once, sorted.
+	Names []string
+}
+
+func (e *DuplicateNameError) Error() string {
+	if e.Kind == "tool" {
+		return fmt.Sprintf("duplicate tool names in namespace %s: %s", e.Namespace, strings.Join(e.Names, ", "))
+	}
+	return fmt.Sprintf("duplicate %s names: %s", e.Kind, strings.Join(e.Names, ", "))
+}
+
+// FunctionCallChannelError reports an assistant call to a function tool that
+// is not on the commentary channel, as required when function tools are
+// declared.
+type FunctionCallChannelError struct {
+	// Index is the position of the offending message in the conversation.
+	Index     int
+	Channel   string
+	Recipient string
+}
+
+func (e *FunctionCallChannelError) Error() string {
+	return fmt.Sprintf("message %d: call to %s must use the commentary channel, got %q", e.Index, e.Recipient, e.Channel)
+}
+
+// MissingChannelError reports an assistant message without a channel in a
+// conversation whose system message requires one.
+type MissingChannelError struct {
+	// Index is the position of the offending message in the conversation.
+	Index int
+}
+
+func (e *MissingChannelError) Error() string {
+	return fmt.Sprintf("message %d: assistant message has no channel but the system message requires one", e.Index)
+}
+
+// InvalidReasoningEffortError reports a system message whose reasoning effort
+// is not a known level, when ValidateReasoningEffort is set.
+type InvalidReasoningEffortError struct {
+	// Index is the position of the offending message in the conversation.
+	Index  int
+	Effort ReasoningEffort
+}
+
+func (e *InvalidReasoningEffortError) Error() string {
+	return fmt.Sprintf("message %d: unknown reasoning effort %q", e.Index, e.Effort)
+}
+
+// checkReasoningEffort rejects system content in m whose ReasoningEffort is
+// neither valid nor one of extra (compared case-insensitively).
+func checkReasoningEffort(idx int, m Message, extra []ReasoningEffort) error {
+	for _, c := range m.Content {
+		if c.Type != ContentSystem || c.System == nil || c.System.ReasoningEffort == nil {
+			continue
+		}
+		eff := *c.System.ReasoningEffort
+		if eff.Valid() || slices.ContainsFunc(extra, func(x ReasoningEffort) bool { return strings.EqualFold(string(x), string(eff)) }) {
+			continue
+		}
+		return &InvalidReasoningEffortError{Index: idx, Effort: eff}
+	}
+	return nil
+}
+
+// channelRequired reports whether a system message in msgs sets an explicit
+// ChannelConfig with ChannelRequired. The default channel config rendered
+// for a system message without one is not enforced, so conversations that
+// never declared channels keep rendering.
+func channelRequired(msgs []Message) bool {
+	for _, m := range msgs {
+		if m.Author.Role != RoleSystem {
+			continue
+		}
+		for _, c := range m.Content {
+			if c.Type == ContentSystem && c.System != nil && c.System.ChannelConfig != nil && c.System.ChannelConfig.ChannelRequired {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkChannelPresent rejects assistant messages without a channel.
+func checkChannelPresent(idx int, m Message) error {
+	if m.Author.Role == RoleAssistant && m.Channel == "" {
+		return &MissingChannelError{Index: idx}
+	}
+	return nil
+}
+
+// checkContentItems reports content items that cannot be rendered: system
+// and developer items without their content and unknown content types.
+// Render paths run it before emitting any of the message's tokens.
+func checkContentItems(m *Message) error {
+	for _, c := range m.Content {
+		switch c.Type {
+		case ContentText:
+		case ContentSystem:
+			if c.System == nil {
+				return errors.New("nil SystemContent")
+			}
+		case ContentDeveloper:
+			if c.Developer == nil {
+				return errors.New("nil DeveloperContent")
+			}
+		default:
+			return fmt.Errorf("unknown content type: %v", c.Type)
+		}
+	}
+	return nil
+}
+
+// checkFunctionCallChannel rejects assistant messages addressed to the
+// functions namespace on any channel other than commentary. Built-in tools
+// (e.g. browser, python) are addressed from analysis and are not checked.
+func checkFunctionCallChannel(idx int, m Message) error {
+	if m.Author.Role != RoleAssistant || !strings.HasPrefix(m.Recipient, "functions.") {
+		return nil
+	}
+	if m.Channel != "commentary" {
+		return &FunctionCallChannelError{Index: idx, Channel: m.Channel, Recipient: m.Recipient}
+	}
+	return nil
+}
+
+// Validate reports a *DuplicateNameError when two tools in the namespace share
+// the same name.
+func (ns *ToolNamespaceConfig) Validate() error {
+	seen := make(map[string]int, len(ns.Tools))
+	for i := range ns.Tools {
+		seen[ns.Tools[i].Name]++
+	}
+	if dups := duplicates(seen); len(dups) > 0 {
+		return &DuplicateNameError{Kind: "tool", Namespace: ns.Name, Names: dups}
+	}
+	return nil
+}
+
+// Validate checks the conversation's content items and tool declarations
+// across its system and developer messages. It reports system or developer
+// items with nil content, unknown content types, duplicate tools within a
+// namespace and namespaces declared more than once.
+func (c *Conversation) Validate() error {
+	seen := map[string]int{}
+	check := func(tools map[string]ToolNamespaceConfig) error {
+		names := make([]string, 0, len(tools))
+		for n := range tools {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			ns := tools[n]
+			if err := ns.Validate(); err != nil {
+				return err
+			}
+			seen[ns.Name]++
+		}
+		return nil
+	}
+	for i := range c.Messages {
+		if err := checkContentItems(&c.Messages[i]); err != nil {
+			return fmt.Errorf("message %d: %w", i, err)
+		}
+		for _, ct := range c.Messages[i].Content {
+			switch {
+			case ct.Type == ContentSystem && ct.System != nil:
+				if err := check(ct.System.Tools); err != nil {
+					return err
+				}
+			case ct.Type == ContentDeveloper && ct.Developer != nil:
+				if err := check(ct.Developer.Tools); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if dups := duplicates(seen); len(dups) > 0 {
+		return &DuplicateNameError{Kind: "namespace", Names: dups}
+	}
+	return nil
+}
+
+// duplicates returns the sorted keys whose count exceeds one.
+func duplicates(counts map[string]int) []string {
+	var out []string
+	for n, c := range counts {
+		if c > 1 {
+			out = append(out, n)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// validateConstrainedContent checks that the text content of a message with a
+// <|constrain|>json or <|constrain|>regex content type is well-formed. Other
+// content types are accepted as-is.
+func validateConstrainedContent(msg Message) error {
+	kind, ok := strings.CutPrefix(strings.TrimSpace(msg.ContentType), "<|constrain|>")
+	if !ok {
+		return nil
+	}
+	var sb strings.Builder
+	for _, c := range msg.Content {
+		if c.Type == ContentText {
+			sb.WriteString(c.Text)
+		}
+	}
+	text := sb.String()
+	switch strings.TrimSpace(kind) {
+	case "json":
+		if !json.Valid([]byte(text)) {
+			return fmt.Errorf("content is not valid JSON for content type %s", msg.ContentType)
+		}
+	case "regex":
+		if _, err := regexp.Compile(text); err != nil {
+			return fmt.Errorf("content is not a valid regex for content type %s: %w", msg.ContentType, err)
+		}
+	}
+	return nil
+}
+
+// checkHeader validates the header fields of msg so the rendered header can
+// be parsed back unambiguously.
+func checkHeader(msg Message) error {
+	if err := checkChannel(msg.Channel); err != nil {
+		return err
+	}
+	if err := checkHeaderName("author name", msg.Author.Name); err != nil {
+		return err
+	}
+	return checkHeaderName("recipient", msg.Recipient)
+}
+
+// checkHeaderName restricts author names and recipients to letters, digits
+// and "._-/". Whitespace, "<", ":" and "=" would make the header ambiguous
+// for the parser (e.g. a name containing " to=").
+func checkHeaderName(kind, s string) error {
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			continue
+		}
+		switch r {
+		case '.', '_', '-', '/':
+			continue
+		}
+		return fmt.Errorf("%s %q contains invalid character %q", kind, s, r)
+	}
+	return nil
+}
+
+// structuralSpecials are the special-token literals that delimit Harmony
+// messages and headers.
+var structuralSpecials = []string{
+	"<|start|>", "<|end|>", "<|message|>", "<|channel|>",
+	"<|constrain|>", "<|return|>", "<|call|>",
+}
+
+// checkContentSpecials rejects text content that embeds a structural special
+// literal. Content is encoded as ordinary text, so the literal would not act
+// as a delimiter and would confuse anything re-tokenizing the string form.
+func checkContentSpecials(msg Message) error {
+	for _, c := range msg.Content {
+		if c.Type != ContentText || !strings.Contains(c.Text, "<|") {
+			continue
+		}
+		for _, lit := range structuralSpecials {
+			if strings.Contains(c.Text, lit) {
+				return fmt.Errorf("content text contains special token literal %s", lit)
+			}
+		}
+	}
+	return nil
+}
+
+// checkRenderedContent rejects text content framed like a rendered message,
+// for RenderConversationConfig.DetectRenderedContent.
+func checkRenderedContent(msg Message) error {
+	for _, c := range msg.Content {
+		if c.Type == ContentText && looksRendered(c.Text) {
+			return errors.New("content text looks like an already rendered conversation; pass the original messages instead of decoded render output")
+		}
+	}
+	return nil
+}
+
+// looksRendered reports whether s contains a rendered message frame:
+// <|start|> followed later by <|message|>.
+func looksRendered(s string) bool {
+	_, rest, ok := strings.Cut(s, "<|start|>")
+	return ok && strings.Contains(rest, "<|message|>")
+}
+
+// checkChannel rejects channel names containing whitespace: the header parser
+// reads a channel up to the next space, so such names cannot round-trip.
+func checkChannel(ch string) error {
+	if strings.ContainsFunc(ch, unicode.IsSpace) {
+		return fmt.Errorf("channel %q must not contain whitespace", ch)
+	}
+	return nil
+}
+
+// TokenStructureError reports malformed Harmony framing found by
+// ValidateTokenStructure.
+type TokenStructureError struct {
+	// Index is the position of the offending token, or len(tokens) when the
+	// sequence ends inside a message.
+	Index  int
+	Reason string
+}
+
+func (e *TokenStructureError) Error() string {
+	return fmt.Sprintf("token %d: %s", e.Index, e.Reason)
+}
+
+// ValidateTokenStructure checks the framing of tokens without decoding any
+// text: every message is <|start|>, a non-empty header that may contain
+// <|channel|> and <|constrain|>, <|message|>, content free of special tokens,
+// and one of <|end|>, <|call|> or <|return|>. The first violation is returned
+// as a *TokenStructureError. Passing does not guarantee that
+// ParseMessagesFromCompletionTokens succeeds, since header text is not
+// interpreted.
+func (e *Encoding) ValidateTokenStructure(tokens []uint32) error {
+	bad := func(i int, reason string) error { return &TokenStructureError{Index: i, Reason: reason} }
+	state := stExpectStart
+	headerLen := 0
+	for i, tok := range tokens {
+		_, stop := e.stopAll[tok]
+		switch state {
+		case stExpectStart:
+			if tok != e.idStart {
+				return bad(i, "expected <|start|>")
+			}
+			state, headerLen = stHeader, 0
+		case stHeader:
+			switch {
+			case tok == e.idMessage:
+				if headerLen == 0 {
+					return bad(i, "empty header before <|message|>")
+				}
+				state = stContent
+			case stop:
+				return bad(i, "terminator inside header")
+			case tok == e.idChannel || tok == e.idConstrain || !e.bpe.IsSpecialToken(tok):
+				headerLen++
+			default:
+				return bad(i, "unexpected special token in header")
+			}
+		case stContent:
+			switch {
+			case stop:
+				state = stExpectStart
+			case e.bpe.IsSpecialToken(tok):
+				return bad(i, "special token inside message content")
+			}
+		}
+	}
+	switch state {
+	case stHeader:
+		return bad(len(tokens), "sequence ends inside a header")
+	case stContent:
+		return bad(len(tokens), "sequence ends inside an unterminated message")
+	}
+	return nil
+}